@@ -0,0 +1,216 @@
+package domain
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+)
+
+// APIKey identifies a service principal such as a batch job or a back-office tool
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	SecretHash []byte     `json:"-"`
+}
+
+type APIKeyStore interface {
+	Create(k APIKey) error
+	Get(id string) (APIKey, error)
+	List() ([]APIKey, error)
+	Delete(id string) error
+}
+
+type MemoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: map[string]APIKey{}}
+}
+
+func (m *MemoryAPIKeyStore) Create(k APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[k.ID] = k
+	return nil
+}
+
+func (m *MemoryAPIKeyStore) Get(id string) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	k, ok := m.keys[id]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return k, nil
+}
+
+func (m *MemoryAPIKeyStore) List() ([]APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]APIKey, 0, len(m.keys))
+	for _, k := range m.keys {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+func (m *MemoryAPIKeyStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[id]; !ok {
+		return ErrAPIKeyNotFound
+	}
+	delete(m.keys, id)
+	return nil
+}
+
+// APIKeys issues and verifies api keys.
+// A key is sent as "<id>.<secret>" and only a hash of the secret is stored.
+type APIKeys struct {
+	store APIKeyStore
+	now   func() time.Time
+}
+
+func NewAPIKeys(store APIKeyStore) *APIKeys {
+	return &APIKeys{store: store, now: time.Now}
+}
+
+// Issue creates a new key and returns it along with the only copy of its plain text value
+func (a *APIKeys) Issue(name string, scopes, allowedIPs []string, expiresAt *time.Time) (APIKey, string, error) {
+	for _, ip := range allowedIPs {
+		if _, err := parseAllowedIP(ip); err != nil {
+			return APIKey{}, "", err
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(encoded))
+
+	k := APIKey{
+		ID:         uuid.NewV4().String(),
+		Name:       name,
+		Scopes:     scopes,
+		AllowedIPs: allowedIPs,
+		ExpiresAt:  expiresAt,
+		CreatedAt:  a.now(),
+		SecretHash: hash[:],
+	}
+
+	if err := a.store.Create(k); err != nil {
+		return APIKey{}, "", err
+	}
+
+	return k, k.ID + "." + encoded, nil
+}
+
+// Verify returns the key matching the plain text value when it is valid for the source IP
+func (a *APIKeys) Verify(key, sourceIP string) (APIKey, error) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	k, err := a.store.Get(parts[0])
+	if err == ErrAPIKeyNotFound {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	hash := sha256.Sum256([]byte(parts[1]))
+	if subtle.ConstantTimeCompare(hash[:], k.SecretHash) != 1 {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	if k.ExpiresAt != nil && !a.now().Before(*k.ExpiresAt) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	if !k.allows(sourceIP) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	return k, nil
+}
+
+func (a *APIKeys) List() ([]APIKey, error) {
+	return a.store.List()
+}
+
+func (a *APIKeys) Revoke(id string) error {
+	return a.store.Delete(id)
+}
+
+// allows checks the source IP against the allow-list, an empty list allowing every IP
+func (k APIKey) allows(sourceIP string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(sourceIP)
+	if ip == nil {
+		return false
+	}
+
+	for _, allowed := range k.AllowedIPs {
+		network, err := parseAllowedIP(allowed)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseAllowedIP accepts either a single IP or a CIDR range
+func parseAllowedIP(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid ip " + s)
+		}
+
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys_Verify(t *testing.T) {
+	now := time.Date(2020, 9, 20, 12, 0, 0, 0, time.UTC)
+	expiry := now.Add(time.Hour)
+
+	keys := NewAPIKeys(NewMemoryAPIKeyStore())
+	keys.now = func() time.Time { return now }
+
+	_, open, err := keys.Issue("payroll", []string{"payments:write"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, restricted, err := keys.Issue("back-office", []string{"payments:read"}, []string{"10.0.0.0/8", "192.168.1.10"}, &expiry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		ip      string
+		elapsed time.Duration
+		wantErr bool
+	}{
+		{name: "valid key", key: open, ip: "1.2.3.4"},
+		{name: "allowed cidr", key: restricted, ip: "10.1.2.3"},
+		{name: "allowed ip", key: restricted, ip: "192.168.1.10"},
+		{name: "ip not allowed", key: restricted, ip: "192.168.1.11", wantErr: true},
+		{name: "wrong secret", key: strings.SplitN(open, ".", 2)[0] + ".abc", ip: "1.2.3.4", wantErr: true},
+		{name: "unknown key", key: "abc.def", ip: "1.2.3.4", wantErr: true},
+		{name: "malformed key", key: "abc", ip: "1.2.3.4", wantErr: true},
+		{name: "expired key", key: restricted, ip: "10.1.2.3", elapsed: time.Hour, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now = now.Add(test.elapsed)
+
+			_, err := keys.Verify(test.key, test.ip)
+			if (err != nil) != test.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestAPIKeys_Revoke(t *testing.T) {
+	keys := NewAPIKeys(NewMemoryAPIKeyStore())
+
+	k, key, err := keys.Issue("payroll", []string{"payments:write"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keys.Revoke(k.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keys.Verify(key, "1.2.3.4"); err != ErrInvalidAPIKey {
+		t.Fatalf("expected %v got %v", ErrInvalidAPIKey, err)
+	}
+
+	if _, _, err := keys.Issue("invalid", nil, []string{"not an ip"}, nil); err == nil {
+		t.Fatal("expected invalid allow-list to be rejected")
+	}
+}
@@ -0,0 +1,56 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+// BalanceOpener opens the balance of newly registered users
+type BalanceOpener interface {
+	OpenBalance(traceID, userID string) error
+}
+
+// openBalanceRequest is the payload of the payment service endpoint
+type openBalanceRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// PaymentBalances opens balances through the payment service internal endpoint
+type PaymentBalances struct {
+	client *http.Client
+	url    string
+}
+
+func NewPaymentBalances(client *http.Client) *PaymentBalances {
+	return &PaymentBalances{client: client, url: "http://payment/balances"}
+}
+
+func (p *PaymentBalances) OpenBalance(traceID, userID string) error {
+	body, err := json.Marshal(openBalanceRequest{UserID: userID})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add(common.TraceIDHeader, traceID)
+
+	response, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+		return fmt.Errorf("could not open balance: payment service returned %d", response.StatusCode)
+	}
+
+	return nil
+}
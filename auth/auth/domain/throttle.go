@@ -0,0 +1,256 @@
+package domain
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Attempts holds the failed authentication state of a single key (a user from a source IP, or a source IP)
+type Attempts struct {
+	Failures    int
+	NextAttempt time.Time
+	LockedUntil time.Time
+	// Pending counts the attempts begun and not known to have failed or succeeded yet, until PendingUntil
+	Pending      int
+	PendingUntil time.Time
+	// ExpiresAt is when the attempts are forgotten
+	ExpiresAt time.Time
+}
+
+// AttemptStore persists failed attempts so that they can be shared between auth instances.
+// Attempts past their ExpiresAt are forgotten.
+type AttemptStore interface {
+	Get(key string) (Attempts, error)
+	// Update replaces the attempts of the key with those fn returns, in a single atomic operation
+	Update(key string, fn func(a Attempts) Attempts) error
+	Delete(key string) error
+}
+
+// attemptSweepInterval is how often MemoryAttemptStore drops the expired attempts
+const attemptSweepInterval = time.Minute
+
+type MemoryAttemptStore struct {
+	mu        sync.Mutex
+	attempts  map[string]Attempts
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: map[string]Attempts{}, now: time.Now}
+}
+
+func (m *MemoryAttemptStore) Get(key string) (Attempts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current(key, m.now()), nil
+}
+
+func (m *MemoryAttemptStore) Update(key string, fn func(a Attempts) Attempts) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	a := fn(m.current(key, now))
+	if now.Before(a.ExpiresAt) {
+		m.attempts[key] = a
+	} else {
+		delete(m.attempts, key)
+	}
+	return nil
+}
+
+func (m *MemoryAttemptStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.attempts, key)
+	return nil
+}
+
+// current must be called with the lock held
+func (m *MemoryAttemptStore) current(key string, now time.Time) Attempts {
+	a := m.attempts[key]
+	if !now.Before(a.ExpiresAt) {
+		return Attempts{}
+	}
+	return a
+}
+
+// sweep drops expired attempts so that random user names and IPs do not grow the store forever
+func (m *MemoryAttemptStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < attemptSweepInterval {
+		return
+	}
+
+	for key, a := range m.attempts {
+		if !now.Before(a.ExpiresAt) {
+			delete(m.attempts, key)
+		}
+	}
+	m.lastSweep = now
+}
+
+// LockoutEvent is recorded every time a key gets locked out
+type LockoutEvent struct {
+	Kind        string    `json:"kind"`
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+type AuditLog interface {
+	RecordLockout(e LockoutEvent)
+}
+
+// LogAuditLog writes audit events to the service logs
+type LogAuditLog struct{}
+
+func (LogAuditLog) RecordLockout(e LockoutEvent) {
+	log.Warn().Bool("audit", true).
+		Str("kind", e.Kind).
+		Str("key", e.Key).
+		Int("failures", e.Failures).
+		Time("locked_until", e.LockedUntil).
+		Msg("authentication lockout")
+}
+
+// Policy describes how failures are penalised.
+// Every failure delays the next allowed attempt by BaseDelay * 2^(failures-1), capped at MaxDelay.
+// Reaching MaxFailures locks the key out for LockoutDuration. Without MaxFailures the key is never locked out, only
+// delayed, and once it failed its attempts are made one at a time so that the delay bounds them.
+type Policy struct {
+	MaxFailures     int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+}
+
+// pendingTimeout is how long an attempt counts as pending, one not ended by then, e.g. as its instance stopped,
+// no longer counts
+const pendingTimeout = time.Minute
+
+// Throttle tracks failed attempts for one kind of key
+type Throttle struct {
+	kind   string
+	store  AttemptStore
+	audit  AuditLog
+	policy Policy
+	now    func() time.Time
+}
+
+func NewThrottle(kind string, store AttemptStore, audit AuditLog, policy Policy) *Throttle {
+	return &Throttle{
+		kind:   kind,
+		store:  store,
+		audit:  audit,
+		policy: policy,
+		now:    time.Now,
+	}
+}
+
+// Begin reports whether a new attempt can be made for the key and records it as pending, in a single operation of
+// the store so that concurrent attempts cannot all pass the check before their failures are recorded: pending attempts
+// count towards the lockout, no more than MaxFailures guesses are made before it. An attempt begun must be ended with
+// Failure, Success or Cancel.
+func (t *Throttle) Begin(key string) (bool, error) {
+	allowed := false
+
+	err := t.store.Update(t.storeKey(key), func(a Attempts) Attempts {
+		now := t.now()
+		if !now.Before(a.PendingUntil) {
+			a.Pending = 0
+		}
+
+		allowed = !now.Before(a.LockedUntil) && !now.Before(a.NextAttempt)
+		if t.policy.MaxFailures > 0 {
+			allowed = allowed && a.Failures+a.Pending < t.policy.MaxFailures
+		} else {
+			allowed = allowed && (a.Failures == 0 || a.Pending == 0)
+		}
+		if !allowed {
+			return a
+		}
+
+		a.Pending++
+		a.PendingUntil = now.Add(pendingTimeout)
+		a.ExpiresAt = t.expiry(a, now)
+		return a
+	})
+
+	return allowed, err
+}
+
+// Failure records a failed attempt and locks the key out once the policy threshold is reached
+func (t *Throttle) Failure(key string) error {
+	return t.store.Update(t.storeKey(key), func(a Attempts) Attempts {
+		now := t.now()
+		if a.Pending > 0 {
+			a.Pending--
+		}
+
+		a.Failures++
+		a.NextAttempt = now.Add(t.delay(a.Failures))
+
+		if t.policy.MaxFailures > 0 && a.Failures >= t.policy.MaxFailures {
+			a.LockedUntil = now.Add(t.policy.LockoutDuration)
+			t.audit.RecordLockout(LockoutEvent{
+				Kind:        t.kind,
+				Key:         key,
+				Failures:    a.Failures,
+				LockedUntil: a.LockedUntil,
+			})
+			a.Failures = 0
+		}
+
+		a.ExpiresAt = t.expiry(a, now)
+		return a
+	})
+}
+
+// Success clears the failures of the key
+func (t *Throttle) Success(key string) error {
+	return t.store.Delete(t.storeKey(key))
+}
+
+// Cancel ends an attempt that was neither a failure nor a success of the key, its failures are kept
+func (t *Throttle) Cancel(key string) error {
+	return t.store.Update(t.storeKey(key), func(a Attempts) Attempts {
+		if a.Pending > 0 {
+			a.Pending--
+		}
+		return a
+	})
+}
+
+// expiry forgets the failures of a key after a lockout duration without a new one, and never before its backoff,
+// lockout or pending attempts are over
+func (t *Throttle) expiry(a Attempts, now time.Time) time.Time {
+	expiresAt := now.Add(t.policy.LockoutDuration)
+	for _, end := range []time.Time{a.NextAttempt, a.LockedUntil, a.PendingUntil} {
+		if end.After(expiresAt) {
+			expiresAt = end
+		}
+	}
+	return expiresAt
+}
+
+func (t *Throttle) delay(failures int) time.Duration {
+	d := t.policy.BaseDelay
+	for i := 1; i < failures && d < t.policy.MaxDelay; i++ {
+		d *= 2
+	}
+
+	if d > t.policy.MaxDelay {
+		return t.policy.MaxDelay
+	}
+
+	return d
+}
+
+func (t *Throttle) storeKey(key string) string {
+	return t.kind + ":" + key
+}
@@ -0,0 +1,197 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingAuditLog struct {
+	events []LockoutEvent
+}
+
+func (r *recordingAuditLog) RecordLockout(e LockoutEvent) {
+	r.events = append(r.events, e)
+}
+
+func TestThrottle(t *testing.T) {
+	now := time.Date(2020, 9, 20, 12, 0, 0, 0, time.UTC)
+	audit := &recordingAuditLog{}
+
+	store := NewMemoryAttemptStore()
+	store.now = func() time.Time { return now }
+
+	throttle := NewThrottle("user", store, audit, Policy{
+		MaxFailures:     3,
+		BaseDelay:       time.Second,
+		MaxDelay:        3 * time.Second,
+		LockoutDuration: time.Minute,
+	})
+	throttle.now = store.now
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		fail    bool
+		allowed bool
+	}{
+		{name: "first attempt", allowed: true, fail: true},
+		{name: "retry during backoff", elapsed: 500 * time.Millisecond, allowed: false},
+		{name: "retry after first backoff", elapsed: 500 * time.Millisecond, allowed: true, fail: true},
+		{name: "backoff doubles", elapsed: 1500 * time.Millisecond, allowed: false},
+		{name: "retry after second backoff", elapsed: 500 * time.Millisecond, allowed: true, fail: true},
+		{name: "locked out", elapsed: 30 * time.Second, allowed: false},
+		{name: "lockout expired", elapsed: 30 * time.Second, allowed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now = now.Add(test.elapsed)
+
+			allowed, err := throttle.Begin("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if allowed != test.allowed {
+				t.Fatalf("expected allowed to be %v got %v", test.allowed, allowed)
+			}
+
+			if test.fail {
+				if err := throttle.Failure("1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+
+	if len(audit.events) != 1 {
+		t.Fatalf("expected 1 lockout event got %d", len(audit.events))
+	}
+
+	if audit.events[0].Key != "1" || audit.events[0].Kind != "user" {
+		t.Fatalf("unexpected lockout event %+v", audit.events[0])
+	}
+}
+
+func TestThrottle_Success(t *testing.T) {
+	throttle := NewThrottle("ip", NewMemoryAttemptStore(), &recordingAuditLog{}, Policy{
+		MaxFailures:     3,
+		BaseDelay:       time.Hour,
+		MaxDelay:        time.Hour,
+		LockoutDuration: time.Hour,
+	})
+
+	if err := throttle.Failure("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if allowed, _ := throttle.Begin("10.0.0.1"); allowed {
+		t.Fatal("expected key to be backing off")
+	}
+
+	if err := throttle.Success("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if allowed, _ := throttle.Begin("10.0.0.1"); !allowed {
+		t.Fatal("expected key to be allowed after a success")
+	}
+}
+
+func TestThrottle_ConcurrentAttempts(t *testing.T) {
+	throttle := NewThrottle("user", NewMemoryAttemptStore(), &recordingAuditLog{}, Policy{
+		MaxFailures:     3,
+		BaseDelay:       time.Hour,
+		MaxDelay:        time.Hour,
+		LockoutDuration: time.Hour,
+	})
+
+	// attempts made at the same time all pass the check before any of them failed, only as many as the lockout
+	// allows are let through
+	begun := 0
+	for i := 0; i < 10; i++ {
+		allowed, err := throttle.Begin("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed {
+			begun++
+		}
+	}
+
+	if begun != 3 {
+		t.Fatalf("expected 3 attempts to be let through got %d", begun)
+	}
+}
+
+func TestMemoryAttemptStore_Expiry(t *testing.T) {
+	now := time.Date(2020, 9, 20, 12, 0, 0, 0, time.UTC)
+
+	store := NewMemoryAttemptStore()
+	store.now = func() time.Time { return now }
+
+	throttle := NewThrottle("ip", store, &recordingAuditLog{}, Policy{
+		MaxFailures:     3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Second,
+		LockoutDuration: time.Minute,
+	})
+	throttle.now = store.now
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := throttle.Failure(ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if a, _ := store.Get("ip:10.0.0.1"); a.Failures != 0 {
+		t.Fatalf("expected the failures to be forgotten got %+v", a)
+	}
+
+	// the next update sweeps the expired attempts
+	if err := throttle.Failure("10.0.0.3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.attempts) != 1 {
+		t.Fatalf("expected the expired attempts to be dropped, %d left", len(store.attempts))
+	}
+}
+
+func TestThrottle_WithoutLockout(t *testing.T) {
+	audit := &recordingAuditLog{}
+	throttle := NewThrottle("user", NewMemoryAttemptStore(), audit, Policy{LockoutDuration: time.Hour})
+
+	for i := 0; i < 10; i++ {
+		if allowed, _ := throttle.Begin("1"); !allowed {
+			t.Fatalf("expected attempt %d to be delayed only", i)
+		}
+
+		if err := throttle.Failure("1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(audit.events) != 0 {
+		t.Fatalf("expected no lockout got %+v", audit.events)
+	}
+
+	// once the key failed, concurrent attempts are made one at a time
+	if allowed, _ := throttle.Begin("1"); !allowed {
+		t.Fatal("expected a first attempt to be allowed")
+	}
+
+	if allowed, _ := throttle.Begin("1"); allowed {
+		t.Fatal("expected a concurrent attempt to wait")
+	}
+
+	if err := throttle.Cancel("1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if allowed, _ := throttle.Begin("1"); !allowed {
+		t.Fatal("expected an attempt once the other one ended")
+	}
+}
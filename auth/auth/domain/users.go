@@ -0,0 +1,244 @@
+package domain
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	ErrUserNotFound  = errors.New("user not found")
+	ErrUsernameTaken = errors.New("username already taken")
+)
+
+// ValidationError explains why a registration was refused
+type ValidationError struct {
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+type User struct {
+	ID           string    `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type UserStore interface {
+	Create(u User) error
+	GetByUsername(username string) (User, error)
+}
+
+type MemoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]User
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: map[string]User{}}
+}
+
+func (m *MemoryUserStore) Create(u User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := strings.ToLower(u.Username)
+	if _, ok := m.users[key]; ok {
+		return ErrUsernameTaken
+	}
+	m.users[key] = u
+	return nil
+}
+
+func (m *MemoryUserStore) GetByUsername(username string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[strings.ToLower(username)]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return u, nil
+}
+
+// TokenStore keeps a secret value per user, such as their current token or their signing secret
+type TokenStore interface {
+	Get(userID string) (string, error)
+	Set(userID, token string) error
+}
+
+type MemoryTokenStore struct {
+	mu     sync.RWMutex
+	tokens map[string]string
+}
+
+func NewMemoryTokenStore(tokens map[string]string) *MemoryTokenStore {
+	t := &MemoryTokenStore{tokens: map[string]string{}}
+	for userID, token := range tokens {
+		t.tokens[userID] = token
+	}
+	return t
+}
+
+func (m *MemoryTokenStore) Get(userID string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, ok := m.tokens[userID]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+	return t, nil
+}
+
+func (m *MemoryTokenStore) Set(userID, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[userID] = token
+	return nil
+}
+
+// NewToken returns a random token to be sent in the Authorization header
+func NewToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,36}$`)
+
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return &ValidationError{
+			Code:    "invalid_username",
+			Message: "username must be 3 to 36 letters, digits, '.', '_' or '-'",
+		}
+	}
+	return nil
+}
+
+// ValidatePassword rejects passwords that are short, made of a single kind of character or that contain the username
+func ValidatePassword(username, password string) error {
+	if len(password) < 10 || len(password) > 128 {
+		return &ValidationError{Code: "weak_password", Message: "password must be between 10 and 128 characters"}
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+
+	if !letter || !digit {
+		return &ValidationError{Code: "weak_password", Message: "password must contain both letters and digits"}
+	}
+
+	if strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return &ValidationError{Code: "weak_password", Message: "password must not contain the username"}
+	}
+
+	return nil
+}
+
+const (
+	passwordIterations = 100000
+	passwordSaltLength = 16
+	passwordKeyLength  = 32
+)
+
+// HashPassword derives a key from the password with PBKDF2-HMAC-SHA256 and a random salt.
+// The result is stored as "pbkdf2-sha256$<iterations>$<salt>$<key>".
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2([]byte(password), salt, passwordIterations, passwordKeyLength)
+
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword compares the password with a hash produced by HashPassword.
+// An empty hash, for an unknown user, still derives a key so that it takes as long as a real check.
+func CheckPassword(hash, password string) bool {
+	if hash == "" {
+		pbkdf2([]byte(password), make([]byte, passwordSaltLength), passwordIterations, passwordKeyLength)
+		return false
+	}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key := pbkdf2([]byte(password), salt, iterations, len(expected))
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// pbkdf2 implements RFC 8018 with HMAC-SHA256
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, blocks*hashLen)
+	buf := make([]byte, 4)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf, uint32(block))
+		prf.Write(buf)
+		u := prf.Sum(nil)
+
+		t := make([]byte, len(u))
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
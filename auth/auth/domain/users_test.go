@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{name: "strong password", username: "alice", password: "correct-horse-42"},
+		{name: "too short", username: "alice", password: "abc123", wantErr: true},
+		{name: "letters only", username: "alice", password: "correcthorsebattery", wantErr: true},
+		{name: "digits only", username: "alice", password: "12345678901", wantErr: true},
+		{name: "contains username", username: "alice", password: "Alice1234567", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePassword(tt.username, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidatePassword() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil && err.(*ValidationError).Code != "weak_password" {
+				t.Errorf("unexpected error code %s", err.(*ValidationError).Code)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("correct-horse-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := HashPassword("correct-horse-42")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hash == other {
+		t.Fatal("expected hashes of the same password to be salted differently")
+	}
+
+	if !CheckPassword(hash, "correct-horse-42") {
+		t.Fatal("expected password to match its hash")
+	}
+
+	if CheckPassword(hash, "correct-horse-43") {
+		t.Fatal("expected wrong password not to match")
+	}
+
+	if CheckPassword("", "correct-horse-42") {
+		t.Fatal("expected empty hash not to match")
+	}
+}
@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/domain"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+type CreateAPIKeyRequest struct {
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+// CreateAPIKeyResponse is the only time the plain text key and signing secret are returned
+type CreateAPIKeyResponse struct {
+	domain.APIKey
+	Key           string `json:"key"`
+	SigningSecret string `json:"signing_secret"`
+}
+
+// CreateAPIKey issues a new api key for a service principal
+func (s *RequestHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := CreateAPIKeyRequest{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not unmarshal request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if request.Name == "" || len(request.Scopes) == 0 {
+		log.Error().Str(logTraceID, traceID).Msg("api key name and scopes are required")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// the signing secret of a service is only issued here, api keys are created out of band
+	secret, err := domain.NewSigningSecret()
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not generate signing secret")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	k, key, err := s.apiKeys.Issue(request.Name, request.Scopes, request.AllowedIPs, request.ExpiresAt)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not issue api key")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = s.signingSecrets.Set(k.ID, secret)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not store signing secret")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).
+		Str("apiKey", k.ID).
+		Str("name", k.Name).
+		Strs("scopes", k.Scopes).
+		Msg("api key issued")
+
+	writeJSON(w, http.StatusCreated, CreateAPIKeyResponse{APIKey: k, Key: key, SigningSecret: secret}, traceID)
+}
+
+// ListAPIKeys returns every api key without their secrets
+func (s *RequestHandler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	keys, err := s.apiKeys.List()
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not list api keys")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, keys, traceID)
+}
+
+// RevokeAPIKey deletes an api key, requests using it are rejected straight away
+func (s *RequestHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+	id := mux.Vars(r)["id"]
+
+	err := s.apiKeys.Revoke(id)
+	if err == domain.ErrAPIKeyNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not revoke api key")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).Str("apiKey", id).Msg("api key revoked")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}, traceID string) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(response)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("error")
+	}
+}
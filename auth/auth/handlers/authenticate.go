@@ -1,36 +1,87 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/domain"
 	"github.com/heetch/MehdiSouilhed-technical-test/common"
 )
 
 type RequestHandler struct {
-	userTokens map[string]string
+	tokens         domain.TokenStore
+	signingSecrets domain.TokenStore
+	registry       domain.UserStore
+	balances       domain.BalanceOpener
+	userScopes     []string
+	apiKeys        *domain.APIKeys
+	// users delays the attempts of a user from any IP, userIPs locks a user out from an IP and ips an IP
+	users   *domain.Throttle
+	userIPs *domain.Throttle
+	ips     *domain.Throttle
 }
 
+// UserCheckAuthRequest carries either a user ID and token or an api key
 type UserCheckAuthRequest struct {
-	UserID string `json:"userID"`
-	Token  string `json:"token"`
+	UserID   string `json:"userID"`
+	Token    string `json:"token"`
+	APIKey   string `json:"apiKey,omitempty"`
+	SourceIP string `json:"sourceIP"`
+}
+
+// Principal is returned on successful authentication
+type Principal struct {
+	Type   string   `json:"type"`
+	ID     string   `json:"id"`
+	Scopes []string `json:"scopes"`
 }
 
 const (
 	logTraceID = "traceID"
+
+	PrincipalUser    = "user"
+	PrincipalService = "service"
 )
 
-func NewRequestHandler(tokens map[string]string) RequestHandler {
+// HasScope reports whether the principal was granted the scope
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// errInvalidCredentials is returned for every authentication failure so that callers
+// cannot tell an unknown user from a wrong token
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// NewRequestHandler builds a handler authenticating users through their tokens, every user being granted userScopes,
+// and services through their api keys. Registered users get a balance opened through balances.
+func NewRequestHandler(tokens, signingSecrets domain.TokenStore, registry domain.UserStore, balances domain.BalanceOpener,
+	userScopes []string, apiKeys *domain.APIKeys, users, userIPs, ips *domain.Throttle) RequestHandler {
 	return RequestHandler{
-		userTokens: tokens,
+		tokens:         tokens,
+		signingSecrets: signingSecrets,
+		registry:       registry,
+		balances:       balances,
+		userScopes:     userScopes,
+		apiKeys:        apiKeys,
+		users:          users,
+		userIPs:        userIPs,
+		ips:            ips,
 	}
 }
 
-// Authenticate checks that the user and token are valid
+// Authenticate checks that the user and token, or the api key, are valid and returns the authenticated principal
 func (s *RequestHandler) Authenticate(w http.ResponseWriter, r *http.Request) {
 	traceID := common.ExtractTraceIDFromReq(r)
 
@@ -50,34 +101,171 @@ func (s *RequestHandler) Authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if request.SourceIP == "" {
+		request.SourceIP = remoteIP(r)
+	}
+
 	log.Info().Str(logTraceID, traceID).
 		Str("user", request.UserID).
+		Str("principalType", request.principalType()).
+		Str("ip", request.SourceIP).
 		Msg("auth request")
 
-	err = s.checkAuth(request)
+	allowed, err := s.begin(request, traceID)
 	if err != nil {
-		log.Error().Err(err).Str(logTraceID, traceID)
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read failed attempts")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if !allowed {
+		log.Info().Str(logTraceID, traceID).
+			Str("user", request.UserID).
+			Str("ip", request.SourceIP).
+			Msg("auth failed")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	principal, err := s.principal(request)
+	if err != nil {
+		s.recordFailure(request, traceID)
+		log.Info().Str(logTraceID, traceID).
+			Str("user", request.UserID).
+			Str("principalType", request.principalType()).
+			Str("ip", request.SourceIP).
+			Msg("auth failed")
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
+	s.recordSuccess(request, traceID)
+
 	log.Info().Str(logTraceID, traceID).
-		Str("user", request.UserID).
+		Str("principal", principal.ID).
+		Str("principalType", principal.Type).
 		Msg("auth successful")
 
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, http.StatusOK, principal, traceID)
+}
+
+// principal authenticates the request with the api key when there is one and with the user token otherwise
+func (s *RequestHandler) principal(r UserCheckAuthRequest) (Principal, error) {
+	if r.APIKey != "" {
+		k, err := s.apiKeys.Verify(r.APIKey, r.SourceIP)
+		if err != nil {
+			return Principal{}, errInvalidCredentials
+		}
+
+		return Principal{Type: PrincipalService, ID: k.ID, Scopes: k.Scopes}, nil
+	}
+
+	if err := s.checkAuth(r); err != nil {
+		return Principal{}, err
+	}
+
+	return Principal{Type: PrincipalUser, ID: r.UserID, Scopes: s.userScopes}, nil
+}
+
+// begin checks that neither the source IP, nor the user (or api key) from that IP or from anywhere, are backing off or
+// locked out, and records the attempt. The source IP is checked first, so that an IP that is throttled cannot make the
+// failures of a user grow. Users are only locked out from an IP, and only delayed everywhere, so that nobody can lock
+// a user out. An attempt refused for the user from the IP counts as a failure of the IP.
+func (s *RequestHandler) begin(r UserCheckAuthRequest, traceID string) (bool, error) {
+	ok, err := s.ips.Begin(r.SourceIP)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	ok, err = s.userIPs.Begin(r.userIPThrottleKey())
+	if err != nil || !ok {
+		if err == nil {
+			logThrottleError(s.ips.Failure(r.SourceIP), "could not record ip failed attempt", traceID)
+		} else {
+			logThrottleError(s.ips.Cancel(r.SourceIP), "could not end ip attempt", traceID)
+		}
+		return false, err
+	}
+
+	ok, err = s.users.Begin(r.throttleKey())
+	if err != nil || !ok {
+		logThrottleError(s.userIPs.Cancel(r.userIPThrottleKey()), "could not end user attempt", traceID)
+		logThrottleError(s.ips.Cancel(r.SourceIP), "could not end ip attempt", traceID)
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *RequestHandler) recordFailure(r UserCheckAuthRequest, traceID string) {
+	logThrottleError(s.users.Failure(r.throttleKey()), "could not record user failed attempt", traceID)
+	logThrottleError(s.userIPs.Failure(r.userIPThrottleKey()), "could not record user failed attempt", traceID)
+	logThrottleError(s.ips.Failure(r.SourceIP), "could not record ip failed attempt", traceID)
+}
+
+// recordSuccess clears the failures of the user, those of the IP expire on their own: a caller logging into their own
+// account must not clear the failures of their guesses at others
+func (s *RequestHandler) recordSuccess(r UserCheckAuthRequest, traceID string) {
+	logThrottleError(s.users.Success(r.throttleKey()), "could not reset user failed attempts", traceID)
+	logThrottleError(s.userIPs.Success(r.userIPThrottleKey()), "could not reset user failed attempts", traceID)
+	logThrottleError(s.ips.Cancel(r.SourceIP), "could not end ip attempt", traceID)
+}
+
+func logThrottleError(err error, msg, traceID string) {
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg(msg)
+	}
 }
 
 func (s *RequestHandler) checkAuth(r UserCheckAuthRequest) error {
-	t, ok := s.userTokens[r.UserID]
+	t, err := s.tokens.Get(r.UserID)
+	if err != nil && err != domain.ErrUserNotFound {
+		return err
+	}
+	ok := err == nil
 
+	// compare against the submitted token itself when the user is unknown
+	// so that both paths take the same time
 	if !ok {
-		return errors.New("user not found")
+		t = r.Token
 	}
 
-	if t != r.Token {
-		return errors.New("invalid token")
+	if subtle.ConstantTimeCompare([]byte(t), []byte(r.Token)) != 1 || !ok || r.Token == "" {
+		return errInvalidCredentials
 	}
 
 	return nil
 }
+
+// remoteIP returns the caller address, as forwarded by the gateway when the request was proxied
+func remoteIP(r *http.Request) string {
+	if ip := r.Header.Get(common.ForwardedForHeader); ip != "" {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (r UserCheckAuthRequest) principalType() string {
+	if r.APIKey != "" {
+		return PrincipalService
+	}
+	return PrincipalUser
+}
+
+// throttleKey identifies whose failed attempts are counted: the user or the api key ID
+func (r UserCheckAuthRequest) throttleKey() string {
+	if r.APIKey != "" {
+		return PrincipalService + ":" + strings.SplitN(r.APIKey, ".", 2)[0]
+	}
+	return r.UserID
+}
+
+// userIPThrottleKey identifies the failed attempts of the user or api key from the source IP
+func (r UserCheckAuthRequest) userIPThrottleKey() string {
+	return r.throttleKey() + "@" + r.SourceIP
+}
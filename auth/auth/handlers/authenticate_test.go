@@ -1,7 +1,13 @@
 package handlers
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/domain"
 )
 
 func TestRequestHandler_checkAuth(t *testing.T) {
@@ -52,7 +58,7 @@ func TestRequestHandler_checkAuth(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			s := &RequestHandler{
-				userTokens: tt.fields.userTokens,
+				tokens: domain.NewMemoryTokenStore(tt.fields.userTokens),
 			}
 			if err := s.checkAuth(tt.args.r); (err != nil) != tt.wantErr {
 				t.Errorf("checkAuth() error = %v, wantErr %v", err, tt.wantErr)
@@ -60,3 +66,95 @@ func TestRequestHandler_checkAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestHandler_AuthenticateUniformResponses(t *testing.T) {
+	policy := domain.Policy{
+		MaxFailures:     2,
+		BaseDelay:       0,
+		MaxDelay:        0,
+		LockoutDuration: time.Hour,
+	}
+	store := domain.NewMemoryAttemptStore()
+	audit := domain.LogAuditLog{}
+
+	handler := NewRequestHandler(domain.NewMemoryTokenStore(map[string]string{"1": "abc"}), domain.NewMemoryTokenStore(nil),
+		domain.NewMemoryUserStore(), nil,
+		nil, domain.NewAPIKeys(domain.NewMemoryAPIKeyStore()),
+		domain.NewThrottle("user", store, audit, domain.Policy{}),
+		domain.NewThrottle("user_ip", store, audit, policy),
+		domain.NewThrottle("ip", store, audit, domain.Policy{MaxFailures: 100}))
+
+	authenticate := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/authenticate", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.Authenticate(rr, req)
+		return rr
+	}
+
+	unknown := authenticate(`{"userID": "2", "token": "abc"}`)
+	invalid := authenticate(`{"userID": "1", "token": "abcd"}`)
+
+	if unknown.Code != invalid.Code || unknown.Body.String() != invalid.Body.String() {
+		t.Fatalf("unknown user and invalid token responses differ: %d %q / %d %q",
+			unknown.Code, unknown.Body.String(), invalid.Code, invalid.Body.String())
+	}
+
+	if rr := authenticate(`{"userID": "1", "token": "wrong"}`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected %d got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// the user is now locked out, even with the right token
+	if rr := authenticate(`{"userID": "1", "token": "abc"}`); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected locked out user to get %d got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// the user is only locked out from the IP the failures came from
+	if rr := authenticate(`{"userID": "1", "token": "abc", "sourceIP": "10.0.0.2"}`); rr.Code != http.StatusOK {
+		t.Fatalf("expected the user to authenticate from another IP, got %d", rr.Code)
+	}
+}
+
+func TestRequestHandler_AuthenticateThrottles(t *testing.T) {
+	store := domain.NewMemoryAttemptStore()
+	audit := domain.LogAuditLog{}
+
+	handler := NewRequestHandler(domain.NewMemoryTokenStore(map[string]string{"1": "abc", "2": "def"}),
+		domain.NewMemoryTokenStore(nil), domain.NewMemoryUserStore(), nil,
+		nil, domain.NewAPIKeys(domain.NewMemoryAPIKeyStore()),
+		domain.NewThrottle("user", store, audit, domain.Policy{BaseDelay: time.Hour, MaxDelay: time.Hour}),
+		domain.NewThrottle("user_ip", store, audit, domain.Policy{MaxFailures: 100}),
+		domain.NewThrottle("ip", store, audit, domain.Policy{MaxFailures: 3, LockoutDuration: time.Hour}))
+
+	authenticate := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/authenticate", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		handler.Authenticate(rr, req)
+		return rr.Code
+	}
+
+	// a failure delays the user from every IP
+	if code := authenticate(`{"userID": "1", "token": "wrong", "sourceIP": "10.0.0.1"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d got %d", http.StatusUnauthorized, code)
+	}
+
+	if code := authenticate(`{"userID": "1", "token": "abc", "sourceIP": "10.0.0.2"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected the user to be delayed from another IP, got %d", code)
+	}
+
+	// logging into their own account does not clear the failures of the IP
+	if code := authenticate(`{"userID": "2", "token": "def", "sourceIP": "10.0.0.1"}`); code != http.StatusOK {
+		t.Fatalf("expected %d got %d", http.StatusOK, code)
+	}
+
+	if code := authenticate(`{"userID": "3", "token": "wrong", "sourceIP": "10.0.0.1"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d got %d", http.StatusUnauthorized, code)
+	}
+
+	if code := authenticate(`{"userID": "4", "token": "wrong", "sourceIP": "10.0.0.1"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected %d got %d", http.StatusUnauthorized, code)
+	}
+
+	if code := authenticate(`{"userID": "2", "token": "def", "sourceIP": "10.0.0.1"}`); code != http.StatusUnauthorized {
+		t.Fatalf("expected the IP to be locked out, got %d", code)
+	}
+}
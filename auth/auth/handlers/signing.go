@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/domain"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+type SigningSecretResponse struct {
+	Secret string `json:"secret"`
+}
+
+// VerifySignatureRequest is sent by the gateway with the canonical request it rebuilt
+type VerifySignatureRequest struct {
+	PrincipalID string `json:"principalID"`
+	Payload     string `json:"payload"`
+	Signature   string `json:"signature"`
+}
+
+// CreateSigningSecret issues a new signing secret to the authenticated user, replacing the previous one.
+// The token alone is not enough, as the secret is what protects payments from a stolen token: the user must also
+// give their username and password. Services get their signing secret with their api key.
+func (s *RequestHandler) CreateSigningSecret(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	principalID := r.Header.Get(common.PrincipalIDHeader)
+	if principalID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if r.Header.Get(common.PrincipalTypeHeader) != PrincipalUser {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "service signing secrets are issued with their api key")
+		return
+	}
+
+	request, ok := readCredentials(w, r, traceID)
+	if !ok {
+		return
+	}
+
+	user, err := s.checkPassword(request, r, traceID)
+	if err != nil && err != errInvalidCredentials {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not check password")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err != nil || user.ID != principalID {
+		log.Info().Str(logTraceID, traceID).Str("principal", principalID).Msg("signing secret refused")
+		common.WriteError(w, http.StatusUnauthorized, "invalid_credentials", "invalid username or password")
+		return
+	}
+
+	secret, err := domain.NewSigningSecret()
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not generate signing secret")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = s.signingSecrets.Set(principalID, secret)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not store signing secret")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).Str("principal", principalID).Msg("signing secret issued")
+
+	writeJSON(w, http.StatusCreated, SigningSecretResponse{Secret: secret}, traceID)
+}
+
+// VerifySignature checks the HMAC of a canonical request with the principal signing secret
+func (s *RequestHandler) VerifySignature(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := VerifySignatureRequest{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not unmarshal request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	secret, err := s.signingSecrets.Get(request.PrincipalID)
+	if err != nil && err != domain.ErrUserNotFound {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read signing secret")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err != nil || !domain.CheckSignature(secret, request.Payload, request.Signature) {
+		log.Info().Str(logTraceID, traceID).Str("principal", request.PrincipalID).Msg("invalid signature")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/domain"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type LoginResponse struct {
+	UserID string `json:"user_id"`
+	Token  string `json:"token"`
+}
+
+// Register creates a user with a hashed password and opens their balance in the payment service
+func (s *RequestHandler) Register(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	request, ok := readCredentials(w, r, traceID)
+	if !ok {
+		return
+	}
+
+	if err := domain.ValidateUsername(request.Username); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	if err := domain.ValidatePassword(request.Username, request.Password); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	_, err := s.registry.GetByUsername(request.Username)
+	if err == nil {
+		common.WriteError(w, http.StatusConflict, "username_taken", domain.ErrUsernameTaken.Error())
+		return
+	}
+
+	if err != domain.ErrUserNotFound {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not look up user")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	hash, err := domain.HashPassword(request.Password)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not hash password")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user := domain.User{
+		ID:           uuid.NewV4().String(),
+		Username:     request.Username,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}
+
+	// the balance is opened first: if creating the user then fails we are only left with an unused empty balance
+	err = s.balances.OpenBalance(traceID, user.ID)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not open balance")
+		common.WriteError(w, http.StatusServiceUnavailable, "balance_unavailable", "could not open a balance, please retry")
+		return
+	}
+
+	err = s.registry.Create(user)
+	if err == domain.ErrUsernameTaken {
+		common.WriteError(w, http.StatusConflict, "username_taken", err.Error())
+		return
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not create user")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).Str("user", user.ID).Msg("user registered")
+
+	writeJSON(w, http.StatusCreated, user, traceID)
+}
+
+// Login exchanges a username and password for a token, replacing any previous token of the user
+func (s *RequestHandler) Login(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	request, ok := readCredentials(w, r, traceID)
+	if !ok {
+		return
+	}
+
+	user, err := s.checkPassword(request, r, traceID)
+	if err == errInvalidCredentials {
+		log.Info().Str(logTraceID, traceID).Str("ip", remoteIP(r)).Msg("login failed")
+		common.WriteError(w, http.StatusUnauthorized, "invalid_credentials", "invalid username or password")
+		return
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not check password")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	token, err := domain.NewToken()
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not generate token")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = s.tokens.Set(user.ID, token)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not store token")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).Str("user", user.ID).Msg("login successful")
+
+	writeJSON(w, http.StatusOK, LoginResponse{UserID: user.ID, Token: token}, traceID)
+}
+
+// checkPassword returns the user the credentials are those of, or errInvalidCredentials.
+// Password checks share the brute-force protection of token authentication.
+func (s *RequestHandler) checkPassword(c Credentials, r *http.Request, traceID string) (domain.User, error) {
+	attempt := UserCheckAuthRequest{UserID: "login:" + c.Username, SourceIP: remoteIP(r)}
+
+	allowed, err := s.begin(attempt, traceID)
+	if err != nil {
+		return domain.User{}, err
+	}
+
+	user, err := s.registry.GetByUsername(c.Username)
+	if err != nil && err != domain.ErrUserNotFound {
+		return domain.User{}, err
+	}
+
+	if !allowed || err != nil || !domain.CheckPassword(user.PasswordHash, c.Password) {
+		if allowed {
+			s.recordFailure(attempt, traceID)
+		}
+		return domain.User{}, errInvalidCredentials
+	}
+
+	s.recordSuccess(attempt, traceID)
+	return user, nil
+}
+
+func readCredentials(w http.ResponseWriter, r *http.Request, traceID string) (Credentials, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return Credentials{}, false
+	}
+
+	request := Credentials{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not unmarshal request")
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request body must be a JSON object with username and password")
+		return Credentials{}, false
+	}
+
+	return request, true
+}
+
+func writeValidationError(w http.ResponseWriter, err error) {
+	if v, ok := err.(*domain.ValidationError); ok {
+		common.WriteError(w, http.StatusBadRequest, v.Code, v.Message)
+		return
+	}
+	common.WriteError(w, http.StatusBadRequest, "invalid_request", err.Error())
+}
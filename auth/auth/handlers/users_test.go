@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/domain"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+type mockBalances struct {
+	opened []string
+}
+
+func (m *mockBalances) OpenBalance(traceID, userID string) error {
+	m.opened = append(m.opened, userID)
+	return nil
+}
+
+func TestRequestHandler_RegisterAndLogin(t *testing.T) {
+	balances := &mockBalances{}
+	store := domain.NewMemoryAttemptStore()
+	policy := domain.Policy{MaxFailures: 100}
+
+	handler := NewRequestHandler(domain.NewMemoryTokenStore(nil), domain.NewMemoryTokenStore(nil),
+		domain.NewMemoryUserStore(), balances,
+		[]string{"payments:read"}, domain.NewAPIKeys(domain.NewMemoryAPIKeyStore()),
+		domain.NewThrottle("user", store, domain.LogAuditLog{}, policy),
+		domain.NewThrottle("user_ip", store, domain.LogAuditLog{}, policy),
+		domain.NewThrottle("ip", store, domain.LogAuditLog{}, policy))
+
+	call := func(h http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		h(rr, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return rr
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		status  int
+		code    string
+	}{
+		{name: "register", handler: handler.Register, body: `{"username": "alice", "password": "correct-horse-42"}`, status: http.StatusCreated},
+		{name: "duplicate username", handler: handler.Register, body: `{"username": "Alice", "password": "correct-horse-42"}`,
+			status: http.StatusConflict, code: "username_taken"},
+		{name: "weak password", handler: handler.Register, body: `{"username": "bob", "password": "secret"}`,
+			status: http.StatusBadRequest, code: "weak_password"},
+		{name: "invalid username", handler: handler.Register, body: `{"username": "b", "password": "correct-horse-42"}`,
+			status: http.StatusBadRequest, code: "invalid_username"},
+		{name: "wrong password", handler: handler.Login, body: `{"username": "alice", "password": "correct-horse-43"}`,
+			status: http.StatusUnauthorized, code: "invalid_credentials"},
+		{name: "unknown user", handler: handler.Login, body: `{"username": "bob", "password": "correct-horse-42"}`,
+			status: http.StatusUnauthorized, code: "invalid_credentials"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := call(tt.handler, tt.body)
+
+			if rr.Code != tt.status {
+				t.Fatalf("expected status %d got %d", tt.status, rr.Code)
+			}
+
+			if tt.code == "" {
+				return
+			}
+
+			e := common.ErrorResponse{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &e); err != nil {
+				t.Fatal(err)
+			}
+
+			if e.Code != tt.code {
+				t.Fatalf("expected error code %s got %s", tt.code, e.Code)
+			}
+		})
+	}
+
+	if len(balances.opened) != 1 {
+		t.Fatalf("expected 1 balance to be opened got %d", len(balances.opened))
+	}
+
+	rr := call(handler.Login, `{"username": "alice", "password": "correct-horse-42"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected login to succeed got %d", rr.Code)
+	}
+
+	login := LoginResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &login); err != nil {
+		t.Fatal(err)
+	}
+
+	if login.UserID != balances.opened[0] {
+		t.Fatalf("expected user %s got %s", balances.opened[0], login.UserID)
+	}
+
+	if err := handler.checkAuth(UserCheckAuthRequest{UserID: login.UserID, Token: login.Token}); err != nil {
+		t.Fatalf("expected login token to authenticate the user: %s", err)
+	}
+}
+
+func TestRequestHandler_CreateSigningSecret(t *testing.T) {
+	store := domain.NewMemoryAttemptStore()
+	policy := domain.Policy{MaxFailures: 100}
+	signingSecrets := domain.NewMemoryTokenStore(nil)
+
+	handler := NewRequestHandler(domain.NewMemoryTokenStore(nil), signingSecrets,
+		domain.NewMemoryUserStore(), &mockBalances{},
+		[]string{"payments:read"}, domain.NewAPIKeys(domain.NewMemoryAPIKeyStore()),
+		domain.NewThrottle("user", store, domain.LogAuditLog{}, policy),
+		domain.NewThrottle("user_ip", store, domain.LogAuditLog{}, policy),
+		domain.NewThrottle("ip", store, domain.LogAuditLog{}, policy))
+
+	ids := map[string]string{}
+	for _, username := range []string{"alice", "bob"} {
+		rr := httptest.NewRecorder()
+		handler.Register(rr, httptest.NewRequest(http.MethodPost, "/",
+			strings.NewReader(`{"username": "`+username+`", "password": "correct-horse-42"}`)))
+
+		user := domain.User{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+			t.Fatal(err)
+		}
+		ids[username] = user.ID
+	}
+
+	tests := []struct {
+		name          string
+		principalType string
+		principalID   string
+		body          string
+		status        int
+	}{
+		{name: "token only", principalType: PrincipalUser, principalID: ids["alice"], body: `{}`, status: http.StatusUnauthorized},
+		{name: "wrong password", principalType: PrincipalUser, principalID: ids["alice"],
+			body: `{"username": "alice", "password": "correct-horse-43"}`, status: http.StatusUnauthorized},
+		{name: "password of another user", principalType: PrincipalUser, principalID: ids["alice"],
+			body: `{"username": "bob", "password": "correct-horse-42"}`, status: http.StatusUnauthorized},
+		{name: "service", principalType: PrincipalService, principalID: "key", body: `{}`, status: http.StatusForbidden},
+		{name: "password of the user", principalType: PrincipalUser, principalID: ids["alice"],
+			body: `{"username": "alice", "password": "correct-horse-42"}`, status: http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/signing_secret", strings.NewReader(tt.body))
+			r.Header.Set(common.PrincipalTypeHeader, tt.principalType)
+			r.Header.Set(common.PrincipalIDHeader, tt.principalID)
+
+			rr := httptest.NewRecorder()
+			handler.CreateSigningSecret(rr, r)
+
+			if rr.Code != tt.status {
+				t.Fatalf("expected status %d got %d", tt.status, rr.Code)
+			}
+		})
+	}
+
+	if _, err := signingSecrets.Get(ids["alice"]); err != nil {
+		t.Errorf("expected alice to have a signing secret: %s", err)
+	}
+}
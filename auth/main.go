@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/domain"
 	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/handlers"
 )
 
@@ -17,9 +20,53 @@ func main() {
 	//	panic(err)
 	//}
 
-	handler := handlers.NewRequestHandler(map[string]string{"1": "h56Zf2gRZBGTxi5iortR"})
+	attempts := domain.NewMemoryAttemptStore()
+	audit := domain.LogAuditLog{}
+
+	// a user is never locked out everywhere, so that nobody can keep them out, their attempts are delayed instead
+	users := domain.NewThrottle("user", attempts, audit, domain.Policy{
+		BaseDelay:       time.Second,
+		MaxDelay:        30 * time.Second,
+		LockoutDuration: 15 * time.Minute,
+	})
+
+	userIPs := domain.NewThrottle("user_ip", attempts, audit, domain.Policy{
+		MaxFailures:     5,
+		BaseDelay:       time.Second,
+		MaxDelay:        30 * time.Second,
+		LockoutDuration: 15 * time.Minute,
+	})
+
+	// source IPs can be shared by many users (NAT, proxies) so they get a higher threshold
+	ips := domain.NewThrottle("ip", attempts, audit, domain.Policy{
+		MaxFailures:     50,
+		BaseDelay:       100 * time.Millisecond,
+		MaxDelay:        5 * time.Second,
+		LockoutDuration: 15 * time.Minute,
+	})
+
+	apiKeys := domain.NewAPIKeys(domain.NewMemoryAPIKeyStore())
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	handler := handlers.NewRequestHandler(
+		domain.NewMemoryTokenStore(map[string]string{"1": "h56Zf2gRZBGTxi5iortR"}),
+		domain.NewMemoryTokenStore(nil),
+		domain.NewMemoryUserStore(),
+		domain.NewPaymentBalances(client),
+		[]string{"payments:read", "payments:write"},
+		apiKeys, users, userIPs, ips)
 
 	r.HandleFunc("/authenticate", handler.Authenticate).Methods(http.MethodPost)
+	r.HandleFunc("/users", handler.Register).Methods(http.MethodPost)
+	r.HandleFunc("/login", handler.Login).Methods(http.MethodPost)
+	r.HandleFunc("/signing_secret", handler.CreateSigningSecret).Methods(http.MethodPost)
+	r.HandleFunc("/verify_signature", handler.VerifySignature).Methods(http.MethodPost)
+
+	// api keys are managed from the internal network only, these routes are not published by the gateway
+	r.HandleFunc("/api_keys", handler.CreateAPIKey).Methods(http.MethodPost)
+	r.HandleFunc("/api_keys", handler.ListAPIKeys).Methods(http.MethodGet)
+	r.HandleFunc("/api_keys/{id}", handler.RevokeAPIKey).Methods(http.MethodDelete)
 
 	log.Print("Listening on port 80")
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", 80), r))
@@ -0,0 +1,25 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ErrorResponse is the payload returned along with an error status code
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// WriteError writes a structured error so that clients do not have to rely on the status code alone
+func WriteError(w http.ResponseWriter, status int, code, message string) {
+	body, err := json.Marshal(ErrorResponse{Code: code, Message: message})
+	if err != nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
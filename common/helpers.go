@@ -8,6 +8,13 @@ import (
 
 const TraceIDHeader = "X-Trace-Id"
 
+// Headers set by the gateway on proxied requests once the caller is authenticated
+const (
+	PrincipalIDHeader   = "X-Principal-Id"
+	PrincipalTypeHeader = "X-Principal-Type"
+	ForwardedForHeader  = "X-Forwarded-For"
+)
+
 func ExtractTraceIDFromReq(r *http.Request) (traceID string) {
 	traceID = r.Header.Get(TraceIDHeader)
 	if traceID == "" {
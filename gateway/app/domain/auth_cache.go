@@ -0,0 +1,170 @@
+package domain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/handlers"
+)
+
+// AuthCacheConfig sets how long authentication results are kept. A successful result stays valid for PositiveTTL
+// even if its credentials are revoked meanwhile.
+type AuthCacheConfig struct {
+	PositiveTTL time.Duration `json:"positive_ttl" yaml:"positive_ttl"`
+	NegativeTTL time.Duration `json:"negative_ttl" yaml:"negative_ttl"`
+}
+
+// AuthCacheStats is exposed for monitoring
+type AuthCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Collapsed int64 `json:"collapsed"`
+	Entries   int   `json:"entries"`
+}
+
+// CachingAuthenticator decorates an Authenticator and keeps its results for a while.
+// Concurrent lookups for the same credentials share a single upstream call.
+type CachingAuthenticator struct {
+	next   Authenticator
+	config AuthCacheConfig
+	now    func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]authCacheEntry
+	calls     map[string]*authCall
+	lastSweep time.Time
+
+	hits      int64
+	misses    int64
+	collapsed int64
+}
+
+type authCacheEntry struct {
+	principal *handlers.Principal
+	expiresAt time.Time
+}
+
+type authCall struct {
+	wg        sync.WaitGroup
+	principal *handlers.Principal
+	err       error
+}
+
+func NewCachingAuthenticator(next Authenticator, config AuthCacheConfig) *CachingAuthenticator {
+	return &CachingAuthenticator{
+		next:    next,
+		config:  config,
+		now:     time.Now,
+		entries: map[string]authCacheEntry{},
+		calls:   map[string]*authCall{},
+	}
+}
+
+func (c *CachingAuthenticator) Authenticate(r *http.Request) (*handlers.Principal, error) {
+	key := authCacheKey(r)
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && c.now().Before(e.expiresAt) {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return e.principal, nil
+	}
+
+	atomic.AddInt64(&c.misses, 1)
+
+	// someone is already asking upstream for the same credentials
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.collapsed, 1)
+		call.wg.Wait()
+		return call.principal, call.err
+	}
+
+	call := &authCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.principal, call.err = c.next.Authenticate(r)
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	// errors are not cached so that the next request retries
+	if call.err == nil {
+		c.store(key, call.principal)
+	}
+	c.mu.Unlock()
+
+	call.wg.Done()
+
+	return call.principal, call.err
+}
+
+// Stats returns the cache counters, it can be published through expvar
+func (c *CachingAuthenticator) Stats() interface{} {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return AuthCacheStats{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Collapsed: atomic.LoadInt64(&c.collapsed),
+		Entries:   entries,
+	}
+}
+
+// store must be called with the lock held
+func (c *CachingAuthenticator) store(key string, principal *handlers.Principal) {
+	ttl := c.config.PositiveTTL
+	if principal == nil {
+		ttl = c.config.NegativeTTL
+	}
+
+	now := c.now()
+	c.sweep(now)
+
+	if ttl <= 0 {
+		return
+	}
+
+	c.entries[key] = authCacheEntry{principal: principal, expiresAt: now.Add(ttl)}
+}
+
+// sweep drops expired entries so that random credentials do not grow the cache forever
+func (c *CachingAuthenticator) sweep(now time.Time) {
+	interval := c.config.PositiveTTL
+	if c.config.NegativeTTL > interval {
+		interval = c.config.NegativeTTL
+	}
+
+	if now.Sub(c.lastSweep) < interval {
+		return
+	}
+
+	for key, e := range c.entries {
+		if !now.Before(e.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	c.lastSweep = now
+}
+
+// authCacheKey hashes the credentials so that tokens are not kept in memory in plain text.
+// The source IP is part of api key lookups as keys can be restricted to some IPs.
+func authCacheKey(r *http.Request) string {
+	h := sha256.New()
+
+	apiKey := r.Header.Get(APIKeyHeader)
+	if apiKey != "" {
+		h.Write([]byte(apiKey + "\x00" + clientIP(r)))
+	} else {
+		h.Write([]byte(r.Header.Get("X-User-Id") + "\x00" + r.Header.Get("Authorization")))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,119 @@
+package domain
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/handlers"
+)
+
+type countingAuthenticator struct {
+	calls   int64
+	tokens  map[string]string
+	release chan struct{}
+}
+
+func (c *countingAuthenticator) Authenticate(r *http.Request) (*handlers.Principal, error) {
+	atomic.AddInt64(&c.calls, 1)
+	if c.release != nil {
+		<-c.release
+	}
+
+	userID := r.Header.Get("X-User-Id")
+	if c.tokens[userID] != r.Header.Get("Authorization") {
+		return nil, nil
+	}
+	return &handlers.Principal{Type: handlers.PrincipalUser, ID: userID}, nil
+}
+
+func authRequest(userID, token string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, "/pay_user", nil)
+	r.Header.Set("X-User-Id", userID)
+	r.Header.Set("Authorization", token)
+	return r
+}
+
+func TestCachingAuthenticator(t *testing.T) {
+	now := time.Date(2020, 9, 20, 12, 0, 0, 0, time.UTC)
+	next := &countingAuthenticator{tokens: map[string]string{"1": "abc"}}
+
+	cache := NewCachingAuthenticator(next, AuthCacheConfig{PositiveTTL: time.Minute, NegativeTTL: time.Second})
+	cache.now = func() time.Time { return now }
+
+	tests := []struct {
+		name          string
+		elapsed       time.Duration
+		userID, token string
+		authenticated bool
+		calls         int64
+	}{
+		{name: "positive miss", userID: "1", token: "abc", authenticated: true, calls: 1},
+		{name: "positive hit", userID: "1", token: "abc", authenticated: true, calls: 1},
+		{name: "negative miss", userID: "1", token: "abcd", calls: 2},
+		{name: "negative hit", userID: "1", token: "abcd", calls: 2},
+		{name: "negative expired", elapsed: 2 * time.Second, userID: "1", token: "abcd", calls: 3},
+		{name: "positive still cached", userID: "1", token: "abc", authenticated: true, calls: 3},
+		{name: "positive expired", elapsed: time.Minute, userID: "1", token: "abc", authenticated: true, calls: 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now = now.Add(test.elapsed)
+
+			p, err := cache.Authenticate(authRequest(test.userID, test.token))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (p != nil) != test.authenticated {
+				t.Errorf("expected authenticated to be %v got %v", test.authenticated, p != nil)
+			}
+
+			if calls := atomic.LoadInt64(&next.calls); calls != test.calls {
+				t.Errorf("expected %d upstream calls got %d", test.calls, calls)
+			}
+		})
+	}
+
+	stats := cache.Stats().(AuthCacheStats)
+	if stats.Hits != 3 || stats.Misses != 4 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCachingAuthenticator_CollapsesConcurrentLookups(t *testing.T) {
+	next := &countingAuthenticator{tokens: map[string]string{"1": "abc"}, release: make(chan struct{})}
+	cache := NewCachingAuthenticator(next, AuthCacheConfig{PositiveTTL: time.Minute})
+
+	n := 20
+	wg := sync.WaitGroup{}
+	wg.Add(n)
+
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			p, err := cache.Authenticate(authRequest("1", "abc"))
+			if err != nil || p == nil {
+				t.Errorf("expected request to be authenticated, got %v %v", p, err)
+			}
+		}()
+	}
+
+	// wait for every goroutine to either lead or join the upstream call
+	for {
+		stats := cache.Stats().(AuthCacheStats)
+		if stats.Misses == int64(n) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(next.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt64(&next.calls); calls != 1 {
+		t.Fatalf("expected 1 upstream call got %d", calls)
+	}
+}
@@ -7,7 +7,9 @@ import (
 )
 
 type Config struct {
-	Urls []URL `json:"urls"`
+	Urls      []URL           `json:"urls"`
+	AuthCache AuthCacheConfig `json:"auth_cache" yaml:"auth_cache"`
+	Signature SignatureConfig `json:"signature"`
 }
 
 type Topic struct {
@@ -23,6 +25,11 @@ type URL struct {
 	Nsq    *Topic `json:"nsq"`
 	HTTP   *HTTP  `json:"http"`
 	Path   string `json:"path"`
+	// Scope the caller must have been granted, any authenticated caller is allowed when empty
+	Scope string `json:"scope"`
+	// Public routes are proxied without authentication
+	Public  bool           `json:"public"`
+	Signing *SigningConfig `json:"signing"`
 }
 
 func ParseFileConfig(filename string) (Config, error) {
@@ -3,7 +3,9 @@ package domain
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
 
@@ -16,16 +18,21 @@ import (
 
 const (
 	logTraceID = "traceID"
+
+	// APIKeyHeader carries the api key of service principals, in place of Authorization and X-User-Id
+	APIKeyHeader = "X-Api-Key"
 )
 
 type RequestHandler struct {
-	client *http.Client
-	router *mux.Router
-	auth   Authenticator
+	client  *http.Client
+	router  *mux.Router
+	auth    Authenticator
+	signing *RequestSigning
 }
 
+// Authenticator returns the principal behind the request, or nil when the request is not authenticated
 type Authenticator interface {
-	Authenticate(r *http.Request) (bool, error)
+	Authenticate(r *http.Request) (*handlers.Principal, error)
 }
 
 type Auth struct {
@@ -41,11 +48,12 @@ type Message struct {
 	Parameters map[string]string `json:"parameters"`
 }
 
-func NewRequestHandler(client *http.Client, r *mux.Router, auth Authenticator) (*RequestHandler, error) {
+func NewRequestHandler(client *http.Client, r *mux.Router, auth Authenticator, signing *RequestSigning) (*RequestHandler, error) {
 	return &RequestHandler{
-		client: client,
-		router: r,
-		auth:   auth,
+		client:  client,
+		router:  r,
+		auth:    auth,
+		signing: signing,
 	}, nil
 }
 
@@ -54,26 +62,23 @@ func (s *RequestHandler) GetRouter() *mux.Router {
 }
 
 func (s *RequestHandler) Gateway(config Config) {
+	// several routes can share a path with different methods, a path matched with another method is still not found
+	s.router.MethodNotAllowedHandler = http.NotFoundHandler()
+
 	for _, c := range config.Urls {
-		host := c.HTTP.Host
-		s.makeSyncHandler(c.Method, c.Path, host)
+		s.makeSyncHandler(c)
 	}
 }
 
-func (s *RequestHandler) makeSyncHandler(method, path, host string) {
+func (s *RequestHandler) makeSyncHandler(u URL) {
+	method, path, host := u.Method, u.Path, u.HTTP.Host
 
 	log.Info().Msgf("Registering http proxy handler for [method|path|host]: [%s|%s|%s]", method, path, host)
 
 	s.router.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-
-		if r.Method != method {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-
 		traceID := common.ExtractTraceIDFromReq(r)
 
-		res, err := s.proxy("http://"+host+r.URL.Path, r)
+		res, err := s.proxy("http://"+host+r.URL.Path, u, r)
 		if err != nil {
 			log.Error().Err(err).Str(logTraceID, traceID)
 			w.WriteHeader(http.StatusBadRequest)
@@ -87,25 +92,24 @@ func (s *RequestHandler) makeSyncHandler(method, path, host string) {
 
 		defer res.Body.Close()
 
-		respBytes, err := ioutil.ReadAll(res.Body)
-
-		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-
 		w.WriteHeader(res.StatusCode)
 
-		_, err = w.Write(respBytes)
+		// the body is streamed rather than read first, large responses such as statements are not held in memory
+		_, err = io.Copy(w, res.Body)
 		if err != nil {
-			log.Error().Err(err).Str(logTraceID, traceID)
-			w.WriteHeader(http.StatusInternalServerError)
+			log.Error().Err(err).Str(logTraceID, traceID).Msg("could not copy the response")
 		}
-	})
+	}).Methods(method)
 }
 
-func (s *RequestHandler) proxy(proxyURL string, r *http.Request) (*http.Response, error) {
-	req, err := http.NewRequest(r.Method, proxyURL, r.Body)
+func (s *RequestHandler) proxy(proxyURL string, u URL, r *http.Request) (*http.Response, error) {
+	// the body is read upfront as signed requests need its hash
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(r.Method, proxyURL, bytes.NewReader(body))
 	if err != nil {
 		log.Error().Err(err).Msg("error")
 		return nil, err
@@ -114,21 +118,49 @@ func (s *RequestHandler) proxy(proxyURL string, r *http.Request) (*http.Response
 	params := r.URL.Query()
 	req.URL.RawQuery = params.Encode()
 
-	valid, err := s.auth.Authenticate(r)
+	// Pass the traceID and the caller address downstream
+	req.Header.Add(common.TraceIDHeader, common.ExtractTraceIDFromReq(r))
+	req.Header.Add(common.ForwardedForHeader, clientIP(r))
+
+	if u.Public {
+		return s.do(req)
+	}
+
+	principal, err := s.auth.Authenticate(r)
 	if err != nil {
 		return nil, err
 	}
 
-	if !valid {
-		return &http.Response{
-			StatusCode: http.StatusUnauthorized,
-			Body:       ioutil.NopCloser(strings.NewReader("")),
-		}, nil
+	if principal == nil {
+		return emptyResponse(http.StatusUnauthorized), nil
 	}
 
-	// Pass the traceID downstream
-	req.Header.Add(common.TraceIDHeader, common.ExtractTraceIDFromReq(r))
+	if u.Scope != "" && !principal.HasScope(u.Scope) {
+		log.Info().Str(logTraceID, common.ExtractTraceIDFromReq(r)).
+			Str("principal", principal.ID).
+			Str("principalType", principal.Type).
+			Str("scope", u.Scope).
+			Msg("missing scope")
+		return emptyResponse(http.StatusForbidden), nil
+	}
 
+	err = s.signing.Verify(r, body, principal.ID, u.Signing)
+	if err != nil {
+		log.Info().Err(err).Str(logTraceID, common.ExtractTraceIDFromReq(r)).
+			Str("principal", principal.ID).
+			Str("principalType", principal.Type).
+			Msg("signature rejected")
+		return signatureErrorResponse(err)
+	}
+
+	// Pass the authenticated principal downstream
+	req.Header.Add(common.PrincipalIDHeader, principal.ID)
+	req.Header.Add(common.PrincipalTypeHeader, principal.Type)
+
+	return s.do(req)
+}
+
+func (s *RequestHandler) do(req *http.Request) (*http.Response, error) {
 	response, err := s.client.Do(req)
 	if err != nil {
 		log.Error().Err(err).Msg("error")
@@ -137,38 +169,101 @@ func (s *RequestHandler) proxy(proxyURL string, r *http.Request) (*http.Response
 
 	return response, nil
 }
-func (a *Auth) Authenticate(r *http.Request) (bool, error) {
+func emptyResponse(status int) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}
+}
+
+func signatureErrorResponse(err error) (*http.Response, error) {
+	codes := map[error]string{
+		ErrSignatureRequired: "signature_required",
+		ErrStaleTimestamp:    "stale_timestamp",
+		ErrReplayedNonce:     "replayed_nonce",
+		ErrInvalidSignature:  "invalid_signature",
+	}
+
+	code, ok := codes[err]
+	if !ok {
+		return nil, err
+	}
+
+	body, err := json.Marshal(common.ErrorResponse{Code: code, Message: err.Error()})
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+// Authenticate accepts either a user token or a service api key
+func (a *Auth) Authenticate(r *http.Request) (*handlers.Principal, error) {
 	authURL := "http://auth/authenticate"
 	request := handlers.UserCheckAuthRequest{
-		UserID: r.Header.Get("X-User-Id"),
-		Token:  r.Header.Get("Authorization"),
+		UserID:   r.Header.Get("X-User-Id"),
+		Token:    r.Header.Get("Authorization"),
+		APIKey:   r.Header.Get(APIKeyHeader),
+		SourceIP: clientIP(r),
+	}
+
+	principalType := handlers.PrincipalUser
+	if request.APIKey != "" {
+		principalType = handlers.PrincipalService
 	}
 
 	body, err := json.Marshal(request)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	req, err := http.NewRequest(http.MethodPost, authURL, bytes.NewReader(body))
 	if err != nil {
 		log.Error().Err(err).Msg("error")
-		return false, err
+		return nil, err
 	}
 
-	log.Info().Interface("request", request).Msg("authenticating request")
+	log.Info().Str("user", request.UserID).
+		Str("principalType", principalType).
+		Msg("authenticating request")
 
 	req.Header.Add(common.TraceIDHeader, common.ExtractTraceIDFromReq(r))
 
 	response, err := a.client.Do(req)
 	if err != nil {
 		log.Error().Err(err).Msg("error")
-		return false, err
+		return nil, err
 	}
 	defer response.Body.Close()
 
-	log.Info().Interface("request", request).
+	log.Info().Str("user", request.UserID).
+		Str("principalType", principalType).
 		Int("status", response.StatusCode).
 		Msg("authentication result")
 
-	return response.StatusCode == http.StatusOK, nil
+	if response.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	principal := handlers.Principal{}
+
+	err = json.NewDecoder(response.Body).Decode(&principal)
+	if err != nil {
+		return nil, err
+	}
+
+	return &principal, nil
+}
+
+// clientIP returns the address the request came from, the gateway being the public entry point
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
 }
@@ -11,22 +11,29 @@ import (
 	"testing"
 
 	"github.com/gorilla/mux"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/handlers"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
 )
 
 type MockAuthenticator struct {
 	response bool
+	scopes   []string
 }
 
 func (m *MockAuthenticator) setResponse(res bool) {
 	m.response = res
 }
 
-func (m *MockAuthenticator) Authenticate(r *http.Request) (bool, error) {
-	return m.response, nil
+func (m *MockAuthenticator) Authenticate(r *http.Request) (*handlers.Principal, error) {
+	if !m.response {
+		return nil, nil
+	}
+	return &handlers.Principal{Type: handlers.PrincipalUser, ID: "1", Scopes: m.scopes}, nil
 }
 
 func TestGateway(t *testing.T) {
-	r, _ := NewRequestHandler(&http.Client{}, mux.NewRouter(), &MockAuthenticator{response: true})
+	r, _ := NewRequestHandler(&http.Client{}, mux.NewRouter(), &MockAuthenticator{response: true}, nil)
 
 	tests := []struct {
 		name     string
@@ -86,7 +93,7 @@ func TestSyncHandler(t *testing.T) {
 	//  response defined in `h`
 	client, _ := testingHTTPClient(h)
 
-	r, _ := NewRequestHandler(client, mux.NewRouter(), &MockAuthenticator{response: true})
+	r, _ := NewRequestHandler(client, mux.NewRouter(), &MockAuthenticator{response: true}, nil)
 
 	config := Config{
 		Urls: []URL{
@@ -129,7 +136,7 @@ func TestSyncHandlerNotMatching(t *testing.T) {
 	client, close := testingHTTPClient(h)
 	defer close()
 
-	r, _ := NewRequestHandler(client, mux.NewRouter(), &MockAuthenticator{response: true})
+	r, _ := NewRequestHandler(client, mux.NewRouter(), &MockAuthenticator{response: true}, nil)
 
 	config := Config{
 		Urls: []URL{
@@ -163,6 +170,50 @@ func TestSyncHandlerNotMatching(t *testing.T) {
 	}
 }
 
+// test that routes sharing a path are told apart by their method
+func TestSyncHandlerSharedPath(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method))
+	})
+
+	client, close := testingHTTPClient(h)
+	defer close()
+
+	r, _ := NewRequestHandler(client, mux.NewRouter(), &MockAuthenticator{response: true, scopes: []string{"read"}}, nil)
+
+	r.Gateway(Config{
+		Urls: []URL{
+			{Method: "GET", Path: "/test", Scope: "read", HTTP: &HTTP{Host: "test"}},
+			{Method: "POST", Path: "/test", Scope: "write", HTTP: &HTTP{Host: "test"}},
+		},
+	})
+
+	tests := []struct {
+		method         string
+		expectedStatus int
+	}{
+		{method: "GET", expectedStatus: http.StatusOK},
+		{method: "POST", expectedStatus: http.StatusForbidden},
+		{method: "PUT", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, "/test", bytes.NewReader([]byte{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			http.Handler(r.GetRouter()).ServeHTTP(rr, req)
+
+			if rr.Code != test.expectedStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, test.expectedStatus)
+			}
+		})
+	}
+}
+
 // from : https://github.com/romanyx/api_client_testing/blob/master/client_test.go
 func testingHTTPClient(handler http.Handler) (*http.Client, func()) {
 	s := httptest.NewServer(handler)
@@ -180,3 +231,98 @@ func testingHTTPClient(handler http.Handler) (*http.Client, func()) {
 
 	return cli, s.Close
 }
+
+func TestSyncHandlerScopes(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(common.PrincipalTypeHeader) + ":" + r.Header.Get(common.PrincipalIDHeader)))
+	})
+
+	client, close := testingHTTPClient(h)
+	defer close()
+
+	tests := []struct {
+		name     string
+		scopes   []string
+		status   int
+		response string
+	}{
+		{
+			name:     "principal has the route scope",
+			scopes:   []string{"payments:read", "payments:write"},
+			status:   http.StatusOK,
+			response: "user:1",
+		},
+		{
+			name:   "principal is missing the route scope",
+			scopes: []string{"payments:read"},
+			status: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := NewRequestHandler(client, mux.NewRouter(), &MockAuthenticator{response: true, scopes: test.scopes}, nil)
+
+			r.Gateway(Config{
+				Urls: []URL{
+					{
+						Method: "POST",
+						Path:   "/pay_user",
+						Scope:  "payments:write",
+						HTTP: &HTTP{
+							Host: "test",
+						},
+					},
+				},
+			})
+
+			req, err := http.NewRequest("POST", "/pay_user", bytes.NewReader([]byte{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			http.Handler(r.GetRouter()).ServeHTTP(rr, req)
+
+			if rr.Code != test.status {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, test.status)
+			}
+
+			if rr.Body.String() != test.response {
+				t.Errorf("expected response %q got %q", test.response, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestSyncHandlerPublic(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	client, close := testingHTTPClient(h)
+	defer close()
+
+	r, _ := NewRequestHandler(client, mux.NewRouter(), &MockAuthenticator{response: false}, nil)
+
+	r.Gateway(Config{
+		Urls: []URL{
+			{Method: "POST", Path: "/users", Public: true, HTTP: &HTTP{Host: "test"}},
+			{Method: "POST", Path: "/pay_user", HTTP: &HTTP{Host: "test"}},
+		},
+	})
+
+	for path, status := range map[string]int{"/users": http.StatusCreated, "/pay_user": http.StatusUnauthorized} {
+		req, err := http.NewRequest("POST", path, bytes.NewReader([]byte{}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		http.Handler(r.GetRouter()).ServeHTTP(rr, req)
+
+		if rr.Code != status {
+			t.Errorf("%s returned wrong status code: got %v want %v", path, rr.Code, status)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package domain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	authdomain "github.com/heetch/MehdiSouilhed-technical-test/auth/auth/domain"
+	"github.com/heetch/MehdiSouilhed-technical-test/auth/auth/handlers"
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+const (
+	SignatureHeader          = "X-Signature"
+	SignatureTimestampHeader = "X-Signature-Timestamp"
+	SignatureNonceHeader     = "X-Signature-Nonce"
+)
+
+var (
+	ErrSignatureRequired = errors.New("request must be signed")
+	ErrStaleTimestamp    = errors.New("signature timestamp is too old or in the future")
+	ErrReplayedNonce     = errors.New("signature nonce was already used")
+	ErrInvalidSignature  = errors.New("invalid signature")
+)
+
+// SigningConfig makes a route require signed requests, always or when the amount in the body reaches a threshold
+type SigningConfig struct {
+	Always          bool    `json:"always"`
+	AmountField     string  `json:"amount_field" yaml:"amount_field"`
+	AmountThreshold float64 `json:"amount_threshold" yaml:"amount_threshold"`
+}
+
+type SignatureConfig struct {
+	// MaxSkew is how far the signature timestamp can be from the gateway clock, nonces are remembered for twice as long
+	MaxSkew time.Duration `json:"max_skew" yaml:"max_skew"`
+}
+
+// SignatureChecker checks the HMAC of a canonical request with the principal signing secret
+type SignatureChecker interface {
+	CheckSignature(r *http.Request, principalID, payload, signature string) (bool, error)
+}
+
+// RequestSigning verifies signed requests and rejects stale timestamps and replayed nonces
+type RequestSigning struct {
+	checker SignatureChecker
+	config  SignatureConfig
+	now     func() time.Time
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func NewRequestSigning(checker SignatureChecker, config SignatureConfig) *RequestSigning {
+	return &RequestSigning{
+		checker: checker,
+		config:  config,
+		now:     time.Now,
+		nonces:  map[string]time.Time{},
+	}
+}
+
+// Verify checks the signature headers when they are present, or when the route requires the request to be signed
+func (v *RequestSigning) Verify(r *http.Request, body []byte, principalID string, config *SigningConfig) error {
+	signature := r.Header.Get(SignatureHeader)
+
+	if signature == "" {
+		if config.requires(body) {
+			return ErrSignatureRequired
+		}
+		return nil
+	}
+
+	timestamp := r.Header.Get(SignatureTimestampHeader)
+	nonce := r.Header.Get(SignatureNonceHeader)
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || nonce == "" {
+		return ErrInvalidSignature
+	}
+
+	now := v.now()
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > v.config.MaxSkew || skew < -v.config.MaxSkew {
+		return ErrStaleTimestamp
+	}
+
+	payload := authdomain.CanonicalRequest(r.Method, r.URL.Path, timestamp, nonce, body)
+
+	valid, err := v.checker.CheckSignature(r, principalID, payload, signature)
+	if err != nil {
+		return err
+	}
+
+	if !valid {
+		return ErrInvalidSignature
+	}
+
+	if !v.useNonce(principalID+":"+nonce, now) {
+		return ErrReplayedNonce
+	}
+
+	return nil
+}
+
+// useNonce remembers the nonce until its timestamp can no longer be accepted, it returns false if it was already used
+func (v *RequestSigning) useNonce(key string, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if expiresAt, ok := v.nonces[key]; ok && now.Before(expiresAt) {
+		return false
+	}
+
+	for k, expiresAt := range v.nonces {
+		if !now.Before(expiresAt) {
+			delete(v.nonces, k)
+		}
+	}
+
+	v.nonces[key] = now.Add(2 * v.config.MaxSkew)
+	return true
+}
+
+// requires reports whether the request must be signed, routes without a signing config never require it.
+// The services decode the body with encoding/json, which matches field names case-insensitively, so every field
+// matching the amount field that way is checked. An amount that cannot be read requires a signature.
+func (c *SigningConfig) requires(body []byte) bool {
+	if c == nil {
+		return false
+	}
+
+	if c.Always {
+		return true
+	}
+
+	// a body that is not a JSON object is refused by the services
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return false
+	}
+
+	for name, value := range fields {
+		if !strings.EqualFold(name, c.AmountField) {
+			continue
+		}
+
+		var amount float64
+		if err := json.Unmarshal(value, &amount); err != nil || bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+			return true
+		}
+
+		if amount >= c.AmountThreshold {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckSignature asks the auth service to verify the HMAC as it holds the signing secrets
+func (a *Auth) CheckSignature(r *http.Request, principalID, payload, signature string) (bool, error) {
+	verifyURL := "http://auth/verify_signature"
+
+	body, err := json.Marshal(handlers.VerifySignatureRequest{
+		PrincipalID: principalID,
+		Payload:     payload,
+		Signature:   signature,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, verifyURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Add(common.TraceIDHeader, common.ExtractTraceIDFromReq(r))
+
+	response, err := a.client.Do(req)
+	if err != nil {
+		log.Error().Err(err).Msg("error")
+		return false, err
+	}
+	defer response.Body.Close()
+
+	return response.StatusCode == http.StatusOK, nil
+}
@@ -0,0 +1,86 @@
+package domain
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	authdomain "github.com/heetch/MehdiSouilhed-technical-test/auth/auth/domain"
+)
+
+type mockSignatureChecker struct {
+	secrets map[string]string
+}
+
+func (m *mockSignatureChecker) CheckSignature(r *http.Request, principalID, payload, signature string) (bool, error) {
+	return authdomain.CheckSignature(m.secrets[principalID], payload, signature), nil
+}
+
+func signedRequest(body, secret string, timestamp time.Time, nonce string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, "/pay_user", bytes.NewReader([]byte(body)))
+	if secret == "" {
+		return r
+	}
+
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	r.Header.Set(SignatureTimestampHeader, ts)
+	r.Header.Set(SignatureNonceHeader, nonce)
+	r.Header.Set(SignatureHeader, authdomain.Sign(secret, authdomain.CanonicalRequest(http.MethodPost, "/pay_user", ts, nonce, []byte(body))))
+	return r
+}
+
+func TestRequestSigning_Verify(t *testing.T) {
+	now := time.Date(2020, 9, 20, 12, 0, 0, 0, time.UTC)
+
+	signing := NewRequestSigning(&mockSignatureChecker{secrets: map[string]string{"1": "secret"}}, SignatureConfig{MaxSkew: time.Minute})
+	signing.now = func() time.Time { return now }
+
+	config := &SigningConfig{AmountField: "amount", AmountThreshold: 100}
+
+	tests := []struct {
+		name    string
+		body    string
+		secret  string
+		at      time.Time
+		nonce   string
+		wantErr error
+	}{
+		{name: "unsigned below threshold", body: `{"amount": 99.99}`},
+		{name: "unsigned above threshold", body: `{"amount": 100}`, wantErr: ErrSignatureRequired},
+		{name: "unsigned above threshold in another case", body: `{"AMOUNT": 5000}`, wantErr: ErrSignatureRequired},
+		{name: "unsigned with a case variant above threshold", body: `{"amount": 1, "Amount": 5000}`, wantErr: ErrSignatureRequired},
+		{name: "unsigned with an unreadable amount", body: `{"amount": "5000"}`, wantErr: ErrSignatureRequired},
+		{name: "unsigned without amount", body: `{"message": "hi"}`},
+		{name: "signed above threshold", body: `{"amount": 500}`, secret: "secret", at: now, nonce: "a"},
+		{name: "replayed nonce", body: `{"amount": 500}`, secret: "secret", at: now, nonce: "a", wantErr: ErrReplayedNonce},
+		{name: "stale timestamp", body: `{"amount": 500}`, secret: "secret", at: now.Add(-2 * time.Minute), nonce: "b", wantErr: ErrStaleTimestamp},
+		{name: "timestamp in the future", body: `{"amount": 500}`, secret: "secret", at: now.Add(2 * time.Minute), nonce: "c", wantErr: ErrStaleTimestamp},
+		{name: "wrong secret", body: `{"amount": 500}`, secret: "other", at: now, nonce: "d", wantErr: ErrInvalidSignature},
+		{name: "signed below threshold is still verified", body: `{"amount": 1}`, secret: "other", at: now, nonce: "e", wantErr: ErrInvalidSignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := signedRequest(test.body, test.secret, test.at, test.nonce)
+
+			err := signing.Verify(r, []byte(test.body), "1", config)
+			if err != test.wantErr {
+				t.Fatalf("expected error %v got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRequestSigning_TamperedBody(t *testing.T) {
+	now := time.Now()
+	signing := NewRequestSigning(&mockSignatureChecker{secrets: map[string]string{"1": "secret"}}, SignatureConfig{MaxSkew: time.Minute})
+
+	r := signedRequest(`{"amount": 500}`, "secret", now, "a")
+
+	err := signing.Verify(r, []byte(`{"amount": 5000}`), "1", &SigningConfig{Always: true})
+	if err != ErrInvalidSignature {
+		t.Fatalf("expected error %v got %v", ErrInvalidSignature, err)
+	}
+}
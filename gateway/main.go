@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"log"
 	"net/http"
 	"os"
@@ -12,13 +13,6 @@ import (
 )
 
 func main() {
-	client := &http.Client{Timeout: 5 * time.Second}
-	auth := domain.NewAuth(client)
-	handler, err := domain.NewRequestHandler(client, mux.NewRouter(), auth)
-	if err != nil {
-		panic(err)
-	}
-
 	configFile, err := domain.ParseFileConfig("config.yaml")
 
 	if err != nil {
@@ -26,6 +20,29 @@ func main() {
 		os.Exit(2)
 	}
 
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	// responses are streamed to the caller, only the wait for their headers is bounded so that long ones such as
+	// statements are not cut short
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 5 * time.Second
+	proxyClient := &http.Client{Transport: transport}
+
+	authClient := domain.NewAuth(client)
+	auth := domain.NewCachingAuthenticator(authClient, configFile.AuthCache)
+	signing := domain.NewRequestSigning(authClient, configFile.Signature)
+	handler, err := domain.NewRequestHandler(proxyClient, mux.NewRouter(), auth, signing)
+	if err != nil {
+		panic(err)
+	}
+
+	// monitoring is served on a separate port, /debug/vars is not exposed to the outside world
+	expvar.Publish("auth_cache", expvar.Func(auth.Stats))
+	go func() {
+		log.Println("Serving metrics on port 8080")
+		log.Fatal(http.ListenAndServe(":8080", nil))
+	}()
+
 	handler.Gateway(configFile)
 	log.Println("Listening on port 80")
 	log.Fatal(http.ListenAndServe(":80", handler.GetRouter()))
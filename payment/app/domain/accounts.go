@@ -0,0 +1,195 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	AccountActive = "active"
+	// AccountFrozen accounts can neither send nor receive money
+	AccountFrozen = "frozen"
+	// AccountClosed accounts have a zero balance and can neither send nor receive money
+	AccountClosed = "closed"
+	// AccountReceiveOnly accounts can receive money but not send it
+	AccountReceiveOnly = "receive_only"
+)
+
+var (
+	ErrAccountFrozen      = errors.New("account is frozen")
+	ErrAccountClosed      = errors.New("account is closed")
+	ErrAccountReceiveOnly = errors.New("account can only receive money")
+	// ErrRecipientUnavailable does not tell the sender why, the state of an account is only known to its owner
+	ErrRecipientUnavailable  = errors.New("recipient cannot receive money")
+	ErrAccountNotEmpty       = errors.New("only accounts with a zero balance can be closed")
+	ErrInvalidAccountStatus  = errors.New("status must be active, frozen, closed or receive_only")
+	ErrAccountChangeNoReason = errors.New("a reason is required")
+)
+
+// Account is the balance of a user along with its state and the history of its state changes, newest first
+type Account struct {
+	UserID  string                `json:"user_id"`
+	Status  string                `json:"status"`
+	Amount  float64               `json:"amount"`
+	Changes []AccountStatusChange `json:"changes"`
+}
+
+// AccountStatusChange records who changed the state of an account and why
+type AccountStatusChange struct {
+	UserID    string    `json:"user_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason"`
+	ChangedBy string    `json:"changed_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type SetAccountStatus struct {
+	UserID    string `json:"-"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason"`
+	ChangedBy string `json:"-"`
+}
+
+// checkAccounts refuses the transfer if the sender cannot send or the recipient cannot receive. The balances are
+// read FOR SHARE so that their state cannot change until the SQL transaction of the transfer ends.
+// The external account stands for the world outside and has no state.
+func checkAccounts(q querier, senderID, recipientID string) error {
+	if senderID != ExternalAccount {
+		status, err := accountStatus(q, senderID)
+		if err != nil {
+			return err
+		}
+
+		switch status {
+		case AccountFrozen:
+			return ErrAccountFrozen
+		case AccountClosed:
+			return ErrAccountClosed
+		case AccountReceiveOnly:
+			return ErrAccountReceiveOnly
+		}
+	}
+
+	if recipientID != ExternalAccount {
+		status, err := accountStatus(q, recipientID)
+		if err != nil {
+			return err
+		}
+
+		if status == AccountFrozen || status == AccountClosed {
+			return ErrRecipientUnavailable
+		}
+	}
+
+	return nil
+}
+
+func accountStatus(q querier, userID string) (string, error) {
+	var status string
+
+	err := q.QueryRow("SELECT status FROM balance WHERE userid = $1 FOR SHARE", userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", ErrAccountNotFound
+	}
+	return status, err
+}
+
+// SetAccountStatus changes the state of the account and records who changed it and why.
+// Closing an account is refused unless its balance is zero.
+func (s *SQLDatabase) SetAccountStatus(c SetAccountStatus) (*Account, error) {
+	switch c.Status {
+	case AccountActive, AccountFrozen, AccountClosed, AccountReceiveOnly:
+	default:
+		return nil, ErrInvalidAccountStatus
+	}
+
+	if c.Reason == "" {
+		return nil, ErrAccountChangeNoReason
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// the row stays locked until the change is committed, transfers wait for it to read the state
+	var status string
+	var amount float64
+
+	err = tx.QueryRow("SELECT status, amount FROM balance WHERE userid = $1 FOR UPDATE", c.UserID).Scan(&status, &amount)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Status == status {
+		return s.GetAccount(c.UserID)
+	}
+
+	if c.Status == AccountClosed && amount != 0 {
+		return nil, ErrAccountNotEmpty
+	}
+
+	_, err = tx.Exec("UPDATE balance SET status = $1, updatedat = NOW() WHERE userid = $2", c.Status, c.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `INSERT into account_status_changes (userid, fromstatus, tostatus, reason, changedby) VALUES ($1, $2, $3, $4, $5)`
+
+	_, err = tx.Exec(query, c.UserID, status, c.Status, c.Reason, c.ChangedBy)
+	if err != nil {
+		return nil, err
+	}
+
+	err = audit(tx, c.ChangedBy, AuditAccountStatus, c.UserID, map[string]string{"from": status, "to": c.Status, "reason": c.Reason})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetAccount(c.UserID)
+}
+
+// GetAccount returns the balance and state of the account, along with the history of its state changes
+func (s *SQLDatabase) GetAccount(userID string) (*Account, error) {
+	a := Account{UserID: userID, Changes: []AccountStatusChange{}}
+
+	err := s.db.QueryRow("SELECT status, amount FROM balance WHERE userid = $1", userID).Scan(&a.Status, &a.Amount)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT userid, fromstatus, tostatus, reason, changedby, createdat FROM account_status_changes
+			  WHERE userid = $1 ORDER BY id DESC`
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		c := AccountStatusChange{}
+		if err := rows.Scan(&c.UserID, &c.From, &c.To, &c.Reason, &c.ChangedBy, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		a.Changes = append(a.Changes, c)
+	}
+
+	return &a, rows.Err()
+}
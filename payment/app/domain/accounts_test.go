@@ -0,0 +1,101 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestSQLDatabase_AccountStatus(t *testing.T) {
+	pay := NewSQLDatabase(db)
+
+	tests := []struct {
+		name      string
+		sender    string
+		recipient string
+		expected  error
+	}{
+		{name: "active accounts", sender: AccountActive, recipient: AccountActive},
+		{name: "frozen sender", sender: AccountFrozen, recipient: AccountActive, expected: ErrAccountFrozen},
+		{name: "closed sender", sender: AccountClosed, recipient: AccountActive, expected: ErrAccountClosed},
+		{name: "receive-only sender", sender: AccountReceiveOnly, recipient: AccountActive, expected: ErrAccountReceiveOnly},
+		{name: "frozen recipient", sender: AccountActive, recipient: AccountFrozen, expected: ErrRecipientUnavailable},
+		{name: "closed recipient", sender: AccountActive, recipient: AccountClosed, expected: ErrRecipientUnavailable},
+		{name: "receive-only recipient", sender: AccountActive, recipient: AccountReceiveOnly},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cleanDB(db)
+			if err := initBalance("1", 100); err != nil {
+				t.Fatal(err)
+			}
+			if err := initBalance("2", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			// the states are set directly, SetAccountStatus would not close an account with money
+			for userID, status := range map[string]string{"1": test.sender, "2": test.recipient} {
+				_, err := db.Exec("UPDATE balance SET status = $1 WHERE userid = $2", status, userID)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := pay.SaveTransaction(Transaction{RequestID: "a", SenderID: "1", RecipientID: "2", Amount: 10, Currency: "SGD"})
+			if err != test.expected {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+
+			if test.expected == nil {
+				expectBalances(t, pay, 90, 10)
+				return
+			}
+
+			expectBalances(t, pay, 100, 0)
+
+			failed, err := pay.GetTransactionByRequestID("a")
+			if err != nil || failed.Status != StatusFailed || failed.FailureReason != test.expected.Error() {
+				t.Errorf("expected the refused payment to be recorded as failed, got %+v, %v", failed, err)
+			}
+		})
+	}
+
+	t.Run("changes are recorded", func(t *testing.T) {
+		cleanDB(db)
+		if err := initBalance("1", 100); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := pay.SetAccountStatus(SetAccountStatus{UserID: "1", Status: AccountClosed, Reason: "customer request", ChangedBy: "backoffice"})
+		if err != ErrAccountNotEmpty {
+			t.Errorf("expected %v, got %v", ErrAccountNotEmpty, err)
+		}
+
+		_, err = pay.SetAccountStatus(SetAccountStatus{UserID: "1", Status: AccountFrozen, Reason: "fraud report", ChangedBy: "backoffice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := initBalance("1", 0); err != nil {
+			t.Fatal(err)
+		}
+
+		a, err := pay.SetAccountStatus(SetAccountStatus{UserID: "1", Status: AccountClosed, Reason: "customer request", ChangedBy: "compliance"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if a.Status != AccountClosed || len(a.Changes) != 2 {
+			t.Fatalf("expected a closed account with 2 changes, got %+v", a)
+		}
+
+		latest := a.Changes[0]
+		if latest.From != AccountFrozen || latest.To != AccountClosed || latest.Reason != "customer request" || latest.ChangedBy != "compliance" {
+			t.Errorf("expected the closing to be recorded with its author and reason, got %+v", latest)
+		}
+
+		_, err = pay.SetAccountStatus(SetAccountStatus{UserID: "1", Status: "suspended", Reason: "?", ChangedBy: "compliance"})
+		if err != ErrInvalidAccountStatus {
+			t.Errorf("expected %v, got %v", ErrInvalidAccountStatus, err)
+		}
+	})
+}
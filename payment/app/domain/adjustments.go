@@ -0,0 +1,340 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	KindAdjustment = "adjustment"
+
+	AdjustmentCredit = "credit"
+	AdjustmentDebit  = "debit"
+
+	AdjustmentPendingApproval = "pending_approval"
+	AdjustmentRejected        = "rejected"
+
+	// AdjustmentAccount is the other side of the adjustments made by operators, it has no balance
+	AdjustmentAccount = "adjustments"
+)
+
+var (
+	ErrAdjustmentNotFound   = errors.New("adjustment not found")
+	ErrInvalidAdjustment    = errors.New("direction must be credit or debit, reason_code a known reason code and ticket is required")
+	ErrAdjustmentNotPending = errors.New("adjustment is not pending approval")
+	ErrSelfApproval         = errors.New("adjustments must be approved by another operator")
+
+	adjustmentNamespace = uuid.NewV5(uuid.NamespaceURL, "payment/adjustments")
+
+	// reasonCodes are the reasons an operator may adjust a balance for
+	reasonCodes = map[string]bool{
+		"correction":     true,
+		"goodwill":       true,
+		"chargeback":     true,
+		"fee_refund":     true,
+		"fraud_recovery": true,
+	}
+)
+
+// AdminConfig sets the rules of the back-office
+type AdminConfig struct {
+	// ApprovalThreshold is the amount from which an adjustment needs the approval of a second operator, 0 is never
+	ApprovalThreshold float64 `json:"approval_threshold" yaml:"approval_threshold"`
+}
+
+// SetAdmin sets the rules of the back-office
+func (s *SQLDatabase) SetAdmin(c AdminConfig) {
+	s.admin = c
+}
+
+// Adjustment credits or debits the balance of a user by hand, e.g. to fix a mistake. It is written to the ledger
+// as a transaction of kind adjustment whose other party is the adjustments account.
+type Adjustment struct {
+	AdjustmentID    string    `json:"adjustment_id"`
+	RequestID       string    `json:"request_id"`
+	UserID          string    `json:"user_id"`
+	Direction       string    `json:"direction"`
+	Amount          float64   `json:"amount"`
+	Currency        string    `json:"currency"`
+	ReasonCode      string    `json:"reason_code"`
+	Ticket          string    `json:"ticket"`
+	Message         string    `json:"message,omitempty"`
+	Status          string    `json:"status"`
+	CreatedBy       string    `json:"created_by"`
+	ReviewedBy      string    `json:"reviewed_by,omitempty"`
+	RejectionReason string    `json:"rejection_reason,omitempty"`
+	TransactionID   string    `json:"transaction_id,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type CreateAdjustment struct {
+	RequestID  string  `json:"request_id"`
+	UserID     string  `json:"user_id"`
+	Direction  string  `json:"direction"`
+	Amount     float64 `json:"amount"`
+	Currency   string  `json:"currency"`
+	ReasonCode string  `json:"reason_code"`
+	// Ticket is the support ticket the adjustment was made for
+	Ticket    string `json:"ticket"`
+	Message   string `json:"message"`
+	CreatedBy string `json:"-"`
+}
+
+const adjustmentColumns = `adjustmentid, requestid, userid, direction, amount, currency, reasoncode, ticket, COALESCE(message, ''),
+	status, createdby, COALESCE(reviewedby, ''), COALESCE(rejectionreason, ''), COALESCE(transactionid, ''), createdat, updatedat`
+
+func scanAdjustment(row scanner) (Adjustment, error) {
+	a := Adjustment{}
+	err := row.Scan(&a.AdjustmentID, &a.RequestID, &a.UserID, &a.Direction, &a.Amount, &a.Currency, &a.ReasonCode, &a.Ticket,
+		&a.Message, &a.Status, &a.CreatedBy, &a.ReviewedBy, &a.RejectionReason, &a.TransactionID, &a.CreatedAt, &a.UpdatedAt)
+	return a, err
+}
+
+func (s *SQLDatabase) GetAdjustment(adjustmentID string) (*Adjustment, error) {
+	a, err := scanAdjustment(s.db.QueryRow("SELECT "+adjustmentColumns+" FROM adjustments WHERE adjustmentid = $1", adjustmentID))
+	if err == sql.ErrNoRows {
+		return nil, ErrAdjustmentNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+// ListAdjustments returns the latest adjustments, optionally with a given status
+func (s *SQLDatabase) ListAdjustments(status string) ([]Adjustment, error) {
+	query := "SELECT " + adjustmentColumns + " FROM adjustments WHERE ($1 = '' OR status = $1) ORDER BY id DESC LIMIT 100"
+
+	rows, err := s.db.Query(query, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	adjustments := []Adjustment{}
+	for rows.Next() {
+		a, err := scanAdjustment(rows)
+		if err != nil {
+			return nil, err
+		}
+		adjustments = append(adjustments, a)
+	}
+
+	return adjustments, rows.Err()
+}
+
+// CreateAdjustment records the adjustment and applies it, unless its amount needs the approval of a second operator.
+// It is idempotent on the request_id.
+func (s *SQLDatabase) CreateAdjustment(c CreateAdjustment) (*Adjustment, error) {
+	if c.Amount <= 0 {
+		return nil, ErrNegativeAmount
+	}
+
+	if (c.Direction != AdjustmentCredit && c.Direction != AdjustmentDebit) || !reasonCodes[c.ReasonCode] || c.Ticket == "" {
+		return nil, ErrInvalidAdjustment
+	}
+
+	adjustmentID := uuid.NewV4().String()
+
+	err := s.lockedTx(adjustmentLock(c.UserID), func(tx *sql.Tx) error {
+		existing, err := scanAdjustment(tx.QueryRow("SELECT "+adjustmentColumns+" FROM adjustments WHERE requestid = $1", c.RequestID))
+		if err == nil {
+			if existing.UserID != c.UserID || existing.Direction != c.Direction || existing.Amount != c.Amount {
+				return ErrDuplicateRequest
+			}
+
+			adjustmentID = existing.AdjustmentID
+			return nil
+		}
+
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		query := `INSERT into adjustments (adjustmentid, requestid, userid, direction, amount, currency, reasoncode, ticket,
+				  message, status, createdby) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11)`
+
+		_, err = tx.Exec(query, adjustmentID, c.RequestID, c.UserID, c.Direction, c.Amount, c.Currency, c.ReasonCode, c.Ticket,
+			c.Message, AdjustmentPendingApproval, c.CreatedBy)
+		if err != nil {
+			return err
+		}
+
+		err = audit(tx, c.CreatedBy, AuditAdjustmentCreate, adjustmentID, c)
+		if err != nil {
+			return err
+		}
+
+		if s.admin.ApprovalThreshold <= 0 || c.Amount < s.admin.ApprovalThreshold {
+			a, err := scanAdjustment(tx.QueryRow("SELECT "+adjustmentColumns+" FROM adjustments WHERE adjustmentid = $1", adjustmentID))
+			if err != nil {
+				return err
+			}
+
+			return s.applyAdjustmentTx(tx, a, "")
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetAdjustment(adjustmentID)
+}
+
+// ApproveAdjustment applies an adjustment pending approval, the approver cannot be the operator who made it
+func (s *SQLDatabase) ApproveAdjustment(adjustmentID, approver string) (*Adjustment, error) {
+	a, err := s.GetAdjustment(adjustmentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.CreatedBy == approver {
+		return nil, ErrSelfApproval
+	}
+
+	err = s.lockedTx(adjustmentLock(a.UserID), func(tx *sql.Tx) error {
+		err := s.applyAdjustmentTx(tx, *a, approver)
+		if err != nil {
+			return err
+		}
+
+		return audit(tx, approver, AuditAdjustmentApprove, adjustmentID, nil)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetAdjustment(adjustmentID)
+}
+
+// RejectAdjustment drops an adjustment pending approval
+func (s *SQLDatabase) RejectAdjustment(adjustmentID, actor, reason string) (*Adjustment, error) {
+	if reason == "" {
+		reason = "rejected by " + actor
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE adjustments SET status = $1, reviewedby = $2, rejectionreason = $3, updatedat = NOW()
+			  WHERE adjustmentid = $4 AND status = $5`
+
+	res, err := tx.Exec(query, AdjustmentRejected, actor, reason, adjustmentID, AdjustmentPendingApproval)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = s.adjustmentNotPending(adjustmentID)
+		}
+		return nil, err
+	}
+
+	err = audit(tx, actor, AuditAdjustmentReject, adjustmentID, map[string]string{"reason": reason})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetAdjustment(adjustmentID)
+}
+
+// applyAdjustmentTx writes the adjustment to the ledger, the caller holds the lock of the user
+func (s *SQLDatabase) applyAdjustmentTx(tx *sql.Tx, a Adjustment, approver string) error {
+	status, err := accountStatus(tx, a.UserID)
+	if err != nil {
+		return err
+	}
+
+	if status == AccountClosed {
+		return ErrAccountClosed
+	}
+
+	t := Transaction{
+		RequestID:   uuid.NewV5(adjustmentNamespace, a.AdjustmentID).String(),
+		SenderID:    AdjustmentAccount,
+		RecipientID: a.UserID,
+		Message:     strings.TrimSpace(a.ReasonCode + " " + a.Ticket),
+		Amount:      a.Amount,
+		Currency:    a.Currency,
+		Kind:        KindAdjustment,
+		Status:      StatusCompleted,
+	}
+
+	amount := a.Amount
+	if a.Direction == AdjustmentDebit {
+		t.SenderID, t.RecipientID = a.UserID, AdjustmentAccount
+		amount = -a.Amount
+
+		balance, err := getBalance(tx, a.UserID)
+		if err != nil {
+			return err
+		}
+
+		held, err := s.heldAmount(tx, a.UserID, "")
+		if err != nil {
+			return err
+		}
+
+		err = checkTransaction(balance.Amount-held, a.Amount)
+		if err != nil {
+			return err
+		}
+	}
+
+	txID := uuid.NewV4().String()
+
+	query := `UPDATE adjustments SET status = $1, transactionid = $2, reviewedby = NULLIF($3, ''), updatedat = NOW()
+			  WHERE adjustmentid = $4 AND status = $5`
+
+	res, err := tx.Exec(query, StatusCompleted, txID, approver, a.AdjustmentID, AdjustmentPendingApproval)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrAdjustmentNotPending
+		}
+		return err
+	}
+
+	err = saveTransaction(tx, t, txID)
+	if err != nil {
+		return err
+	}
+
+	// only the user has a balance, the adjustments account stands for the operators
+	return updateBalance(tx, amount, a.UserID, txID)
+}
+
+func (s *SQLDatabase) adjustmentNotPending(adjustmentID string) error {
+	if _, err := s.GetAdjustment(adjustmentID); err != nil {
+		return err
+	}
+	return ErrAdjustmentNotPending
+}
+
+// adjustmentLock is the lock of the adjustments of the user
+func adjustmentLock(userID string) Transaction {
+	return Transaction{SenderID: userID, RecipientID: AdjustmentAccount}
+}
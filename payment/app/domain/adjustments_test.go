@@ -0,0 +1,124 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestSQLDatabase_Adjustments(t *testing.T) {
+	cleanDB(db)
+	pay := NewSQLDatabase(db)
+	pay.SetAdmin(AdminConfig{ApprovalThreshold: 1000})
+
+	if err := initBalance("1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	adjustment := func(requestID, direction string, amount float64) CreateAdjustment {
+		return CreateAdjustment{RequestID: requestID, UserID: "2", Direction: direction, Amount: amount, Currency: "SGD",
+			ReasonCode: "correction", Ticket: "SUP-1", CreatedBy: "alice"}
+	}
+
+	// small adjustments are applied straight away
+	a, err := pay.CreateAdjustment(adjustment("a", AdjustmentCredit, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.Status != StatusCompleted || a.TransactionID == "" {
+		t.Errorf("expected a completed adjustment, got %+v", a)
+	}
+
+	_, err = pay.CreateAdjustment(adjustment("b", AdjustmentDebit, 60))
+	if err != ErrInsufficientBalance {
+		t.Errorf("expected %v, got %v", ErrInsufficientBalance, err)
+	}
+
+	invalid := adjustment("c", AdjustmentCredit, 10)
+	invalid.Ticket = ""
+	if _, err := pay.CreateAdjustment(invalid); err != ErrInvalidAdjustment {
+		t.Errorf("expected %v, got %v", ErrInvalidAdjustment, err)
+	}
+
+	// large adjustments wait for a second operator
+	large, err := pay.CreateAdjustment(adjustment("d", AdjustmentCredit, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if large.Status != AdjustmentPendingApproval {
+		t.Fatalf("expected the adjustment to be pending approval, got %+v", large)
+	}
+
+	expectBalances(t, pay, 100, 50)
+
+	if _, err := pay.ApproveAdjustment(large.AdjustmentID, "alice"); err != ErrSelfApproval {
+		t.Errorf("expected %v, got %v", ErrSelfApproval, err)
+	}
+
+	large, err = pay.ApproveAdjustment(large.AdjustmentID, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if large.Status != StatusCompleted || large.ReviewedBy != "bob" {
+		t.Errorf("expected the adjustment to be approved by bob, got %+v", large)
+	}
+
+	expectBalances(t, pay, 100, 1050)
+
+	if _, err := pay.ApproveAdjustment(large.AdjustmentID, "carol"); err != ErrAdjustmentNotPending {
+		t.Errorf("expected %v, got %v", ErrAdjustmentNotPending, err)
+	}
+
+	rejected, err := pay.CreateAdjustment(adjustment("e", AdjustmentDebit, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rejected, err = pay.RejectAdjustment(rejected.AdjustmentID, "bob", "wrong user")
+	if err != nil || rejected.Status != AdjustmentRejected {
+		t.Errorf("expected the adjustment to be rejected, got %+v, %v", rejected, err)
+	}
+
+	expectBalances(t, pay, 100, 1050)
+
+	txs, err := pay.SearchTransactions(TransactionSearch{UserID: "2", Kind: KindAdjustment}, "bob")
+	if err != nil || len(txs) != 2 {
+		t.Fatalf("expected the 2 adjustments written to the ledger, got %v, %v", txs, err)
+	}
+
+	if txs[0].SenderID != AdjustmentAccount || txs[0].Amount != 1000 {
+		t.Errorf("expected the newest adjustment first, got %+v", txs[0])
+	}
+
+	entries, err := pay.ListAuditLog(ListAuditLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Actor+" "+e.Action)
+	}
+
+	expected := []string{"bob transactions.search", "bob adjustment.reject", "alice adjustment.create", "bob adjustment.approve",
+		"alice adjustment.create", "alice adjustment.create"}
+
+	if len(actions) != len(expected) {
+		t.Fatalf("expected audit log %v, got %v", expected, actions)
+	}
+
+	for i := range expected {
+		if actions[i] != expected[i] {
+			t.Errorf("expected audit log %v, got %v", expected, actions)
+			break
+		}
+	}
+
+	if _, err := db.Exec("DELETE FROM audit_log WHERE id > 0"); err == nil {
+		t.Error("expected the audit log to refuse deletes")
+	}
+}
@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	AuditAccountStatus      = "account.status"
+	AuditAdjustmentCreate   = "adjustment.create"
+	AuditAdjustmentApprove  = "adjustment.approve"
+	AuditAdjustmentReject   = "adjustment.reject"
+	AuditTransactionsSearch = "transactions.search"
+
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+// AuditEntry records an action of an operator. The audit log is append-only, the database refuses
+// to update or delete its rows.
+type AuditEntry struct {
+	ID     int64  `json:"id"`
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	// Target is what the action was made on, such as a user or an adjustment
+	Target    string          `json:"target,omitempty"`
+	Details   json.RawMessage `json:"details,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type ListAuditLog struct {
+	Actor  string
+	Action string
+	Target string
+	// Before only returns the entries older than the given id, to page through the log
+	Before int64
+	Limit  int
+}
+
+// audit appends the action to the audit log, in the SQL transaction of the action when it changes something
+// so that the action is recorded if and only if it happened
+func audit(e execer, actor, action, target string, details interface{}) error {
+	payload, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT into audit_log (actor, action, target, details) VALUES ($1, $2, NULLIF($3, ''), $4)`
+
+	_, err = e.Exec(query, actor, action, target, payload)
+	return err
+}
+
+// ListAuditLog returns the entries of the audit log matching the filters, newest first
+func (s *SQLDatabase) ListAuditLog(l ListAuditLog) ([]AuditEntry, error) {
+	if l.Limit <= 0 || l.Limit > auditMaxLimit {
+		l.Limit = auditDefaultLimit
+	}
+
+	query := `SELECT id, actor, action, COALESCE(target, ''), details, createdat FROM audit_log
+			  WHERE ($1 = '' OR actor = $1) AND ($2 = '' OR action = $2) AND ($3 = '' OR target = $3) AND ($4 = 0 OR id < $4)
+			  ORDER BY id DESC LIMIT $5`
+
+	rows, err := s.db.Query(query, l.Actor, l.Action, l.Target, l.Before, l.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		e := AuditEntry{}
+		var details []byte
+
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.Target, &details, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Details = details
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
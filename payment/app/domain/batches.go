@@ -0,0 +1,390 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	BatchAllOrNothing = "all_or_nothing"
+	BatchBestEffort   = "best_effort"
+
+	BatchProcessing         = "processing"
+	BatchCompleted          = "completed"
+	BatchPartiallyCompleted = "partially_completed"
+	BatchFailed             = "failed"
+
+	MaxBatchItems = 1000
+)
+
+var (
+	ErrBatchNotFound = errors.New("batch not found")
+	ErrInvalidBatch  = errors.New("a batch needs a mode, all_or_nothing or best_effort, and between 1 and 1000 transfers")
+	ErrBatchAborted  = errors.New("not made as another transfer of the batch failed")
+)
+
+// batchNamespace derives the request_id of each transfer from the batch, a batch that is resumed
+// after a crash does not pay the transfers that were already made
+var batchNamespace = uuid.NewV5(uuid.NamespaceURL, "payment/batches")
+
+// Batch is a list of transfers from a single sender. In all_or_nothing mode the transfers are made in a single
+// SQL transaction, either all of them or none. In best_effort mode each transfer is a separate payment.
+type Batch struct {
+	BatchID     string      `json:"batch_id"`
+	RequestID   string      `json:"request_id"`
+	SenderID    string      `json:"sender_id"`
+	Mode        string      `json:"mode"`
+	Status      string      `json:"status"`
+	TotalAmount float64     `json:"total_amount"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Items       []BatchItem `json:"items"`
+}
+
+// BatchItem is the result of one transfer of the batch, its status is pending until it is processed
+type BatchItem struct {
+	Index         int     `json:"index"`
+	RequestID     string  `json:"request_id"`
+	RecipientID   string  `json:"recipient_id"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	Message       string  `json:"message"`
+	Status        string  `json:"status"`
+	TransactionID string  `json:"transaction_id,omitempty"`
+	FailureReason string  `json:"failure_reason,omitempty"`
+}
+
+type CreateBatch struct {
+	RequestID string          `json:"request_id"`
+	SenderID  string          `json:"sender_id"`
+	Mode      string          `json:"mode"`
+	Transfers []BatchTransfer `json:"transfers"`
+}
+
+type BatchTransfer struct {
+	RecipientID string  `json:"recipient_id"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+	Message     string  `json:"message"`
+}
+
+func (b *Batch) transaction(item BatchItem) Transaction {
+	return Transaction{
+		RequestID:   item.RequestID,
+		SenderID:    b.SenderID,
+		RecipientID: item.RecipientID,
+		Message:     item.Message,
+		Amount:      item.Amount,
+		Currency:    item.Currency,
+		Kind:        KindPayment,
+	}
+}
+
+// CreateBatch checks that the sender can afford all the transfers then makes them. It is idempotent on the request_id,
+// a batch that was interrupted is resumed.
+func (s *SQLDatabase) CreateBatch(c CreateBatch) (*Batch, error) {
+	var batchID string
+
+	err := s.db.QueryRow("SELECT batchid FROM batches WHERE requestid = $1", c.RequestID).Scan(&batchID)
+	if err == sql.ErrNoRows {
+		batchID, err = s.insertBatch(c)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := s.GetBatch(batchID)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Status == BatchProcessing {
+		if b.Mode == BatchAllOrNothing {
+			err = s.processAllOrNothing(b)
+		} else {
+			err = s.processBestEffort(b)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.GetBatch(batchID)
+}
+
+// insertBatch validates the batch and records it with all its transfers pending
+func (s *SQLDatabase) insertBatch(c CreateBatch) (string, error) {
+	if c.Mode != BatchAllOrNothing && c.Mode != BatchBestEffort || len(c.Transfers) == 0 || len(c.Transfers) > MaxBatchItems {
+		return "", ErrInvalidBatch
+	}
+
+	balance, err := s.GetBalance(c.SenderID)
+	if err != nil {
+		return "", err
+	}
+
+	var total float64
+	for _, transfer := range c.Transfers {
+		if transfer.Amount <= 0 {
+			return "", ErrNegativeAmount
+		}
+
+		if _, err := s.GetBalance(transfer.RecipientID); err != nil {
+			return "", err
+		}
+
+		// the sender pays the fee of each transfer on top of its amount
+		fee, err := s.feeFor(s.db, Transaction{SenderID: c.SenderID, Amount: transfer.Amount, Currency: transfer.Currency})
+		if err != nil {
+			return "", err
+		}
+
+		total += transfer.Amount + fee
+	}
+
+	held, err := s.heldAmount(s.db, c.SenderID, "")
+	if err != nil {
+		return "", err
+	}
+
+	if !lessOrEqual(total, balance.Amount-held) {
+		return "", ErrInsufficientBalance
+	}
+
+	batchID := uuid.NewV4().String()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := tx.Exec(`INSERT into batches (batchid, requestid, senderid, mode, status, totalamount)
+						 VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (requestid) DO NOTHING`,
+		batchID, c.RequestID, c.SenderID, c.Mode, BatchProcessing, total)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	// the same batch was created concurrently
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return "", err
+		}
+		return batchID, s.db.QueryRow("SELECT batchid FROM batches WHERE requestid = $1", c.RequestID).Scan(&batchID)
+	}
+
+	query := `INSERT into batch_items (batchid, idx, requestid, recipientid, amount, currency, message, status)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+	for i, transfer := range c.Transfers {
+		_, err := tx.Exec(query, batchID, i, batchRequestID(batchID, i), transfer.RecipientID, transfer.Amount, transfer.Currency,
+			transfer.Message, StatusPending)
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
+	return batchID, tx.Commit()
+}
+
+// processAllOrNothing makes all the pending transfers in a single SQL transaction run with lockedTxs on the accounts of
+// all the pairs. When a transfer is refused none is made and the batch fails in another one.
+func (s *SQLDatabase) processAllOrNothing(b *Batch) error {
+	pairs := make([]Transaction, 0, len(b.Items))
+	for _, item := range b.Items {
+		pairs = append(pairs, b.transaction(item))
+	}
+
+	err := s.lockedTxs(pairs, func(tx *sql.Tx) error {
+		// another call may have processed the batch while we were waiting for the locks
+		status, err := batchStatus(tx, b.BatchID)
+		if err != nil || status != BatchProcessing {
+			return err
+		}
+
+		for _, item := range b.Items {
+			_, err := s.transferTx(tx, b.transaction(item), transferHooks{
+				write: func(tx *sql.Tx, txID string) error {
+					return updateBatchItem(tx, b.BatchID, item.Index, StatusCompleted, txID, "")
+				},
+			})
+
+			if err == nil {
+				continue
+			}
+
+			if !isRejection(err) && err != ErrDuplicateRequest {
+				return err
+			}
+
+			return &batchRejection{index: item.Index, reason: err}
+		}
+
+		return updateBatchStatus(tx, b.BatchID, BatchCompleted)
+	})
+
+	if r, ok := err.(*batchRejection); ok {
+		return s.abortBatch(pairs, b.BatchID, r)
+	}
+
+	return err
+}
+
+// batchRejection rolls back the SQL transaction of an all-or-nothing batch when one of its transfers is refused
+type batchRejection struct {
+	index  int
+	reason error
+}
+
+func (r *batchRejection) Error() string {
+	return r.reason.Error()
+}
+
+// abortBatch fails all the transfers of the batch, the one that was refused with the reason, unless another call
+// processed the batch in between
+func (s *SQLDatabase) abortBatch(pairs []Transaction, batchID string, r *batchRejection) error {
+	return s.lockedTxs(pairs, func(tx *sql.Tx) error {
+		status, err := batchStatus(tx, batchID)
+		if err != nil || status != BatchProcessing {
+			return err
+		}
+
+		query := `UPDATE batch_items SET status = $1, failurereason = CASE WHEN idx = $2 THEN $3 ELSE $4 END
+				  WHERE batchid = $5 AND status = $6`
+
+		_, err = tx.Exec(query, StatusFailed, r.index, r.reason.Error(), ErrBatchAborted.Error(), batchID, StatusPending)
+		if err != nil {
+			return err
+		}
+
+		return updateBatchStatus(tx, batchID, BatchFailed)
+	})
+}
+
+// processBestEffort makes each pending transfer as a separate payment and records its outcome,
+// a refused transfer does not stop the following ones
+func (s *SQLDatabase) processBestEffort(b *Batch) error {
+	completed, failed := 0, 0
+
+	for _, item := range b.Items {
+		if item.Status == StatusPending {
+			_, err := s.SaveTransaction(b.transaction(item))
+
+			// a duplicate is a transfer that was made before the batch was interrupted
+			if err != nil && err != ErrDuplicateRequest && !isRejection(err) {
+				return err
+			}
+
+			t, err := s.GetTransactionByRequestID(item.RequestID)
+			if err != nil {
+				return err
+			}
+
+			err = updateBatchItem(s.db, b.BatchID, item.Index, t.Status, t.TransactionID, t.FailureReason)
+			if err != nil {
+				return err
+			}
+
+			item.Status = t.Status
+		}
+
+		// transfers pending a review are made, they may still be rejected
+		if item.Status == StatusFailed {
+			failed++
+		} else {
+			completed++
+		}
+	}
+
+	status := BatchPartiallyCompleted
+	if failed == 0 {
+		status = BatchCompleted
+	} else if completed == 0 {
+		status = BatchFailed
+	}
+
+	return updateBatchStatus(s.db, b.BatchID, status)
+}
+
+// execer runs statements either directly on the database or in a SQL transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func updateBatchItem(e execer, batchID string, index int, status, txID, failureReason string) error {
+	query := `UPDATE batch_items SET status = $1, transactionid = $2, failurereason = NULLIF($3, '')
+			  WHERE batchid = $4 AND idx = $5 AND status = $6`
+
+	_, err := e.Exec(query, status, txID, failureReason, batchID, index, StatusPending)
+	return err
+}
+
+func batchStatus(q querier, batchID string) (string, error) {
+	var status string
+	err := q.QueryRow("SELECT status FROM batches WHERE batchid = $1", batchID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", ErrBatchNotFound
+	}
+	return status, err
+}
+
+func updateBatchStatus(e execer, batchID, status string) error {
+	_, err := e.Exec(`UPDATE batches SET status = $1, updatedat = NOW() WHERE batchid = $2 AND status = $3`,
+		status, batchID, BatchProcessing)
+	return err
+}
+
+// GetBatch returns the batch with the result of each transfer
+func (s *SQLDatabase) GetBatch(batchID string) (*Batch, error) {
+	b := Batch{}
+
+	query := `SELECT batchid, requestid, senderid, mode, status, totalamount, createdat FROM batches WHERE batchid = $1`
+
+	err := s.db.QueryRow(query, batchID).Scan(&b.BatchID, &b.RequestID, &b.SenderID, &b.Mode, &b.Status, &b.TotalAmount, &b.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrBatchNotFound
+	}
+
+	if err != nil {
+		log.Error().Err(err)
+		return nil, err
+	}
+
+	query = `SELECT idx, requestid, recipientid, amount, currency, COALESCE(message, ''), status, COALESCE(transactionid, ''),
+			 COALESCE(failurereason, '') FROM batch_items WHERE batchid = $1 ORDER BY idx`
+
+	rows, err := s.db.Query(query, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := BatchItem{}
+		err := rows.Scan(&item.Index, &item.RequestID, &item.RecipientID, &item.Amount, &item.Currency, &item.Message,
+			&item.Status, &item.TransactionID, &item.FailureReason)
+		if err != nil {
+			return nil, err
+		}
+		b.Items = append(b.Items, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &b, nil
+}
+
+func batchRequestID(batchID string, index int) string {
+	return uuid.NewV5(batchNamespace, batchID+"/"+strconv.Itoa(index)).String()
+}
@@ -0,0 +1,175 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestSQLDatabase_CreateBatch(t *testing.T) {
+	pay := NewSQLDatabase(db)
+
+	transfers := []BatchTransfer{
+		{RecipientID: "2", Amount: 30, Currency: "SGD"},
+		{RecipientID: "3", Amount: 40, Currency: "SGD"},
+		{RecipientID: "2", Amount: 20, Currency: "SGD"},
+	}
+
+	tests := []struct {
+		name string
+		mode string
+		// drain is taken from the sender once the batch is validated, before its transfers are made
+		drain           float64
+		expectErr       error
+		expectedStatus  string
+		expectedItems   []string
+		expectedBalance map[string]float64
+	}{
+		{
+			name:            "all or nothing",
+			mode:            BatchAllOrNothing,
+			expectedStatus:  BatchCompleted,
+			expectedItems:   []string{StatusCompleted, StatusCompleted, StatusCompleted},
+			expectedBalance: map[string]float64{"1": 10, "2": 50, "3": 40},
+		},
+		{
+			name:            "all or nothing with a refused transfer",
+			mode:            BatchAllOrNothing,
+			drain:           20,
+			expectedStatus:  BatchFailed,
+			expectedItems:   []string{StatusFailed, StatusFailed, StatusFailed},
+			expectedBalance: map[string]float64{"1": 80, "2": 0, "3": 0},
+		},
+		{
+			name:            "best effort with a refused transfer",
+			mode:            BatchBestEffort,
+			drain:           20,
+			expectedStatus:  BatchPartiallyCompleted,
+			expectedItems:   []string{StatusCompleted, StatusCompleted, StatusFailed},
+			expectedBalance: map[string]float64{"1": 10, "2": 30, "3": 40},
+		},
+		{
+			name:            "total exceeding the balance",
+			mode:            BatchBestEffort,
+			drain:           -1,
+			expectErr:       ErrInsufficientBalance,
+			expectedBalance: map[string]float64{"1": 100, "2": 0, "3": 0},
+		},
+		{
+			name:            "unknown mode",
+			mode:            "sometimes",
+			expectErr:       ErrInvalidBatch,
+			expectedBalance: map[string]float64{"1": 100, "2": 0, "3": 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cleanDB(db)
+
+			initial := 100.0
+			if test.drain < 0 {
+				initial = 80
+			}
+
+			for userID, amount := range map[string]float64{"1": initial, "2": 0, "3": 0} {
+				if err := initBalance(userID, amount); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := CreateBatch{RequestID: "batch-1", SenderID: "1", Mode: test.mode, Transfers: transfers}
+
+			if test.drain > 0 {
+				// the batch is recorded then interrupted, it is resumed by the next call
+				if _, err := pay.insertBatch(c); err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := db.Exec(`UPDATE balance SET amount = amount - $1 WHERE userid = '1'`, test.drain); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			b, err := pay.CreateBatch(c)
+			if err != test.expectErr {
+				t.Fatalf("expected %v, got %v", test.expectErr, err)
+			}
+
+			for userID, expected := range test.expectedBalance {
+				balance, err := pay.GetBalance(userID)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if balance.Amount != expected {
+					t.Errorf("expected balance of user %s to be %v, got %v", userID, expected, balance.Amount)
+				}
+			}
+
+			if test.expectErr != nil {
+				return
+			}
+
+			if b.Status != test.expectedStatus || len(b.Items) != len(test.expectedItems) {
+				t.Fatalf("expected a %s batch with %d items, got %+v", test.expectedStatus, len(test.expectedItems), b)
+			}
+
+			for i, status := range test.expectedItems {
+				if b.Items[i].Status != status {
+					t.Errorf("item %d: expected %s, got %+v", i, status, b.Items[i])
+				}
+			}
+
+			// replaying the batch returns it as it is
+			replayed, err := pay.CreateBatch(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if replayed.BatchID != b.BatchID || replayed.Status != b.Status {
+				t.Errorf("expected the same batch, got %+v", replayed)
+			}
+		})
+	}
+}
+
+func TestSQLDatabase_CreateBatchWithFees(t *testing.T) {
+	cleanDB(db)
+	pay := NewSQLDatabase(db)
+
+	err := pay.SetFees(FeesConfig{
+		HouseAccount: "house",
+		Currencies: map[string]map[string]FeeSchedule{
+			"SGD": {DefaultTier: {Type: FeeFlat, Flat: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for userID, amount := range map[string]float64{"1": 100, "2": 0, "house": 0} {
+		if err := initBalance(userID, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the amounts add up to the balance but the fees do not fit
+	c := CreateBatch{RequestID: "batch-fees", SenderID: "1", Mode: BatchAllOrNothing, Transfers: []BatchTransfer{
+		{RecipientID: "2", Amount: 50, Currency: "SGD"},
+		{RecipientID: "2", Amount: 50, Currency: "SGD"},
+	}}
+
+	_, err = pay.CreateBatch(c)
+	if err != ErrInsufficientBalance {
+		t.Fatalf("expected %v, got %v", ErrInsufficientBalance, err)
+	}
+
+	c.Transfers[1].Amount = 48
+	b, err := pay.CreateBatch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.TotalAmount != 100 || b.Status != BatchCompleted {
+		t.Errorf("expected a completed batch with a total of 100, got %+v", b)
+	}
+}
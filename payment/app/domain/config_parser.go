@@ -0,0 +1,62 @@
+package domain
+
+import (
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	Limits         LimitsConfig         `json:"limits"`
+	Risk           RiskConfig           `json:"risk"`
+	Fees           FeesConfig           `json:"fees"`
+	Funding        FundingConfig        `json:"funding"`
+	FundingEvents  FundingEventsConfig  `json:"funding_events" yaml:"funding_events"`
+	Events         EventsConfig         `json:"events"`
+	Webhooks       WebhooksConfig       `json:"webhooks"`
+	Admin          AdminConfig          `json:"admin"`
+	Locks          LocksConfig          `json:"locks"`
+	Consistency    ConsistencyConfig    `json:"consistency"`
+	Reconciliation ReconciliationConfig `json:"reconciliation"`
+}
+
+// ReconciliationConfig sets how often the balances are reconciled with the transactions, 0 is never
+type ReconciliationConfig struct {
+	Interval time.Duration `json:"interval"`
+	// Record writes the discrepancies to the discrepancies table
+	Record bool `json:"record"`
+}
+
+// EventsConfig tells where the events of the outbox are published and how often
+type EventsConfig struct {
+	NSQD          string        `json:"nsqd"`
+	Topic         string        `json:"topic"`
+	RelayInterval time.Duration `json:"relay_interval" yaml:"relay_interval"`
+}
+
+func ParseFileConfig(filename string) (Config, error) {
+	source, err := ioutil.ReadFile(filename)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	c := Config{}
+
+	err = yaml.Unmarshal(source, &c)
+	if err != nil {
+		return Config{}, err
+	}
+
+	// the workers need an interval to tick
+	if c.Events.RelayInterval <= 0 {
+		c.Events.RelayInterval = time.Second
+	}
+
+	if c.Webhooks.Interval <= 0 {
+		c.Webhooks.Interval = 5 * time.Second
+	}
+
+	return c, nil
+}
@@ -0,0 +1,135 @@
+package domain
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// ConsistencyLocks checks and writes a transfer in a SQL transaction begun once the locks are held,
+	// the locks alone keep the balances from changing in between
+	ConsistencyLocks = "locks"
+	// ConsistencyForUpdate also locks the balances of the transfer with SELECT ... FOR UPDATE, in a SQL transaction
+	// on the connection holding the locks
+	ConsistencyForUpdate = "for_update"
+	// ConsistencySerializable runs the SQL transaction on the connection holding the locks with the SERIALIZABLE
+	// isolation level, transfers that fail to serialize are tried again
+	ConsistencySerializable = "serializable"
+)
+
+// ConsistencyConfig chooses how a transfer is kept consistent with the balances it reads
+type ConsistencyConfig struct {
+	Mode string `json:"mode"`
+	// Retries is how many times a transfer that failed to serialize is tried again
+	Retries int `json:"retries"`
+}
+
+func (s *SQLDatabase) SetConsistency(c ConsistencyConfig) error {
+	if c.Mode == "" {
+		c.Mode = ConsistencyLocks
+	}
+
+	if c.Retries <= 0 {
+		c.Retries = 3
+	}
+
+	switch c.Mode {
+	case ConsistencyLocks, ConsistencyForUpdate, ConsistencySerializable:
+	default:
+		return fmt.Errorf("unknown consistency mode %q", c.Mode)
+	}
+
+	s.consistency = c
+	return nil
+}
+
+// lockedTx runs fn in a SQL transaction while the locks of the accounts of the transaction are held, the writes to
+// the balances of every kind of transfer go through it so that they all follow the consistency mode
+func (s *SQLDatabase) lockedTx(t Transaction, fn func(tx *sql.Tx) error) error {
+	return s.lockedTxs([]Transaction{t}, fn)
+}
+
+// lockedTxs is lockedTx for the accounts of all the transactions. In locks mode the SQL transaction is begun once the
+// locks are held, the other modes run it with inLockedTx.
+func (s *SQLDatabase) lockedTxs(ts []Transaction, fn func(tx *sql.Tx) error) error {
+	if s.consistency.Mode != ConsistencyLocks {
+		return s.inLockedTx(ts, fn)
+	}
+
+	return s.withLocks(ts, func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		return runTx(tx, fn)
+	})
+}
+
+// inLockedTx runs fn in a single SQL transaction on the connection holding the locks of the accounts of the
+// transactions, its reads, checks and writes included. In for_update mode the balances are locked first, in the order
+// of the user ids. In serializable mode fn is run again, locks and all, when the SQL transaction failed to serialize,
+// unless the context of the request is done in between. fn must not keep anything from an attempt that failed.
+func (s *SQLDatabase) inLockedTx(ts []Transaction, fn func(tx *sql.Tx) error) error {
+	accounts := lockedAccounts(ts)
+
+	opts := &sql.TxOptions{}
+	if s.consistency.Mode == ConsistencySerializable {
+		opts.Isolation = sql.LevelSerializable
+	}
+
+	wait := lockRetryBase
+
+	for attempt := 0; ; attempt++ {
+		err := s.withLockedTx(accounts, opts, func(tx *sql.Tx) error {
+			if s.consistency.Mode == ConsistencyForUpdate {
+				_, err := tx.Exec("SELECT userid FROM balance WHERE userid = ANY($1) ORDER BY userid FOR UPDATE",
+					pq.Array(accounts))
+				if err != nil {
+					return err
+				}
+			}
+
+			return fn(tx)
+		})
+
+		if !isSerializationFailure(err) || attempt >= s.consistency.Retries {
+			return err
+		}
+
+		atomic.AddInt64(&s.lockCounters.retried, 1)
+
+		// the client may be gone while waiting to try again
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.requestContext().Done():
+			timer.Stop()
+			return s.requestContext().Err()
+		}
+
+		wait *= 2
+		if wait > lockRetryMax {
+			wait = lockRetryMax
+		}
+	}
+}
+
+// withLockedTx runs fn in a SQL transaction on the connection holding the locks of the accounts
+func (s *SQLDatabase) withLockedTx(accounts []string, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	ctx, cancel := context.WithTimeout(s.requestContext(), s.locks.Timeout)
+	defer cancel()
+
+	return s.lockStrategy.WithLockedTx(ctx, accounts, opts, fn)
+}
+
+// isSerializationFailure tells whether the SQL transaction was aborted by a concurrent one and can be tried again
+func isSerializationFailure(err error) bool {
+	e, ok := err.(*pq.Error)
+	return ok && (e.Code == "40001" || e.Code == "40P01")
+}
@@ -0,0 +1,53 @@
+package domain
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestSQLDatabase_Consistency(t *testing.T) {
+	for _, mode := range []string{ConsistencyForUpdate, ConsistencySerializable} {
+		for _, strategy := range lockStrategies {
+			t.Run(mode+"/"+strategy, func(t *testing.T) {
+				pay := NewSQLDatabase(db)
+				if err := pay.SetLocks(LocksConfig{Strategy: strategy, Timeout: 10 * time.Second}); err != nil {
+					t.Fatal(err)
+				}
+				if err := pay.SetConsistency(ConsistencyConfig{Mode: mode}); err != nil {
+					t.Fatal(err)
+				}
+
+				expectNoOverdraft(t, pay)
+			})
+		}
+	}
+}
+
+func TestSQLDatabase_SetConsistency(t *testing.T) {
+	pay := NewSQLDatabase(db)
+
+	if err := pay.SetConsistency(ConsistencyConfig{Mode: "optimistic"}); err == nil {
+		t.Error("expected an unknown mode to be refused")
+	}
+}
+
+func TestIsSerializationFailure(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "40P01"}, true},
+		{&pq.Error{Code: "23505"}, false},
+		{ErrInsufficientBalance, false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := isSerializationFailure(test.err); got != test.expected {
+			t.Errorf("expected %v for %v, got %v", test.expected, test.err, got)
+		}
+	}
+}
@@ -5,8 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"hash/fnv"
-	"sort"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -15,12 +14,62 @@ import (
 
 type DB interface {
 	SaveTransaction(t Transaction) (*string, error)
+	Refund(r RefundRequest) (*Transaction, error)
+	GetTransaction(transactionID string) (*Transaction, error)
+	GetTransactionByRequestID(requestID string) (*Transaction, error)
 	GetBalance(userID string) (*Balance, error)
-	Lock(t Transaction, conn *sql.Conn) (int, error)
-	Unlock(keyStr int, conn *sql.Conn) error
+	WithContext(ctx context.Context) DB
 	GetAllTransactions(request GetTransactions) ([]Transaction, error)
+	OpenBalance(userID string) error
+	CreateHold(c CreateHold) (*Hold, error)
+	GetHold(holdID string) (*Hold, error)
+	Capture(c CaptureHold) (*Transaction, error)
+	Void(holdID string) (*Hold, error)
+	CreateSchedule(c CreateSchedule) (*Schedule, error)
+	GetSchedule(scheduleID string) (*Schedule, error)
+	ListSchedules(userID string) ([]Schedule, error)
+	CancelSchedule(scheduleID string) (*Schedule, error)
+	CreateMoneyRequest(c CreateMoneyRequest) (*MoneyRequest, error)
+	GetMoneyRequest(moneyRequestID string) (*MoneyRequest, error)
+	ListMoneyRequests(l ListMoneyRequests) ([]MoneyRequest, error)
+	AcceptMoneyRequest(moneyRequestID string) (*MoneyRequest, error)
+	DeclineMoneyRequest(moneyRequestID string) (*MoneyRequest, error)
+	CancelMoneyRequest(moneyRequestID string) (*MoneyRequest, error)
+	CreateBatch(c CreateBatch) (*Batch, error)
+	GetBatch(batchID string) (*Batch, error)
+	CreateSplit(c CreateSplit) (*Split, error)
+	GetSplit(splitID string) (*Split, error)
+	ListPendingTransactions() ([]Transaction, error)
+	ReleaseTransaction(transactionID string) (*Transaction, error)
+	RejectTransaction(transactionID, reason string) (*Transaction, error)
+	Quote(senderID string, amount float64, currency string) (*Quote, error)
+	CreateFunding(c CreateFunding) (*Funding, error)
+	GetFunding(fundingID string) (*Funding, error)
+	HandleFundingEvent(e FundingEvent) (*Funding, error)
+	GetAccount(userID string) (*Account, error)
+	SetAccountStatus(c SetAccountStatus) (*Account, error)
+	CreateAdjustment(c CreateAdjustment) (*Adjustment, error)
+	GetAdjustment(adjustmentID string) (*Adjustment, error)
+	ListAdjustments(status string) ([]Adjustment, error)
+	ApproveAdjustment(adjustmentID, approver string) (*Adjustment, error)
+	RejectAdjustment(adjustmentID, actor, reason string) (*Adjustment, error)
+	SearchTransactions(q TransactionSearch, actor string) ([]Transaction, error)
+	ListAuditLog(l ListAuditLog) ([]AuditEntry, error)
+	WriteStatement(ctx context.Context, g GetStatement, w StatementWriter) error
+	CreateWebhookSubscription(c CreateWebhookSubscription) (*WebhookSubscription, error)
+	GetWebhookSubscription(subscriptionID string) (*WebhookSubscription, error)
+	ListWebhookSubscriptions(userID string) ([]WebhookSubscription, error)
+	DeleteWebhookSubscription(subscriptionID string) (*WebhookSubscription, error)
+	GetWebhookDelivery(deliveryID string) (*WebhookDelivery, error)
+	ListWebhookDeliveries(l ListWebhookDeliveries) ([]WebhookDelivery, error)
+	ReplayWebhookDelivery(deliveryID string) (*WebhookDelivery, error)
 }
 
+const (
+	KindPayment = "payment"
+	KindRefund  = "refund"
+)
+
 type Transaction struct {
 	RequestID     string    `json:"request_id"`
 	TransactionID string    `json:"transaction_id"`
@@ -30,12 +79,34 @@ type Transaction struct {
 	Amount        float64   `json:"amount"`
 	Currency      string    `json:"currency"`
 	CreatedAt     time.Time `json:"created_at"`
+	Kind          string    `json:"kind"`
+	Status        string    `json:"status"`
+	// SettledAt is when the money moved, after created_at for payments released after a review
+	SettledAt *time.Time `json:"settled_at,omitempty"`
+	// FailureReason explains why a failed transaction was refused
+	FailureReason string `json:"failure_reason,omitempty"`
+	// Fee is paid by the sender on top of the amount, it is also listed as a transaction of its own
+	Fee float64 `json:"fee,omitempty"`
+	// RiskReasons are the risk rules that sent the payment to review
+	RiskReasons string `json:"risk_reasons,omitempty"`
+	// OriginalTransactionID links a refund to the payment it reverses, and a fee to the payment it was charged for
+	OriginalTransactionID string `json:"original_transaction_id,omitempty"`
+	// Refunds and RefundedAmount are only set on payments that were refunded
+	Refunds        []string `json:"refunds,omitempty"`
+	RefundedAmount float64  `json:"refunded_amount,omitempty"`
+
+	// capturedHold is the hold this transaction captures, its funds are available to the transaction
+	capturedHold string
 }
 
 type GetTransactions struct {
 	UserID string `json:"user_id"`
 }
 
+type OpenBalance struct {
+	UserID string `json:"user_id"`
+}
+
 func (t Transaction) String() string {
 	return fmt.Sprintf("%s-%s-%s-%f-%s-%s", t.RequestID, t.SenderID, t.RecipientID, t.Amount, t.Currency, t.Message)
 }
@@ -46,82 +117,222 @@ type Balance struct {
 }
 
 type SQLDatabase struct {
-	db *sql.DB
+	db          *sql.DB
+	limits      LimitsConfig
+	risk        RiskEvaluator
+	fees        FeesConfig
+	funding     FundingProvider
+	webhooks    WebhooksConfig
+	admin       AdminConfig
+	locks       LocksConfig
+	consistency ConsistencyConfig
+
+	lockStrategy LockStrategy
+	lockCounters *lockCounters
+	// ctx is the context of the request the database was bound to by WithContext
+	ctx context.Context
 }
 
 func NewSQLDatabase(db *sql.DB) *SQLDatabase {
-	return &SQLDatabase{db: db}
+	s := &SQLDatabase{db: db, lockCounters: &lockCounters{}}
+	s.SetWebhooks(WebhooksConfig{})
+	s.SetLocks(LocksConfig{})
+	s.SetConsistency(ConsistencyConfig{})
+	return s
 }
 
+// SaveTransaction pays the recipient. Refused payments are recorded as failed along with the reason,
+// they can be retried with the same request_id.
 func (s *SQLDatabase) SaveTransaction(t Transaction) (*string, error) {
-	conn, err := s.db.Conn(context.Background())
-	if err != nil {
-		return nil, err
+	return s.pay(t, transferHooks{})
+}
+
+// pay is the path of every payment, the hooks add the rules of the feature the payment comes from
+func (s *SQLDatabase) pay(t Transaction, hooks transferHooks) (*string, error) {
+	// the outcome of the payment is ours to record, whatever the caller sent
+	t.Kind = KindPayment
+	t.OriginalTransactionID = ""
+	t.FailureReason = ""
+	t.RiskReasons = ""
+
+	txID, err := s.transfer(t, hooks)
+	if isRejection(err) {
+		s.recordFailure(t, err)
 	}
 
-	// mutex lock
-	keyMutex, err := s.Lock(t, conn)
+	return txID, err
+}
+
+// transferHooks let the different kinds of transfers add their own rules to transfer
+type transferHooks struct {
+	// check is run in the SQL transaction once the lock is held and can refuse or amend the transfer
+	check func(q querier, t *Transaction) error
+	// write is run in the SQL transaction once the transaction record and balances are written
+	write func(tx *sql.Tx, txID string) error
+}
+
+// transfer moves the amount from the sender to the recipient while holding the locks of their accounts
+func (s *SQLDatabase) transfer(t Transaction, hooks transferHooks) (*string, error) {
+	var txID string
+
+	err := s.lockedTx(t, func(tx *sql.Tx) error {
+		var err error
+		txID, err = s.transferTx(tx, t, hooks)
+		return err
+	})
+
 	if err != nil {
 		return nil, err
 	}
 
-	// defer unlock
-	defer func() {
-		err := s.Unlock(keyMutex, conn)
-		log.Error().Err(err).Msg("error releasing the lock")
-	}()
+	return &txID, nil
+}
 
-	senderBalance, err := s.GetBalance(t.SenderID)
+// transferTx checks and writes the transfer in the SQL transaction, the caller holds the locks of the accounts.
+// Balances are read in the SQL transaction so that several transfers can be written in the same one.
+func (s *SQLDatabase) transferTx(tx *sql.Tx, t Transaction, hooks transferHooks) (string, error) {
+	if hooks.check != nil {
+		err := hooks.check(tx, &t)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := checkAccounts(tx, t.SenderID, t.RecipientID)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	err = checkTransaction(senderBalance.Amount, t.Amount)
+	senderBalance, err := getBalance(tx, t.SenderID)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	recipientBalance, err := s.GetBalance(t.RecipientID)
+	// funds reserved by holds are not available, except those of the hold being captured
+	held, err := s.heldAmount(tx, t.SenderID, t.capturedHold)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	// the sender pays the fee on top of the amount
+	t.Fee = 0
+	if t.Kind == KindPayment {
+		t.Fee, err = s.feeFor(tx, t)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = checkTransaction(senderBalance.Amount-held, t.Amount+t.Fee)
+	if err != nil {
+		return "", err
+	}
+
+	if t.Kind == KindPayment {
+		err = s.checkLimits(tx, t)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := getBalance(tx, t.RecipientID); err != nil {
+		return "", err
 	}
 
 	// generate uuid
 	txID := uuid.NewV4().String()
 
-	// begin transaction
-	tx, err := s.db.Begin()
-	if err != nil {
-		return nil, err
+	t.Status = StatusCompleted
+
+	if t.Kind == KindPayment && s.risk != nil {
+		decision, err := s.risk.Evaluate(t, txHistory{tx})
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case decision.Action == RiskDeny:
+			return "", &RiskError{Reasons: decision.Reasons}
+
+		// transfers that complete something else, such as a money request, cannot wait for a review
+		case decision.Action == RiskReview && hooks.write != nil:
+			return "", &RiskError{Reasons: decision.Reasons}
+
+		// the payment is written without moving the money, its amount is held until it is released
+		case decision.Action == RiskReview:
+			t.Status = StatusPending
+			t.RiskReasons = strings.Join(decision.Reasons, ", ")
+			return txID, saveTransaction(tx, t, txID)
+		}
 	}
 
 	// save transaction record
 	err = saveTransaction(tx, t, txID)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+
+	err = s.moveMoney(tx, t, txID)
+	if err != nil {
+		return "", err
+	}
+
+	if t.Kind == KindPayment {
+		err = writeEvent(tx, EventPaymentCompleted, txID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if hooks.write != nil {
+		err = hooks.write(tx, txID)
+		if err != nil {
+			return "", err
+		}
 	}
 
+	return txID, nil
+}
+
+// moveMoney updates the balances of a written transaction and charges its fee
+func (s *SQLDatabase) moveMoney(tx *sql.Tx, t Transaction, txID string) error {
 	// update sender balance
-	err = updateBalance(tx, senderBalance.Amount-t.Amount, t.SenderID, txID)
+	err := updateBalance(tx, -t.Amount, t.SenderID, txID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// update receiver balance
-	err = updateBalance(tx, recipientBalance.Amount+t.Amount, t.RecipientID, txID)
+	err = updateBalance(tx, t.Amount, t.RecipientID, txID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// commit
-	return &txID, tx.Commit()
+	if t.Fee > 0 {
+		return s.chargeFee(tx, t, txID)
+	}
+
+	return nil
 }
 
 func (s *SQLDatabase) GetBalance(userID string) (*Balance, error) {
+	return getBalance(s.db, userID)
+}
+
+// querier runs queries either directly on the database or in a SQL transaction
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func getBalance(q querier, userID string) (*Balance, error) {
 	balance := Balance{}
 	query := "SELECT amount, lastTransactionId FROM balance WHERE userid = $1"
 
-	err := s.db.QueryRow(query, userID).Scan(&balance.Amount, &balance.LastTransaction)
+	err := q.QueryRow(query, userID).Scan(&balance.Amount, &balance.LastTransaction)
+	if err == sql.ErrNoRows {
+		return nil, ErrAccountNotFound
+	}
+
 	if err != nil {
 		log.Error().Err(err)
 		return nil, err
@@ -130,59 +341,71 @@ func (s *SQLDatabase) GetBalance(userID string) (*Balance, error) {
 	return &balance, nil
 }
 
+// OpenBalance creates an empty balance for the user, it does nothing if the user already has one
+func (s *SQLDatabase) OpenBalance(userID string) error {
+	query := `INSERT into balance (userid, amount) VALUES ($1, 0) ON CONFLICT (userid) DO NOTHING`
+
+	_, err := s.db.Exec(query, userID)
+	if err != nil {
+		log.Error().Err(err)
+	}
+	return err
+}
+
+var (
+	ErrNegativeAmount      = errors.New("amount is negative")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrAccountNotFound     = errors.New("account not found")
+)
+
 func checkTransaction(balance, withdrawal float64) error {
 	if withdrawal < 0 {
-		return errors.New("amount is negative")
+		return ErrNegativeAmount
 	}
 
 	if balance-withdrawal < 0 {
-		return errors.New("insufficient balance")
+		return ErrInsufficientBalance
 	}
 
 	return nil
 }
 
-func (s *SQLDatabase) Lock(t Transaction, conn *sql.Conn) (int, error) {
-	key := []string{t.RecipientID, t.SenderID}
-
-	sort.Strings(key)
-
-	keyStr := fmt.Sprint(key)
-	h := fnv.New32a()
-	_, err := h.Write([]byte(keyStr))
-
+// saveTransaction inserts the transaction record. A failed transaction with the same request_id is replaced
+// as it is being retried, any other transaction with the same request_id makes it a duplicate.
+func saveTransaction(tx *sql.Tx, t Transaction, txID string) error {
+	query := `INSERT into transactions  (requestid, transactionid, senderid, receiverid, amount, currency, message, kind,
+			  originaltransactionid, status, failurereason, riskreasons, fee, settledat)
+ 			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, NULLIF($11, ''), NULLIF($12, ''), $13,
+			  CASE WHEN $14 THEN NOW() END)
+			  ON CONFLICT (requestid) DO UPDATE SET transactionid = EXCLUDED.transactionid, senderid = EXCLUDED.senderid,
+			  receiverid = EXCLUDED.receiverid, amount = EXCLUDED.amount, currency = EXCLUDED.currency, message = EXCLUDED.message,
+			  kind = EXCLUDED.kind, originaltransactionid = EXCLUDED.originaltransactionid, status = EXCLUDED.status,
+			  failurereason = EXCLUDED.failurereason, riskreasons = EXCLUDED.riskreasons, fee = EXCLUDED.fee, createdat = NOW(),
+			  settledat = EXCLUDED.settledat
+			  WHERE transactions.status = 'failed'`
+
+	res, err := tx.Exec(query, t.RequestID, txID, t.SenderID, t.RecipientID, t.Amount, t.Currency, t.Message,
+		t.Kind, t.OriginalTransactionID, t.Status, t.FailureReason, t.RiskReasons, t.Fee, t.Status == StatusCompleted)
 	if err != nil {
-		return 0, err
+		log.Error().Err(err)
+		tx.Rollback()
+		return err
 	}
-	hash := h.Sum32()
 
-	_, err = conn.ExecContext(context.Background(), `SELECT pg_advisory_lock($1)`, hash)
-	if err != nil {
-		return 0, err
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		err = ErrDuplicateRequest
 	}
 
-	return int(hash), err
-}
-
-func (s *SQLDatabase) Unlock(keyStr int, conn *sql.Conn) error {
-	_, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, keyStr)
-	return err
-}
-
-func saveTransaction(tx *sql.Tx, t Transaction, txID string) error {
-	query := `INSERT into transactions  (requestid, transactionid, senderid, receiverid, amount, currency, message )
- 			  VALUES ($1, $2, $3, $4, $5, $6)`
-
-	_, err := tx.Exec(query, t.RequestID, txID, t.SenderID, t.RecipientID, t.Amount, t.Currency, t.Message)
 	if err != nil {
-		log.Error().Err(err)
 		tx.Rollback()
 	}
 	return err
 }
 
+// updateBalance adds the amount, negative for withdrawals, to the balance of the user
 func updateBalance(tx *sql.Tx, amount float64, userID string, txID string) error {
-	_, err := tx.Exec("UPDATE balance SET Amount = $1, lastTransactionId = $2 WHERE userId = $3 ", amount, txID, userID)
+	_, err := tx.Exec("UPDATE balance SET Amount = Amount + $1, lastTransactionId = $2 WHERE userId = $3 ", amount, txID, userID)
 	if err != nil {
 		log.Error().Err(err)
 		tx.Rollback()
@@ -190,10 +413,30 @@ func updateBalance(tx *sql.Tx, amount float64, userID string, txID string) error
 	return err
 }
 
-func (s *SQLDatabase) GetAllTransactions(request GetTransactions) ([]Transaction, error) {
-	userSQL := "SELECT requestid, transactionid, senderid, receiverid, amount, currency, createdat FROM transactions WHERE senderid = $1 OR receiverid = $1"
+const transactionColumns = `requestid, transactionid, senderid, receiverid, amount, currency, COALESCE(message, ''), createdat,
+	kind, COALESCE(originaltransactionid, ''), status, COALESCE(failurereason, ''), COALESCE(riskreasons, ''), fee,
+	settledat`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTransaction(row scanner) (Transaction, error) {
+	t := Transaction{}
+	var settledAt sql.NullTime
+	err := row.Scan(&t.RequestID, &t.TransactionID, &t.SenderID, &t.RecipientID, &t.Amount, &t.Currency, &t.Message, &t.CreatedAt,
+		&t.Kind, &t.OriginalTransactionID, &t.Status, &t.FailureReason, &t.RiskReasons, &t.Fee, &settledAt)
+	if settledAt.Valid {
+		t.SettledAt = &settledAt.Time
+	}
+	return t, err
+}
 
-	rows, err := s.db.Query(userSQL, request.UserID)
+// userTransactionsSQL selects the transactions the user sent or received, callers add their conditions and order
+const userTransactionsSQL = "SELECT " + transactionColumns + " FROM transactions WHERE (senderid = $1 OR receiverid = $1)"
+
+func (s *SQLDatabase) GetAllTransactions(request GetTransactions) ([]Transaction, error) {
+	rows, err := s.db.Query(userTransactionsSQL+" ORDER BY id", request.UserID)
 	if err != nil {
 		log.Error().Msgf("Failed to execute query: %s", err)
 	}
@@ -206,28 +449,15 @@ func (s *SQLDatabase) GetAllTransactions(request GetTransactions) ([]Transaction
 	defer rows.Close()
 
 	var t []Transaction
-	var requestID, transactionID, currency, msg string
-	var senderID, recipientID string
-	var amount float64
-	var createdAt time.Time
 
 	for rows.Next() {
-		err := rows.Scan(&requestID, &transactionID, &senderID, &recipientID, &amount, &currency, &msg, &createdAt)
+		tx, err := scanTransaction(rows)
 		if err != nil {
 			log.Error().Err(err)
 			return nil, err
 		}
 
-		t = append(t, Transaction{
-			RequestID:     requestID,
-			TransactionID: transactionID,
-			SenderID:      senderID,
-			RecipientID:   recipientID,
-			Amount:        amount,
-			Message:       msg,
-			Currency:      currency,
-			CreatedAt:     createdAt,
-		})
+		t = append(t, tx)
 	}
 
 	err = rows.Err()
@@ -235,5 +465,33 @@ func (s *SQLDatabase) GetAllTransactions(request GetTransactions) ([]Transaction
 		log.Error().Err(err)
 		return nil, err
 	}
+
+	linkRefunds(t)
+
 	return t, nil
 }
+
+// linkRefunds lists on each payment the refunds that reverse it. Both parties of a payment
+// are also the parties of its refunds, so they are always part of the same history.
+func linkRefunds(txs []Transaction) {
+	payments := map[string]int{}
+	for i, tx := range txs {
+		if tx.Kind == KindPayment {
+			payments[tx.TransactionID] = i
+		}
+	}
+
+	for _, tx := range txs {
+		if tx.Kind != KindRefund || tx.Status == StatusFailed {
+			continue
+		}
+
+		i, ok := payments[tx.OriginalTransactionID]
+		if !ok {
+			continue
+		}
+
+		txs[i].Refunds = append(txs[i].Refunds, tx.TransactionID)
+		txs[i].RefundedAmount += tx.Amount
+	}
+}
@@ -54,13 +54,133 @@ func teardown() {
 }
 
 func cleanDB(db *sql.DB) {
-	query := `DELETE from balance WHERE id > 0`
+	// the audit log refuses deletes, truncating it is only for tests
+	query := `TRUNCATE audit_log`
 
 	_, err := db.Exec(query)
 	if err != nil {
 		panic(err)
 	}
 
+	query = `DELETE from discrepancies WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from adjustments WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from webhook_attempts WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from webhook_deliveries WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from webhook_subscriptions WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from outbox WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from fundings WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from batch_items WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from batches WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from split_parts WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from money_requests WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from splits WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from schedule_runs WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from schedules WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from holds WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from account_status_changes WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
+	query = `DELETE from balance WHERE id > 0`
+
+	_, err = db.Exec(query)
+	if err != nil {
+		panic(err)
+	}
+
 	query = `DELETE from transactions WHERE id > 0`
 
 	_, err = db.Exec(query)
@@ -197,8 +317,8 @@ func TestConcurrentRequests(t *testing.T) {
 
 	for i := 0; i < n; i++ {
 		i := i
+		wg.Add(1)
 		go func() {
-			wg.Add(1)
 			defer wg.Done()
 
 			_, err := pay.SaveTransaction(Transaction{
@@ -0,0 +1,206 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	KindFee = "fee"
+
+	FeeFlat       = "flat"
+	FeePercentage = "percentage"
+	FeeTiered     = "tiered"
+)
+
+var (
+	ErrInvalidFee = errors.New("invalid fee schedule")
+
+	feeNamespace = uuid.NewV5(uuid.NamespaceURL, "payment/fees")
+)
+
+// FeeTier is the fee of the amounts up to UpTo, the last tier has no UpTo
+type FeeTier struct {
+	UpTo       float64 `json:"up_to" yaml:"up_to"`
+	Flat       float64 `json:"flat"`
+	Percentage float64 `json:"percentage"`
+}
+
+// FeeSchedule is how much a payment costs its sender, on top of the amount sent.
+// Min and Max bound the fee, 0 is no bound.
+type FeeSchedule struct {
+	Type       string    `json:"type"`
+	Flat       float64   `json:"flat"`
+	Percentage float64   `json:"percentage"`
+	Tiers      []FeeTier `json:"tiers"`
+	Min        float64   `json:"min"`
+	Max        float64   `json:"max"`
+}
+
+// FeesConfig sets fee schedules per currency then per user tier, payments without a schedule are free.
+// Fees are paid to the house account.
+type FeesConfig struct {
+	HouseAccount string                            `json:"house_account" yaml:"house_account"`
+	Currencies   map[string]map[string]FeeSchedule `json:"currencies"`
+}
+
+// Quote is what a payment would cost its sender
+type Quote struct {
+	SenderID string  `json:"sender_id"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+	Fee      float64 `json:"fee"`
+	Total    float64 `json:"total"`
+}
+
+// Fee returns the fee of a payment of the amount, rounded to the cent
+func (f FeeSchedule) Fee(amount float64) float64 {
+	if amount <= 0 {
+		return 0
+	}
+
+	var fee float64
+
+	switch f.Type {
+	case FeeFlat:
+		fee = f.Flat
+	case FeePercentage:
+		fee = amount * f.Percentage / 100
+	case FeeTiered:
+		for _, t := range f.Tiers {
+			if t.UpTo == 0 || lessOrEqual(amount, t.UpTo) {
+				fee = t.Flat + amount*t.Percentage/100
+				break
+			}
+		}
+	}
+
+	if f.Min > 0 && fee < f.Min {
+		fee = f.Min
+	}
+
+	if f.Max > 0 && fee > f.Max {
+		fee = f.Max
+	}
+
+	return math.Round(fee*100) / 100
+}
+
+func (f FeeSchedule) validate() error {
+	switch f.Type {
+	case FeeFlat, FeePercentage:
+	case FeeTiered:
+		if len(f.Tiers) == 0 {
+			return errors.New("tiered fees need tiers")
+		}
+
+		for i, t := range f.Tiers {
+			last := i == len(f.Tiers)-1
+			if (t.UpTo == 0) != last || (i > 0 && !last && t.UpTo <= f.Tiers[i-1].UpTo) {
+				return errors.New("tiers must be in increasing up_to order, only the last one without up_to")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %q", f.Type)
+	}
+
+	if f.Max > 0 && f.Max < f.Min {
+		return errors.New("max is lower than min")
+	}
+
+	return nil
+}
+
+// SetFees makes payments pay the fees of the schedules to the house account
+func (s *SQLDatabase) SetFees(fees FeesConfig) error {
+	for currency, tiers := range fees.Currencies {
+		for tier, f := range tiers {
+			if err := f.validate(); err != nil {
+				return fmt.Errorf("%w for %s %s: %s", ErrInvalidFee, currency, tier, err)
+			}
+		}
+	}
+
+	if len(fees.Currencies) > 0 && fees.HouseAccount == "" {
+		return fmt.Errorf("%w: house_account is required", ErrInvalidFee)
+	}
+
+	s.fees = fees
+	return nil
+}
+
+// feeFor returns the fee the sender pays for the payment, the house account pays no fee
+func (s *SQLDatabase) feeFor(q querier, t Transaction) (float64, error) {
+	tiers, ok := s.fees.Currencies[t.Currency]
+	if !ok || t.SenderID == s.fees.HouseAccount {
+		return 0, nil
+	}
+
+	var tier string
+	err := q.QueryRow("SELECT tier FROM balance WHERE userid = $1", t.SenderID).Scan(&tier)
+	if err == sql.ErrNoRows {
+		return 0, ErrAccountNotFound
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return tiers[tier].Fee(t.Amount), nil
+}
+
+// Quote previews the fee of a payment without making it
+func (s *SQLDatabase) Quote(senderID string, amount float64, currency string) (*Quote, error) {
+	if amount < 0 {
+		return nil, ErrNegativeAmount
+	}
+
+	if _, err := s.GetBalance(senderID); err != nil {
+		return nil, err
+	}
+
+	fee, err := s.feeFor(s.db, Transaction{SenderID: senderID, Amount: amount, Currency: currency})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Quote{SenderID: senderID, Amount: amount, Currency: currency, Fee: fee, Total: amount + fee}, nil
+}
+
+// chargeFee writes the fee of the payment as a transaction of its own, from the sender to the house account
+func (s *SQLDatabase) chargeFee(tx *sql.Tx, payment Transaction, paymentTxID string) error {
+	fee := Transaction{
+		RequestID:             uuid.NewV5(feeNamespace, payment.RequestID).String(),
+		SenderID:              payment.SenderID,
+		RecipientID:           s.fees.HouseAccount,
+		Message:               "fee",
+		Amount:                payment.Fee,
+		Currency:              payment.Currency,
+		Kind:                  KindFee,
+		Status:                StatusCompleted,
+		OriginalTransactionID: paymentTxID,
+	}
+
+	// without the house account the fee would be taken from the sender and paid to no one
+	if _, err := getBalance(tx, fee.RecipientID); err != nil {
+		return fmt.Errorf("house account %s: %s", fee.RecipientID, err)
+	}
+
+	txID := uuid.NewV4().String()
+
+	err := saveTransaction(tx, fee, txID)
+	if err != nil {
+		return err
+	}
+
+	err = updateBalance(tx, -fee.Amount, fee.SenderID, txID)
+	if err != nil {
+		return err
+	}
+
+	return updateBalance(tx, fee.Amount, fee.RecipientID, txID)
+}
@@ -0,0 +1,140 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestFeeSchedule_Fee(t *testing.T) {
+	tiered := FeeSchedule{
+		Type: FeeTiered,
+		Tiers: []FeeTier{
+			{UpTo: 100, Flat: 0.5},
+			{UpTo: 1000, Percentage: 1},
+			{Flat: 1, Percentage: 0.5},
+		},
+		Max: 20,
+	}
+
+	tests := []struct {
+		name     string
+		schedule FeeSchedule
+		amount   float64
+		expected float64
+	}{
+		{name: "flat", schedule: FeeSchedule{Type: FeeFlat, Flat: 0.3}, amount: 50, expected: 0.3},
+		{name: "percentage rounded to the cent", schedule: FeeSchedule{Type: FeePercentage, Percentage: 1.5}, amount: 33.33, expected: 0.5},
+		{name: "percentage under min", schedule: FeeSchedule{Type: FeePercentage, Percentage: 1, Min: 0.2}, amount: 10, expected: 0.2},
+		{name: "percentage over max", schedule: FeeSchedule{Type: FeePercentage, Percentage: 1, Max: 5}, amount: 1000, expected: 5},
+		{name: "first tier", schedule: tiered, amount: 100, expected: 0.5},
+		{name: "second tier", schedule: tiered, amount: 100.01, expected: 1},
+		{name: "last tier", schedule: tiered, amount: 2000, expected: 11},
+		{name: "last tier over max", schedule: tiered, amount: 10000, expected: 20},
+		{name: "no fee on nothing", schedule: FeeSchedule{Type: FeeFlat, Flat: 0.3}, amount: 0, expected: 0},
+		{name: "no schedule", amount: 50, expected: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if fee := test.schedule.Fee(test.amount); fee != test.expected {
+				t.Errorf("expected a fee of %v, got %v", test.expected, fee)
+			}
+		})
+	}
+}
+
+func TestSQLDatabase_SetFees(t *testing.T) {
+	pay := NewSQLDatabase(nil)
+
+	for name, schedule := range map[string]FeeSchedule{
+		"unknown type":       {Type: "other"},
+		"no tiers":           {Type: FeeTiered},
+		"unbounded tier":     {Type: FeeTiered, Tiers: []FeeTier{{Flat: 1}, {UpTo: 100, Flat: 2}}},
+		"decreasing tiers":   {Type: FeeTiered, Tiers: []FeeTier{{UpTo: 100}, {UpTo: 50}, {}}},
+		"max lower than min": {Type: FeeFlat, Min: 2, Max: 1},
+		"bounded last tier":  {Type: FeeTiered, Tiers: []FeeTier{{UpTo: 100}}},
+	} {
+		err := pay.SetFees(FeesConfig{HouseAccount: "house", Currencies: map[string]map[string]FeeSchedule{"SGD": {DefaultTier: schedule}}})
+		if err == nil {
+			t.Errorf("expected %s to be refused", name)
+		}
+	}
+
+	err := pay.SetFees(FeesConfig{Currencies: map[string]map[string]FeeSchedule{"SGD": {DefaultTier: {Type: FeeFlat}}}})
+	if err == nil {
+		t.Error("expected fees without a house account to be refused")
+	}
+}
+
+func TestSQLDatabase_Fees(t *testing.T) {
+	cleanDB(db)
+	pay := NewSQLDatabase(db)
+
+	err := pay.SetFees(FeesConfig{
+		HouseAccount: "house",
+		Currencies: map[string]map[string]FeeSchedule{
+			"SGD": {DefaultTier: {Type: FeeFlat, Flat: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for userID, amount := range map[string]float64{"1": 100, "2": 0, "house": 0} {
+		if err := initBalance(userID, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quote, err := pay.Quote("1", 50, "SGD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if quote.Fee != 1 || quote.Total != 51 {
+		t.Errorf("expected a fee of 1 and a total of 51, got %+v", quote)
+	}
+
+	txID, err := pay.SaveTransaction(Transaction{RequestID: "fee", SenderID: "1", RecipientID: "2", Amount: 50, Currency: "SGD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBalances(t, pay, 49, 50)
+
+	house, err := pay.GetBalance("house")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if house.Amount != 1 {
+		t.Errorf("expected the house account to get 1, got %v", house.Amount)
+	}
+
+	// the fee is on top of the amount, so 49 cannot be sent
+	_, err = pay.SaveTransaction(Transaction{RequestID: "too much", SenderID: "1", RecipientID: "2", Amount: 49, Currency: "SGD"})
+	if err != ErrInsufficientBalance {
+		t.Errorf("expected %v, got %v", ErrInsufficientBalance, err)
+	}
+
+	// currencies without a schedule are free
+	_, err = pay.SaveTransaction(Transaction{RequestID: "free", SenderID: "1", RecipientID: "2", Amount: 9, Currency: "EUR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectBalances(t, pay, 40, 59)
+
+	txs, err := pay.GetAllTransactions(GetTransactions{UserID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fees []Transaction
+	for _, tx := range txs {
+		if tx.Kind == KindFee {
+			fees = append(fees, tx)
+		}
+	}
+
+	if len(fees) != 1 || fees[0].Amount != 1 || fees[0].OriginalTransactionID != *txID || fees[0].RecipientID != "house" {
+		t.Errorf("expected one fee of 1 to the house account for %s, got %+v", *txID, fees)
+	}
+}
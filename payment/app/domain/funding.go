@@ -0,0 +1,438 @@
+package domain
+
+import (
+	"crypto/hmac"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	KindDeposit    = "deposit"
+	KindWithdrawal = "withdrawal"
+	// KindReversal undoes a deposit or withdrawal the provider reversed after it completed
+	KindReversal = "reversal"
+
+	MethodCard         = "card"
+	MethodBankTransfer = "bank_transfer"
+
+	FundingSucceeded = "succeeded"
+	FundingFailed    = "failed"
+	FundingReversed  = "reversed"
+
+	// ExternalAccount is the other side of the money entering and leaving the system, it has no balance
+	ExternalAccount = "external"
+
+	FundingSignatureHeader = "X-Funding-Signature"
+	FundingTimestampHeader = "X-Funding-Timestamp"
+)
+
+var (
+	ErrFundingNotFound      = errors.New("funding not found")
+	ErrInvalidFunding       = errors.New("direction must be deposit or withdrawal and method card or bank_transfer")
+	ErrFundingEventInvalid  = errors.New("event does not apply to the funding in its current status")
+	ErrNoFundingProvider    = errors.New("no funding provider")
+	ErrFundingEventUnsigned = errors.New("funding event signature is missing, invalid or stale")
+
+	fundingNamespace = uuid.NewV5(uuid.NamespaceURL, "payment/fundings")
+)
+
+// FundingEventsConfig authenticates the events the funding provider sends to /funding/events. They are signed as
+// webhook deliveries are, with the secret shared with the provider, and all refused while it is not set.
+type FundingEventsConfig struct {
+	Secret  string        `json:"secret"`
+	MaxSkew time.Duration `json:"max_skew" yaml:"max_skew"`
+}
+
+// VerifyFundingEvent checks that the event was signed with the shared secret at a timestamp close to now. An event
+// replayed within MaxSkew is not refused, events are idempotent.
+func VerifyFundingEvent(c FundingEventsConfig, timestamp, signature string, body []byte, now time.Time) error {
+	if c.Secret == "" || signature == "" {
+		return ErrFundingEventUnsigned
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrFundingEventUnsigned
+	}
+
+	maxSkew := c.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = 5 * time.Minute
+	}
+
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return ErrFundingEventUnsigned
+	}
+
+	if !hmac.Equal([]byte(SignWebhook(c.Secret, timestamp, body)), []byte(signature)) {
+		return ErrFundingEventUnsigned
+	}
+
+	return nil
+}
+
+// Funding is a deposit to, or a withdrawal from, the balance of a user through a funding provider.
+// It stays pending until the provider tells its outcome, the amount of a pending withdrawal is held.
+type Funding struct {
+	FundingID     string    `json:"funding_id"`
+	RequestID     string    `json:"request_id"`
+	UserID        string    `json:"user_id"`
+	Direction     string    `json:"direction"`
+	Method        string    `json:"method"`
+	Source        string    `json:"source"`
+	Amount        float64   `json:"amount"`
+	Currency      string    `json:"currency"`
+	Status        string    `json:"status"`
+	ProviderRef   string    `json:"provider_ref,omitempty"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	TransactionID string    `json:"transaction_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type CreateFunding struct {
+	RequestID string `json:"request_id"`
+	UserID    string `json:"user_id"`
+	Direction string `json:"-"`
+	Method    string `json:"method"`
+	// Source is the card or bank account the provider takes the money from or sends it to
+	Source   string  `json:"source"`
+	Amount   float64 `json:"amount"`
+	Currency string  `json:"currency"`
+}
+
+// FundingEvent is the outcome of a funding, sent by its provider
+type FundingEvent struct {
+	FundingID   string `json:"funding_id"`
+	ProviderRef string `json:"provider_ref"`
+	Type        string `json:"type"`
+	Reason      string `json:"reason"`
+}
+
+// FundingProvider moves money between the system and cards or bank accounts.
+// Start only submits the funding, the provider sends its outcome later to HandleFundingEvent.
+type FundingProvider interface {
+	Start(f Funding) (providerRef string, err error)
+}
+
+// FundingProviderSimulator settles fundings in process, for development only as anyone can deposit money with it
+const FundingProviderSimulator = "simulator"
+
+// FundingConfig selects the provider deposits and withdrawals go through, they are refused while none is selected
+type FundingConfig struct {
+	Provider string `json:"provider"`
+	// SimulatorDelay is how long the funding simulator takes to settle a funding
+	SimulatorDelay time.Duration `json:"simulator_delay" yaml:"simulator_delay"`
+}
+
+// SetFundingProvider sets the provider deposits and withdrawals go through
+func (s *SQLDatabase) SetFundingProvider(provider FundingProvider) {
+	s.funding = provider
+}
+
+const fundingColumns = `fundingid, requestid, userid, direction, method, COALESCE(source, ''), amount, currency, status,
+	COALESCE(providerref, ''), COALESCE(failurereason, ''), COALESCE(transactionid, ''), createdat, updatedat`
+
+func scanFunding(row scanner) (Funding, error) {
+	f := Funding{}
+	err := row.Scan(&f.FundingID, &f.RequestID, &f.UserID, &f.Direction, &f.Method, &f.Source, &f.Amount, &f.Currency,
+		&f.Status, &f.ProviderRef, &f.FailureReason, &f.TransactionID, &f.CreatedAt, &f.UpdatedAt)
+	return f, err
+}
+
+func (s *SQLDatabase) GetFunding(fundingID string) (*Funding, error) {
+	return getFunding(s.db, fundingID)
+}
+
+func getFunding(q querier, fundingID string) (*Funding, error) {
+	f, err := scanFunding(q.QueryRow("SELECT "+fundingColumns+" FROM fundings WHERE fundingid = $1", fundingID))
+	if err == sql.ErrNoRows {
+		return nil, ErrFundingNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// CreateFunding records the funding as pending and submits it to the provider, it is idempotent on the request_id.
+// A funding the provider refuses straight away is returned as failed.
+func (s *SQLDatabase) CreateFunding(c CreateFunding) (*Funding, error) {
+	if c.Amount <= 0 {
+		return nil, ErrNegativeAmount
+	}
+
+	if (c.Direction != KindDeposit && c.Direction != KindWithdrawal) || (c.Method != MethodCard && c.Method != MethodBankTransfer) {
+		return nil, ErrInvalidFunding
+	}
+
+	if s.funding == nil {
+		return nil, ErrNoFundingProvider
+	}
+
+	fundingID := uuid.NewV4().String()
+	created := false
+
+	// withdrawals run under the lock of the user so that what they hold cannot be spent meanwhile
+	err := s.lockedTx(fundingLock(c.UserID), func(tx *sql.Tx) error {
+		created = false
+
+		existing, err := scanFunding(tx.QueryRow("SELECT "+fundingColumns+" FROM fundings WHERE requestid = $1", c.RequestID))
+		if err == nil {
+			if existing.UserID != c.UserID || existing.Direction != c.Direction {
+				return ErrDuplicateRequest
+			}
+
+			fundingID = existing.FundingID
+			return nil
+		}
+
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		sender, recipient := ExternalAccount, c.UserID
+		if c.Direction == KindWithdrawal {
+			sender, recipient = c.UserID, ExternalAccount
+		}
+
+		err = checkAccounts(tx, sender, recipient)
+		if err != nil {
+			return err
+		}
+
+		balance, err := getBalance(tx, c.UserID)
+		if err != nil {
+			return err
+		}
+
+		if c.Direction == KindWithdrawal {
+			held, err := s.heldAmount(tx, c.UserID, "")
+			if err != nil {
+				return err
+			}
+
+			err = checkTransaction(balance.Amount-held, c.Amount)
+			if err != nil {
+				return err
+			}
+		}
+
+		query := `INSERT into fundings (fundingid, requestid, userid, direction, method, source, amount, currency, status)
+				  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+		_, err = tx.Exec(query, fundingID, c.RequestID, c.UserID, c.Direction, c.Method, c.Source, c.Amount, c.Currency,
+			StatusPending)
+		created = err == nil
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := s.GetFunding(fundingID)
+	if err != nil || !created {
+		return f, err
+	}
+
+	ref, err := s.funding.Start(*f)
+	if err != nil {
+		log.Error().Err(err).Str("fundingid", fundingID).Msg("funding provider refused the funding")
+		err = setFundingStatus(s.db, fundingID, StatusPending, StatusFailed, err.Error())
+		if err != nil {
+			return nil, err
+		}
+		return s.GetFunding(fundingID)
+	}
+
+	_, err = s.db.Exec("UPDATE fundings SET providerref = $1, updatedat = NOW() WHERE fundingid = $2", ref, fundingID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetFunding(fundingID)
+}
+
+// HandleFundingEvent applies the outcome sent by the provider. Providers may send an event more than once,
+// an event that was already applied changes nothing.
+func (s *SQLDatabase) HandleFundingEvent(e FundingEvent) (*Funding, error) {
+	f, err := s.GetFunding(e.FundingID)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.ProviderRef != "" && e.ProviderRef != f.ProviderRef {
+		return nil, ErrFundingNotFound
+	}
+
+	err = s.lockedTx(fundingLock(f.UserID), func(tx *sql.Tx) error {
+		// the funding may have changed while we were waiting for the lock
+		f, err := getFunding(tx, e.FundingID)
+		if err != nil {
+			return err
+		}
+
+		switch e.Type {
+		case FundingSucceeded:
+			return s.completeFunding(tx, *f)
+		case FundingFailed:
+			reason := e.Reason
+			if reason == "" {
+				reason = "refused by the provider"
+			}
+			return setFundingStatus(tx, f.FundingID, StatusPending, StatusFailed, reason)
+		case FundingReversed:
+			reason := e.Reason
+			if reason == "" {
+				reason = "reversed by the provider"
+			}
+			return s.reverseFunding(tx, *f, reason)
+		}
+
+		return ErrFundingEventInvalid
+	})
+
+	// redelivered events find the funding already in the status they lead to
+	if err == ErrFundingEventInvalid {
+		current, getErr := s.GetFunding(f.FundingID)
+		if getErr == nil && current.Status == eventStatus(e.Type) {
+			return current, nil
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetFunding(f.FundingID)
+}
+
+// completeFunding writes the deposit or withdrawal to the ledger
+func (s *SQLDatabase) completeFunding(tx *sql.Tx, f Funding) error {
+	t := Transaction{
+		RequestID:   uuid.NewV5(fundingNamespace, f.FundingID).String(),
+		SenderID:    ExternalAccount,
+		RecipientID: f.UserID,
+		Message:     f.Method,
+		Amount:      f.Amount,
+		Currency:    f.Currency,
+		Kind:        f.Direction,
+		Status:      StatusCompleted,
+	}
+
+	if f.Direction == KindWithdrawal {
+		t.SenderID, t.RecipientID = f.UserID, ExternalAccount
+	}
+
+	return s.writeFundingTx(tx, f, t, uuid.NewV4().String(), StatusPending, StatusCompleted)
+}
+
+// reverseFunding undoes a completed funding, a reversed deposit is taken back even if the balance does not cover it
+func (s *SQLDatabase) reverseFunding(tx *sql.Tx, f Funding, reason string) error {
+	if f.Status != StatusCompleted {
+		return ErrFundingEventInvalid
+	}
+
+	original, err := s.GetTransaction(f.TransactionID)
+	if err != nil {
+		return err
+	}
+
+	t := Transaction{
+		RequestID:             uuid.NewV5(fundingNamespace, f.FundingID+"/"+FundingReversed).String(),
+		SenderID:              original.RecipientID,
+		RecipientID:           original.SenderID,
+		Message:               reason,
+		Amount:                f.Amount,
+		Currency:              f.Currency,
+		Kind:                  KindReversal,
+		Status:                StatusCompleted,
+		OriginalTransactionID: original.TransactionID,
+	}
+
+	return s.writeFundingTx(tx, f, t, uuid.NewV4().String(), StatusCompleted, StatusReversed)
+}
+
+// writeFundingTx writes the ledger transaction of the funding and moves it from one status to the other
+func (s *SQLDatabase) writeFundingTx(tx *sql.Tx, f Funding, t Transaction, txID, from, to string) error {
+	query := `UPDATE fundings SET status = $1, transactionid = COALESCE(transactionid, $2), updatedat = NOW()
+			  WHERE fundingid = $3 AND status = $4`
+
+	res, err := tx.Exec(query, to, txID, f.FundingID, from)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrFundingEventInvalid
+		}
+		return err
+	}
+
+	err = saveTransaction(tx, t, txID)
+	if err != nil {
+		return err
+	}
+
+	if t.Kind == KindReversal {
+		_, err = tx.Exec("UPDATE transactions SET status = $1 WHERE transactionid = $2", StatusReversed, t.OriginalTransactionID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// only the user has a balance, the external account stands for the world outside
+	if t.SenderID == f.UserID {
+		return updateBalance(tx, -t.Amount, f.UserID, txID)
+	}
+
+	return updateBalance(tx, t.Amount, f.UserID, txID)
+}
+
+func setFundingStatus(ex execer, fundingID, from, to, reason string) error {
+	query := `UPDATE fundings SET status = $1, failurereason = NULLIF($2, ''), updatedat = NOW()
+			  WHERE fundingid = $3 AND status = $4`
+
+	res, err := ex.Exec(query, to, reason, fundingID, from)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrFundingEventInvalid
+	}
+
+	return nil
+}
+
+// fundingLock is the lock of the fundings of the user
+func fundingLock(userID string) Transaction {
+	return Transaction{SenderID: userID, RecipientID: ExternalAccount}
+}
+
+func eventStatus(eventType string) string {
+	switch eventType {
+	case FundingSucceeded:
+		return StatusCompleted
+	case FundingFailed:
+		return StatusFailed
+	case FundingReversed:
+		return StatusReversed
+	}
+	return ""
+}
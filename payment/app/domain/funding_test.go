@@ -0,0 +1,150 @@
+package domain
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeProvider accepts fundings unless err is set, their outcome is sent by the test
+type fakeProvider struct {
+	err error
+}
+
+func (p *fakeProvider) Start(f Funding) (string, error) {
+	return "ref-" + f.RequestID, p.err
+}
+
+func TestSQLDatabase_Funding(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	provider := &fakeProvider{}
+	pay.SetFundingProvider(provider)
+
+	tests := []struct {
+		name      string
+		direction string
+		events    []string
+		expected  string
+		balance   float64
+	}{
+		{name: "deposit", direction: KindDeposit, events: []string{FundingSucceeded}, expected: StatusCompleted, balance: 130},
+		{name: "redelivered deposit", direction: KindDeposit, events: []string{FundingSucceeded, FundingSucceeded}, expected: StatusCompleted, balance: 130},
+		{name: "failed deposit", direction: KindDeposit, events: []string{FundingFailed}, expected: StatusFailed, balance: 100},
+		{name: "reversed deposit", direction: KindDeposit, events: []string{FundingSucceeded, FundingReversed}, expected: StatusReversed, balance: 100},
+		{name: "withdrawal", direction: KindWithdrawal, events: []string{FundingSucceeded}, expected: StatusCompleted, balance: 70},
+		{name: "failed withdrawal", direction: KindWithdrawal, events: []string{FundingFailed}, expected: StatusFailed, balance: 100},
+		{name: "reversed withdrawal", direction: KindWithdrawal, events: []string{FundingSucceeded, FundingReversed}, expected: StatusReversed, balance: 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cleanDB(db)
+			if err := initBalance("1", 100); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := pay.CreateFunding(CreateFunding{RequestID: "funding", UserID: "1", Direction: test.direction,
+				Method: MethodCard, Source: "4242", Amount: 30, Currency: "SGD"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if f.Status != StatusPending || f.ProviderRef != "ref-funding" {
+				t.Fatalf("expected a pending funding submitted to the provider, got %+v", f)
+			}
+
+			// the amount of a pending withdrawal cannot be spent
+			if test.direction == KindWithdrawal {
+				_, err := pay.CreateFunding(CreateFunding{RequestID: "other", UserID: "1", Direction: test.direction,
+					Method: MethodCard, Source: "4242", Amount: 71, Currency: "SGD"})
+				if err != ErrInsufficientBalance {
+					t.Errorf("expected %v, got %v", ErrInsufficientBalance, err)
+				}
+			}
+
+			for _, e := range test.events {
+				f, err = pay.HandleFundingEvent(FundingEvent{FundingID: f.FundingID, ProviderRef: f.ProviderRef, Type: e})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if f.Status != test.expected {
+				t.Errorf("expected status %s, got %s", test.expected, f.Status)
+			}
+
+			b, err := pay.GetBalance("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if b.Amount != test.balance {
+				t.Errorf("expected balance %v, got %v", test.balance, b.Amount)
+			}
+		})
+	}
+
+	t.Run("refused by the provider", func(t *testing.T) {
+		cleanDB(db)
+		if err := initBalance("1", 100); err != nil {
+			t.Fatal(err)
+		}
+
+		provider.err = errors.New("card declined")
+		defer func() { provider.err = nil }()
+
+		f, err := pay.CreateFunding(CreateFunding{RequestID: "funding", UserID: "1", Direction: KindDeposit,
+			Method: MethodCard, Source: "4242", Amount: 30, Currency: "SGD"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.Status != StatusFailed || f.FailureReason != "card declined" {
+			t.Errorf("expected the funding to fail with the provider error, got %+v", f)
+		}
+
+		_, err = pay.HandleFundingEvent(FundingEvent{FundingID: f.FundingID, Type: FundingSucceeded})
+		if err != ErrFundingEventInvalid {
+			t.Errorf("expected %v, got %v", ErrFundingEventInvalid, err)
+		}
+	})
+}
+
+func TestVerifyFundingEvent(t *testing.T) {
+	now := time.Date(2020, 9, 20, 12, 0, 0, 0, time.UTC)
+	config := FundingEventsConfig{Secret: "secret", MaxSkew: time.Minute}
+	body := []byte(`{"funding_id": "1", "type": "succeeded"}`)
+
+	ts := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-2*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		config    FundingEventsConfig
+		timestamp string
+		signature string
+		body      []byte
+		wantErr   error
+	}{
+		{name: "signed", config: config, timestamp: ts, signature: SignWebhook("secret", ts, body), body: body},
+		{name: "unsigned", config: config, timestamp: ts, body: body, wantErr: ErrFundingEventUnsigned},
+		{name: "wrong secret", config: config, timestamp: ts, signature: SignWebhook("other", ts, body), body: body,
+			wantErr: ErrFundingEventUnsigned},
+		{name: "tampered body", config: config, timestamp: ts, signature: SignWebhook("secret", ts, body),
+			body: []byte(`{"funding_id": "2", "type": "succeeded"}`), wantErr: ErrFundingEventUnsigned},
+		{name: "stale timestamp", config: config, timestamp: stale, signature: SignWebhook("secret", stale, body), body: body,
+			wantErr: ErrFundingEventUnsigned},
+		{name: "no secret set", config: FundingEventsConfig{}, timestamp: ts, signature: SignWebhook("", ts, body), body: body,
+			wantErr: ErrFundingEventUnsigned},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := VerifyFundingEvent(test.config, test.timestamp, test.signature, test.body, now)
+			if err != test.wantErr {
+				t.Fatalf("expected error %v got %v", test.wantErr, err)
+			}
+		})
+	}
+}
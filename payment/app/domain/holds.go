@@ -0,0 +1,293 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldVoided   = "voided"
+	HoldExpired  = "expired"
+
+	DefaultHoldDuration = 7 * 24 * time.Hour
+)
+
+var (
+	ErrHoldNotFound      = errors.New("hold not found")
+	ErrHoldNotActive     = errors.New("hold is not active")
+	ErrCaptureExceedHold = errors.New("captured amount exceeds the hold")
+)
+
+// Hold reserves part of the sender balance for a payment whose final amount is not known yet.
+// Held funds are no longer available but stay in the ledger balance until the hold is captured.
+type Hold struct {
+	HoldID         string    `json:"hold_id"`
+	RequestID      string    `json:"request_id"`
+	SenderID       string    `json:"sender_id"`
+	RecipientID    string    `json:"recipient_id"`
+	Amount         float64   `json:"amount"`
+	CapturedAmount float64   `json:"captured_amount"`
+	Currency       string    `json:"currency"`
+	Message        string    `json:"message"`
+	Status         string    `json:"status"`
+	TransactionID  string    `json:"transaction_id,omitempty"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type CreateHold struct {
+	RequestID   string  `json:"request_id"`
+	SenderID    string  `json:"sender_id"`
+	RecipientID string  `json:"recipient_id"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+	Message     string  `json:"message"`
+	// ExpiresIn is the lifetime of the hold in seconds, DefaultHoldDuration when 0
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// CaptureHold turns a hold into a payment. When Amount is 0 the whole hold is captured,
+// any amount left over is released.
+type CaptureHold struct {
+	RequestID string  `json:"request_id"`
+	HoldID    string  `json:"-"`
+	Amount    float64 `json:"amount"`
+}
+
+const holdColumns = `holdid, requestid, senderid, receiverid, amount, capturedamount, currency, COALESCE(message, ''), status,
+	COALESCE(transactionid, ''), expiresat, createdat`
+
+func scanHold(row scanner) (Hold, error) {
+	h := Hold{}
+	err := row.Scan(&h.HoldID, &h.RequestID, &h.SenderID, &h.RecipientID, &h.Amount, &h.CapturedAmount, &h.Currency, &h.Message,
+		&h.Status, &h.TransactionID, &h.ExpiresAt, &h.CreatedAt)
+	return h, err
+}
+
+func (s *SQLDatabase) GetHold(holdID string) (*Hold, error) {
+	return getHold(s.db, holdID)
+}
+
+func getHold(q querier, holdID string) (*Hold, error) {
+	h, err := scanHold(q.QueryRow("SELECT "+holdColumns+" FROM holds WHERE holdid = $1", holdID))
+	if err == sql.ErrNoRows {
+		return nil, ErrHoldNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &h, nil
+}
+
+// CreateHold reserves the amount on the sender balance, it is idempotent on the request_id. A request_id sent again
+// for another hold is refused with ErrDuplicateRequest.
+func (s *SQLDatabase) CreateHold(c CreateHold) (*Hold, error) {
+	if c.Amount <= 0 {
+		return nil, ErrNegativeAmount
+	}
+
+	duration := DefaultHoldDuration
+	if c.ExpiresIn > 0 {
+		duration = time.Duration(c.ExpiresIn) * time.Second
+	}
+
+	holdID := uuid.NewV4().String()
+
+	err := s.lockedTx(Transaction{SenderID: c.SenderID, RecipientID: c.RecipientID}, func(tx *sql.Tx) error {
+		existing, err := scanHold(tx.QueryRow("SELECT "+holdColumns+" FROM holds WHERE requestid = $1", c.RequestID))
+		if err == nil {
+			if existing.SenderID != c.SenderID || existing.RecipientID != c.RecipientID || existing.Amount != c.Amount {
+				return ErrDuplicateRequest
+			}
+
+			holdID = existing.HoldID
+			return nil
+		}
+
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		err = checkAccounts(tx, c.SenderID, c.RecipientID)
+		if err != nil {
+			return err
+		}
+
+		balance, err := getBalance(tx, c.SenderID)
+		if err != nil {
+			return err
+		}
+
+		held, err := s.heldAmount(tx, c.SenderID, "")
+		if err != nil {
+			return err
+		}
+
+		err = checkTransaction(balance.Amount-held, c.Amount)
+		if err != nil {
+			return err
+		}
+
+		query := `INSERT into holds (holdid, requestid, senderid, receiverid, amount, currency, message, status, expiresat)
+				  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW() + $9 * INTERVAL '1 second')`
+
+		_, err = tx.Exec(query, holdID, c.RequestID, c.SenderID, c.RecipientID, c.Amount, c.Currency, c.Message,
+			HoldActive, duration.Seconds())
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetHold(holdID)
+}
+
+// Capture pays the recipient of the hold and releases what is left of it
+func (s *SQLDatabase) Capture(c CaptureHold) (*Transaction, error) {
+	h, err := s.GetHold(c.HoldID)
+	if err != nil {
+		return nil, err
+	}
+
+	t := Transaction{
+		RequestID:    c.RequestID,
+		SenderID:     h.SenderID,
+		RecipientID:  h.RecipientID,
+		Message:      h.Message,
+		Amount:       c.Amount,
+		Currency:     h.Currency,
+		Kind:         KindPayment,
+		capturedHold: h.HoldID,
+	}
+
+	var captured float64
+
+	txID, err := s.transfer(t, transferHooks{
+		check: func(q querier, t *Transaction) error {
+			h, err := getHold(q, c.HoldID)
+			if err != nil {
+				return err
+			}
+
+			active, err := holdActive(q, c.HoldID)
+			if err != nil {
+				return err
+			}
+
+			if !active {
+				return ErrHoldNotActive
+			}
+
+			if t.Amount == 0 {
+				t.Amount = h.Amount
+			}
+
+			if t.Amount < 0 {
+				return ErrNegativeAmount
+			}
+
+			if !lessOrEqual(t.Amount, h.Amount) {
+				return ErrCaptureExceedHold
+			}
+
+			captured = t.Amount
+			return nil
+		},
+		write: func(tx *sql.Tx, txID string) error {
+			query := `UPDATE holds SET status = $1, capturedamount = $2, transactionid = $3, updatedat = NOW()
+					  WHERE holdid = $4 AND status = $5`
+
+			_, err := tx.Exec(query, HoldCaptured, captured, txID, c.HoldID, HoldActive)
+			return err
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetTransaction(*txID)
+}
+
+// Void releases the whole hold without paying the recipient
+func (s *SQLDatabase) Void(holdID string) (*Hold, error) {
+	h, err := s.GetHold(holdID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.lockedTx(Transaction{SenderID: h.SenderID, RecipientID: h.RecipientID}, func(tx *sql.Tx) error {
+		query := `UPDATE holds SET status = $1, updatedat = NOW() WHERE holdid = $2 AND status = $3 AND expiresat > NOW()`
+
+		res, err := tx.Exec(query, HoldVoided, holdID, HoldActive)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return ErrHoldNotActive
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetHold(holdID)
+}
+
+// ExpireHolds marks the holds past their expiry as expired. Expired holds are already ignored
+// when computing available balances, this keeps their status accurate.
+func (s *SQLDatabase) ExpireHolds() (int64, error) {
+	res, err := s.db.Exec(`UPDATE holds SET status = $1, updatedat = NOW() WHERE status = $2 AND expiresat <= NOW()`,
+		HoldExpired, HoldActive)
+	if err != nil {
+		log.Error().Err(err)
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// holdActive checks the expiry against the database clock, as heldAmount does
+func holdActive(q querier, holdID string) (bool, error) {
+	var active bool
+
+	query := `SELECT status = $1 AND expiresat > NOW() FROM holds WHERE holdid = $2`
+
+	err := q.QueryRow(query, HoldActive, holdID).Scan(&active)
+	return active, err
+}
+
+// heldAmount sums the active holds of the user, except the one given, their payments pending a review
+// and their pending withdrawals
+func (s *SQLDatabase) heldAmount(q querier, userID, exceptHoldID string) (float64, error) {
+	var held float64
+
+	query := `SELECT
+			  (SELECT COALESCE(SUM(amount), 0) FROM holds
+			   WHERE senderid = $1 AND status = $2 AND expiresat > NOW() AND holdid <> $3) +
+			  (SELECT COALESCE(SUM(amount + fee), 0) FROM transactions
+			   WHERE senderid = $1 AND status = $4 AND kind = $5) +
+			  (SELECT COALESCE(SUM(amount), 0) FROM fundings
+			   WHERE userid = $1 AND status = $4 AND direction = $6)`
+
+	err := q.QueryRow(query, userID, HoldActive, exceptHoldID, StatusPending, KindPayment, KindWithdrawal).Scan(&held)
+	return held, err
+}
@@ -0,0 +1,126 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestSQLDatabase_Holds(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	cleanDB(db)
+
+	if err := initBalance("1", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	hold, err := pay.CreateHold(CreateHold{RequestID: "hold-1", SenderID: "1", RecipientID: "2", Amount: 70, Currency: "SGD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := pay.CreateHold(CreateHold{RequestID: "hold-1", SenderID: "1", RecipientID: "2", Amount: 70, Currency: "SGD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replayed.HoldID != hold.HoldID {
+		t.Fatalf("expected the same hold to be returned for the same request_id")
+	}
+
+	_, err = pay.CreateHold(CreateHold{RequestID: "hold-1", SenderID: "1", RecipientID: "2", Amount: 10, Currency: "SGD"})
+	if err != ErrDuplicateRequest {
+		t.Fatalf("expected error %v got %v", ErrDuplicateRequest, err)
+	}
+
+	// only 30 are available, the ledger balance is untouched
+	_, err = pay.SaveTransaction(Transaction{RequestID: "pay-1", SenderID: "1", RecipientID: "2", Amount: 31, Currency: "SGD"})
+	if err != ErrInsufficientBalance {
+		t.Fatalf("expected %v got %v", ErrInsufficientBalance, err)
+	}
+
+	_, err = pay.CreateHold(CreateHold{RequestID: "hold-2", SenderID: "1", RecipientID: "2", Amount: 31, Currency: "SGD"})
+	if err != ErrInsufficientBalance {
+		t.Fatalf("expected %v got %v", ErrInsufficientBalance, err)
+	}
+
+	balance, err := pay.GetBalance("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if balance.Amount != 100 {
+		t.Fatalf("expected ledger balance to be %f got %f", 100.0, balance.Amount)
+	}
+
+	_, err = pay.Capture(CaptureHold{RequestID: "capture-1", HoldID: hold.HoldID, Amount: 71})
+	if err != ErrCaptureExceedHold {
+		t.Fatalf("expected %v got %v", ErrCaptureExceedHold, err)
+	}
+
+	tx, err := pay.Capture(CaptureHold{RequestID: "capture-1", HoldID: hold.HoldID, Amount: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tx.Amount != 50 {
+		t.Fatalf("expected captured transaction amount to be %f got %f", 50.0, tx.Amount)
+	}
+
+	if _, err = pay.Capture(CaptureHold{RequestID: "capture-2", HoldID: hold.HoldID}); err != ErrHoldNotActive {
+		t.Fatalf("expected %v got %v", ErrHoldNotActive, err)
+	}
+
+	if _, err = pay.Void(hold.HoldID); err != ErrHoldNotActive {
+		t.Fatalf("expected %v got %v", ErrHoldNotActive, err)
+	}
+
+	// the 20 left over from the capture are released
+	_, err = pay.SaveTransaction(Transaction{RequestID: "pay-2", SenderID: "1", RecipientID: "2", Amount: 50, Currency: "SGD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	captured, err := pay.GetHold(hold.HoldID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if captured.Status != HoldCaptured || captured.CapturedAmount != 50 || captured.TransactionID != tx.TransactionID {
+		t.Fatalf("unexpected captured hold %+v", captured)
+	}
+}
+
+func TestSQLDatabase_VoidHold(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	cleanDB(db)
+
+	if err := initBalance("1", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	hold, err := pay.CreateHold(CreateHold{RequestID: "hold-1", SenderID: "1", RecipientID: "2", Amount: 100, Currency: "SGD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	voided, err := pay.Void(hold.HoldID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if voided.Status != HoldVoided {
+		t.Fatalf("expected hold to be %s got %s", HoldVoided, voided.Status)
+	}
+
+	_, err = pay.SaveTransaction(Transaction{RequestID: "pay-1", SenderID: "1", RecipientID: "2", Amount: 100, Currency: "SGD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,183 @@
+package domain
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultTier = "standard"
+
+	LimitPerTransfer = "per_transfer"
+	LimitDaily       = "daily"
+	LimitMonthly     = "monthly"
+	LimitHourlyCount = "hourly_count"
+)
+
+// Limits caps the payments a user sends, a limit of 0 is no limit.
+// Daily and hourly limits are over a rolling window, monthly limits over the calendar month in UTC.
+type Limits struct {
+	PerTransfer float64 `json:"per_transfer" yaml:"per_transfer"`
+	Daily       float64 `json:"daily"`
+	Monthly     float64 `json:"monthly"`
+	HourlyCount int     `json:"hourly_count" yaml:"hourly_count"`
+}
+
+// LimitsConfig sets limits per user tier, and per user for the limits that differ from their tier
+type LimitsConfig struct {
+	Tiers map[string]Limits `json:"tiers"`
+	Users map[string]Limits `json:"users"`
+}
+
+// LimitError tells which limit a payment exceeds and when it can be sent again, ResetsAt is nil when it never can
+type LimitError struct {
+	Limit    string
+	Max      float64
+	ResetsAt *time.Time
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s limit of %v exceeded", e.Limit, e.Max)
+}
+
+// For returns the limits of the user, those of their tier overridden by theirs
+func (c LimitsConfig) For(userID, tier string) Limits {
+	l := c.Tiers[tier]
+
+	u, ok := c.Users[userID]
+	if !ok {
+		return l
+	}
+
+	if u.PerTransfer > 0 {
+		l.PerTransfer = u.PerTransfer
+	}
+	if u.Daily > 0 {
+		l.Daily = u.Daily
+	}
+	if u.Monthly > 0 {
+		l.Monthly = u.Monthly
+	}
+	if u.HourlyCount > 0 {
+		l.HourlyCount = u.HourlyCount
+	}
+
+	return l
+}
+
+// SetLimits makes payments check the limits of their sender
+func (s *SQLDatabase) SetLimits(limits LimitsConfig) {
+	s.limits = limits
+}
+
+// usage is a payment counting towards a rolling limit until it expires
+type usage struct {
+	amount    float64
+	expiresAt time.Time
+}
+
+// checkLimits runs in the SQL transaction of the payment, so that the payments already written in it count
+func (s *SQLDatabase) checkLimits(tx *sql.Tx, t Transaction) error {
+	if len(s.limits.Tiers) == 0 && len(s.limits.Users) == 0 {
+		return nil
+	}
+
+	var tier string
+	err := tx.QueryRow("SELECT tier FROM balance WHERE userid = $1", t.SenderID).Scan(&tier)
+	if err != nil {
+		return err
+	}
+
+	l := s.limits.For(t.SenderID, tier)
+
+	if l.PerTransfer > 0 && !lessOrEqual(t.Amount, l.PerTransfer) {
+		return &LimitError{Limit: LimitPerTransfer, Max: l.PerTransfer}
+	}
+
+	if l.Daily > 0 {
+		payments, err := recentPayments(tx, t.SenderID, "1 day")
+		if err != nil {
+			return err
+		}
+
+		var used float64
+		for _, p := range payments {
+			used += p.amount
+		}
+
+		if !lessOrEqual(used+t.Amount, l.Daily) {
+			// the limit resets once enough of the payments have left the window
+			e := &LimitError{Limit: LimitDaily, Max: l.Daily}
+			for _, p := range payments {
+				used -= p.amount
+				if lessOrEqual(used+t.Amount, l.Daily) {
+					e.ResetsAt = &p.expiresAt
+					break
+				}
+			}
+			return e
+		}
+	}
+
+	if l.Monthly > 0 {
+		var used float64
+		var resetsAt time.Time
+
+		query := `SELECT COALESCE(SUM(amount), 0), date_trunc('month', NOW() AT TIME ZONE 'UTC') + INTERVAL '1 month'
+				  FROM transactions WHERE senderid = $1 AND kind = $2 AND status <> $3
+				  AND createdat >= date_trunc('month', NOW() AT TIME ZONE 'UTC')`
+
+		err := tx.QueryRow(query, t.SenderID, KindPayment, StatusFailed).Scan(&used, &resetsAt)
+		if err != nil {
+			return err
+		}
+
+		if !lessOrEqual(used+t.Amount, l.Monthly) {
+			e := &LimitError{Limit: LimitMonthly, Max: l.Monthly}
+			if lessOrEqual(t.Amount, l.Monthly) {
+				e.ResetsAt = &resetsAt
+			}
+			return e
+		}
+	}
+
+	if l.HourlyCount > 0 {
+		payments, err := recentPayments(tx, t.SenderID, "1 hour")
+		if err != nil {
+			return err
+		}
+
+		if len(payments) >= l.HourlyCount {
+			// one more payment can be sent once the oldest ones over the limit have left the window
+			resetsAt := payments[len(payments)-l.HourlyCount].expiresAt
+			return &LimitError{Limit: LimitHourlyCount, Max: float64(l.HourlyCount), ResetsAt: &resetsAt}
+		}
+	}
+
+	return nil
+}
+
+// recentPayments returns the payments the user sent within the window, oldest first
+func recentPayments(tx *sql.Tx, userID, window string) ([]usage, error) {
+	query := `SELECT amount, createdat + $4::interval FROM transactions
+			  WHERE senderid = $1 AND kind = $2 AND status <> $3 AND createdat > NOW() - $4::interval
+			  ORDER BY createdat`
+
+	rows, err := tx.Query(query, userID, KindPayment, StatusFailed, window)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []usage
+	for rows.Next() {
+		p := usage{}
+		if err := rows.Scan(&p.amount, &p.expiresAt); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+
+	return payments, rows.Err()
+}
@@ -0,0 +1,145 @@
+package domain
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLimitsConfig_For(t *testing.T) {
+	c := LimitsConfig{
+		Tiers: map[string]Limits{
+			DefaultTier: {PerTransfer: 100, Daily: 200, Monthly: 1000, HourlyCount: 5},
+		},
+		Users: map[string]Limits{
+			"vip": {Daily: 500},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		userID   string
+		tier     string
+		expected Limits
+	}{
+		{name: "tier limits", userID: "1", tier: DefaultTier, expected: Limits{PerTransfer: 100, Daily: 200, Monthly: 1000, HourlyCount: 5}},
+		{name: "user override", userID: "vip", tier: DefaultTier, expected: Limits{PerTransfer: 100, Daily: 500, Monthly: 1000, HourlyCount: 5}},
+		{name: "unknown tier", userID: "1", tier: "other", expected: Limits{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if l := c.For(test.userID, test.tier); l != test.expected {
+				t.Errorf("expected %+v, got %+v", test.expected, l)
+			}
+		})
+	}
+}
+
+func TestSQLDatabase_Limits(t *testing.T) {
+	pay := NewSQLDatabase(db)
+
+	tests := []struct {
+		name          string
+		limits        Limits
+		amounts       []float64
+		expectedLimit string
+		expectReset   bool
+	}{
+		{
+			name:    "within limits",
+			limits:  Limits{PerTransfer: 50, Daily: 100, Monthly: 100, HourlyCount: 2},
+			amounts: []float64{50, 50},
+		},
+		{
+			name:          "per transfer",
+			limits:        Limits{PerTransfer: 50},
+			amounts:       []float64{50.01},
+			expectedLimit: LimitPerTransfer,
+		},
+		{
+			name:          "rolling day",
+			limits:        Limits{Daily: 100},
+			amounts:       []float64{50, 40, 20},
+			expectedLimit: LimitDaily,
+			expectReset:   true,
+		},
+		{
+			name:          "more than the daily limit at once never resets",
+			limits:        Limits{Daily: 100},
+			amounts:       []float64{101},
+			expectedLimit: LimitDaily,
+		},
+		{
+			name:          "month",
+			limits:        Limits{Monthly: 120},
+			amounts:       []float64{50, 50, 30},
+			expectedLimit: LimitMonthly,
+			expectReset:   true,
+		},
+		{
+			name:          "transfers per hour",
+			limits:        Limits{HourlyCount: 3},
+			amounts:       []float64{1, 1, 1, 1},
+			expectedLimit: LimitHourlyCount,
+			expectReset:   true,
+		},
+		{
+			name:    "refused payments do not count",
+			limits:  Limits{Daily: 100},
+			amounts: []float64{100.01, 100},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cleanDB(db)
+			pay.SetLimits(LimitsConfig{Tiers: map[string]Limits{DefaultTier: test.limits}})
+
+			if err := initBalance("1", 1000); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := initBalance("2", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			var requestID string
+			for i, amount := range test.amounts {
+				requestID = fmt.Sprintf("payment-%d", i)
+
+				_, err = pay.SaveTransaction(Transaction{RequestID: requestID, SenderID: "1", RecipientID: "2", Amount: amount,
+					Currency: "SGD"})
+				// only the last payment can be refused, or any payment over the daily limit on its own
+				if err != nil && i != len(test.amounts)-1 && amount <= test.limits.Daily {
+					t.Fatal(err)
+				}
+			}
+
+			if test.expectedLimit == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			le, ok := err.(*LimitError)
+			if !ok || le.Limit != test.expectedLimit {
+				t.Fatalf("expected the %s limit to be hit, got %v", test.expectedLimit, err)
+			}
+
+			if (le.ResetsAt != nil) != test.expectReset {
+				t.Errorf("expected a reset time: %v, got %v", test.expectReset, le.ResetsAt)
+			}
+
+			failed, err := pay.GetTransactionByRequestID(requestID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if failed.Status != StatusFailed || failed.FailureReason != le.Error() {
+				t.Errorf("expected the refused payment to be recorded as failed, got %+v", failed)
+			}
+		})
+	}
+}
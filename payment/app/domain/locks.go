@@ -0,0 +1,355 @@
+package domain
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrLockTimeout is returned when a lock was not free in time, the request can be retried
+var ErrLockTimeout = errors.New("timed out waiting for a lock, retry later")
+
+const (
+	// lockRetryBase and lockRetryMax bound the wait between two tries of a taken lock
+	lockRetryBase = 5 * time.Millisecond
+	lockRetryMax  = 200 * time.Millisecond
+)
+
+const (
+	// LockAdvisory takes a session advisory lock per account, keyed by the id of its balance
+	LockAdvisory = "advisory"
+	// LockForUpdate locks the rows of the accounts in the account_locks table with SELECT ... FOR UPDATE
+	LockForUpdate = "for_update"
+)
+
+// LocksConfig sets how the accounts of a payment are locked, and how long it waits for them before giving up
+// with ErrLockTimeout
+type LocksConfig struct {
+	Strategy string        `json:"strategy"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+// LockStats is exposed for monitoring
+type LockStats struct {
+	Acquired int64 `json:"acquired"`
+	// Contended counts the locks that were taken by someone else at the first try
+	Contended int64 `json:"contended"`
+	TimedOut  int64 `json:"timed_out"`
+	Cancelled int64 `json:"cancelled"`
+	// WaitMillis is the total time spent waiting for taken locks
+	WaitMillis int64 `json:"wait_millis"`
+	// Retried counts the transfers tried again as they failed to serialize
+	Retried int64 `json:"retried"`
+}
+
+// lockCounters are shared by the copies of a SQLDatabase made for each request
+type lockCounters struct {
+	acquired   int64
+	contended  int64
+	timedOut   int64
+	cancelled  int64
+	waitMillis int64
+	retried    int64
+}
+
+// LockStrategy serializes the changes to the same accounts. Locks are taken in a canonical order so that two
+// callers locking overlapping accounts cannot deadlock.
+type LockStrategy interface {
+	// WithLocks runs fn while holding the locks of the accounts, it gives up once the context is done
+	WithLocks(ctx context.Context, accounts []string, fn func() error) error
+	// WithLockedTx runs fn in a SQL transaction on the connection holding the locks of the accounts,
+	// and commits it when fn succeeds
+	WithLockedTx(ctx context.Context, accounts []string, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error
+}
+
+func (s *SQLDatabase) SetLocks(c LocksConfig) error {
+	if c.Strategy == "" {
+		c.Strategy = LockAdvisory
+	}
+
+	if c.Timeout <= 0 {
+		c.Timeout = 5 * time.Second
+	}
+
+	switch c.Strategy {
+	case LockAdvisory:
+		s.lockStrategy = &advisoryLocks{db: s.db, counters: s.lockCounters}
+	case LockForUpdate:
+		s.lockStrategy = &rowLocks{db: s.db, counters: s.lockCounters}
+	default:
+		return fmt.Errorf("unknown lock strategy %q", c.Strategy)
+	}
+
+	s.locks = c
+	return nil
+}
+
+// WithContext returns the database bound to the context of a request, waiting for locks stops once it is done
+func (s *SQLDatabase) WithContext(ctx context.Context) DB {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+func (s *SQLDatabase) requestContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// LockStats returns the lock counters, it can be published through expvar
+func (s *SQLDatabase) LockStats() interface{} {
+	return LockStats{
+		Acquired:   atomic.LoadInt64(&s.lockCounters.acquired),
+		Contended:  atomic.LoadInt64(&s.lockCounters.contended),
+		TimedOut:   atomic.LoadInt64(&s.lockCounters.timedOut),
+		Cancelled:  atomic.LoadInt64(&s.lockCounters.cancelled),
+		WaitMillis: atomic.LoadInt64(&s.lockCounters.waitMillis),
+		Retried:    atomic.LoadInt64(&s.lockCounters.retried),
+	}
+}
+
+// withLock runs fn while holding the locks of the sender and the recipient
+func (s *SQLDatabase) withLock(t Transaction, fn func() error) error {
+	return s.withLocks([]Transaction{t}, fn)
+}
+
+// withLocks runs fn while holding the locks of the accounts of all the transactions. The external and adjustments
+// accounts have no balance to protect and are not locked, so that deposits and adjustments do not wait for each
+// other. All the locks must be taken within the lock timeout.
+func (s *SQLDatabase) withLocks(ts []Transaction, fn func() error) error {
+	ctx, cancel := context.WithTimeout(s.requestContext(), s.locks.Timeout)
+	defer cancel()
+
+	return s.lockStrategy.WithLocks(ctx, lockedAccounts(ts), fn)
+}
+
+// lockedAccounts are the accounts of the transactions that have a balance
+func lockedAccounts(ts []Transaction) []string {
+	seen := map[string]bool{ExternalAccount: true, AdjustmentAccount: true}
+
+	var accounts []string
+	for _, t := range ts {
+		for _, account := range []string{t.SenderID, t.RecipientID} {
+			if !seen[account] {
+				seen[account] = true
+				accounts = append(accounts, account)
+			}
+		}
+	}
+
+	return accounts
+}
+
+// runTx runs fn in the SQL transaction and commits it when fn succeeds
+func runTx(tx *sql.Tx, fn func(tx *sql.Tx) error) error {
+	err := fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// retryLock calls try until it takes the lock, with a backoff while the lock is taken by someone else.
+// ErrLockTimeout is returned once the deadline of the context is passed and its error once it is cancelled.
+func retryLock(ctx context.Context, counters *lockCounters, try func() (bool, error)) error {
+	start := time.Now()
+	wait := lockRetryBase
+
+	for attempt := 0; ; attempt++ {
+		acquired, err := try()
+		if err != nil {
+			return err
+		}
+
+		if acquired {
+			atomic.AddInt64(&counters.acquired, 1)
+			if attempt > 0 {
+				atomic.AddInt64(&counters.contended, 1)
+				atomic.AddInt64(&counters.waitMillis, time.Since(start).Milliseconds())
+			}
+			return nil
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddInt64(&counters.waitMillis, time.Since(start).Milliseconds())
+
+			if ctx.Err() == context.DeadlineExceeded {
+				atomic.AddInt64(&counters.timedOut, 1)
+				return ErrLockTimeout
+			}
+
+			atomic.AddInt64(&counters.cancelled, 1)
+			return ctx.Err()
+		}
+
+		wait *= 2
+		if wait > lockRetryMax {
+			wait = lockRetryMax
+		}
+	}
+}
+
+// advisoryLocks locks each account with a session advisory lock on a dedicated connection. The key of an account is
+// the id of its balance, which no other account shares, and the locks are taken in the order of their keys.
+type advisoryLocks struct {
+	db       *sql.DB
+	counters *lockCounters
+}
+
+func (a *advisoryLocks) WithLocks(ctx context.Context, accounts []string, fn func() error) error {
+	return a.withConn(ctx, accounts, func(*sql.Conn) error {
+		return fn()
+	})
+}
+
+func (a *advisoryLocks) WithLockedTx(ctx context.Context, accounts []string, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	return a.withConn(ctx, accounts, func(conn *sql.Conn) error {
+		// the SQL transaction is not bound to the context, its timeout is only for waiting for the locks
+		tx, err := conn.BeginTx(context.Background(), opts)
+		if err != nil {
+			return err
+		}
+
+		return runTx(tx, fn)
+	})
+}
+
+// withConn runs fn with the connection the locks of the accounts are taken on
+func (a *advisoryLocks) withConn(ctx context.Context, accounts []string, fn func(conn *sql.Conn) error) error {
+	conn, err := a.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	keys, err := accountLockKeys(ctx, conn, accounts)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := a.Lock(ctx, key, conn)
+		if err != nil {
+			return err
+		}
+
+		key := key
+		defer func() {
+			err := a.Unlock(key, conn)
+			if err != nil {
+				log.Error().Err(err).Msg("error releasing the lock")
+			}
+		}()
+	}
+
+	return fn(conn)
+}
+
+// accountLockKeys returns the keys of the accounts in the order they must be locked, accounts without a balance
+// have nothing to protect and no key
+func accountLockKeys(ctx context.Context, conn *sql.Conn, accounts []string) ([]int64, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT id FROM balance WHERE userid = ANY($1) ORDER BY id", pq.Array(accounts))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []int64
+	for rows.Next() {
+		var key int64
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// Lock takes the advisory lock of the key on the connection, trying again while it is taken
+func (a *advisoryLocks) Lock(ctx context.Context, key int64, conn *sql.Conn) error {
+	return retryLock(ctx, a.counters, func() (bool, error) {
+		// trying does not block, it is not cancelled halfway so that a lock taken is never left unknown
+		var acquired bool
+		err := conn.QueryRowContext(context.Background(), `SELECT pg_try_advisory_lock($1)`, key).Scan(&acquired)
+		return acquired, err
+	})
+}
+
+func (a *advisoryLocks) Unlock(key int64, conn *sql.Conn) error {
+	_, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, key)
+	return err
+}
+
+// rowLocks locks the rows of the accounts in the account_locks table with SELECT ... FOR UPDATE, in a SQL transaction
+// held while fn runs. The rows are locked in the order of the user ids. The balances themselves are not locked as
+// WithLocks updates them in another SQL transaction.
+type rowLocks struct {
+	db       *sql.DB
+	counters *lockCounters
+}
+
+func (r *rowLocks) WithLocks(ctx context.Context, accounts []string, fn func() error) error {
+	return r.WithLockedTx(ctx, accounts, nil, func(*sql.Tx) error {
+		return fn()
+	})
+}
+
+func (r *rowLocks) WithLockedTx(ctx context.Context, accounts []string, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	sorted := append([]string{}, accounts...)
+	sort.Strings(sorted)
+
+	// the rows are created once, they are never deleted
+	_, err := r.db.ExecContext(ctx, `INSERT into account_locks (userid) SELECT unnest($1::varchar[]) ON CONFLICT DO NOTHING`,
+		pq.Array(sorted))
+	if err != nil {
+		return err
+	}
+
+	// the SQL transaction is not bound to the context, a cancelled lock attempt is rolled back to the savepoint
+	tx, err := r.db.BeginTx(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+
+	err = retryLock(ctx, r.counters, func() (bool, error) {
+		if _, err := tx.Exec("SAVEPOINT account_locks"); err != nil {
+			return false, err
+		}
+
+		_, err := tx.Exec(`SELECT userid FROM account_locks WHERE userid = ANY($1) ORDER BY userid FOR UPDATE NOWAIT`,
+			pq.Array(sorted))
+		if err == nil {
+			return true, nil
+		}
+
+		if e, ok := err.(*pq.Error); !ok || e.Code != "55P03" {
+			return false, err
+		}
+
+		// a row is locked by someone else, those locked by this attempt are released
+		_, err = tx.Exec("ROLLBACK TO SAVEPOINT account_locks")
+		return false, err
+	})
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return runTx(tx, fn)
+}
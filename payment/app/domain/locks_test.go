@@ -0,0 +1,176 @@
+package domain
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+var lockStrategies = []string{LockAdvisory, LockForUpdate}
+
+// holdLocks holds the locks of the accounts until the returned function is called, like a stuck payment would
+func holdLocks(t *testing.T, pay *SQLDatabase, accounts ...string) func() {
+	locked, release, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	// the locks may fail to release after they were taken, locked is then already closed
+	var lockedOnce sync.Once
+
+	go func() {
+		defer close(done)
+		err := pay.lockStrategy.WithLocks(context.Background(), accounts, func() error {
+			lockedOnce.Do(func() { close(locked) })
+			<-release
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+			lockedOnce.Do(func() { close(locked) })
+		}
+	}()
+
+	<-locked
+	return func() {
+		close(release)
+		<-done
+	}
+}
+
+func TestSQLDatabase_LockTimeout(t *testing.T) {
+	for _, strategy := range lockStrategies {
+		t.Run(strategy, func(t *testing.T) {
+			cleanDB(db)
+			pay := NewSQLDatabase(db)
+			if err := pay.SetLocks(LocksConfig{Strategy: strategy, Timeout: 100 * time.Millisecond}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := initBalance("1", 100); err != nil {
+				t.Fatal(err)
+			}
+			if err := initBalance("2", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			payment := Transaction{RequestID: "a", SenderID: "1", RecipientID: "2", Amount: 10, Currency: "SGD"}
+
+			release := holdLocks(t, pay, "1")
+
+			start := time.Now()
+			if _, err := pay.SaveTransaction(payment); err != ErrLockTimeout {
+				t.Errorf("expected %v, got %v", ErrLockTimeout, err)
+			}
+
+			if waited := time.Since(start); waited > time.Second {
+				t.Errorf("expected the payment to give up after the lock timeout, waited %v", waited)
+			}
+
+			// the client goes away while the payment waits
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			if _, err := pay.WithContext(ctx).SaveTransaction(payment); err != context.Canceled {
+				t.Errorf("expected %v, got %v", context.Canceled, err)
+			}
+
+			stats := pay.LockStats().(LockStats)
+			if stats.TimedOut != 1 || stats.Cancelled != 1 {
+				t.Errorf("expected a timed out and a cancelled lock, got %+v", stats)
+			}
+
+			release()
+
+			// nothing was written, the payment goes through once the lock is free
+			if _, err := pay.SaveTransaction(payment); err != nil {
+				t.Fatal(err)
+			}
+
+			expectBalances(t, pay, 90, 10)
+		})
+	}
+}
+
+func TestSQLDatabase_LockStrategies(t *testing.T) {
+	for _, strategy := range lockStrategies {
+		t.Run(strategy, func(t *testing.T) {
+			pay := NewSQLDatabase(db)
+			if err := pay.SetLocks(LocksConfig{Strategy: strategy, Timeout: 10 * time.Second}); err != nil {
+				t.Fatal(err)
+			}
+
+			expectNoOverdraft(t, pay)
+		})
+	}
+}
+
+// expectNoOverdraft makes concurrent payments from the same account to different recipients,
+// only those its balance covers must go through
+func expectNoOverdraft(t *testing.T, pay *SQLDatabase) {
+	cleanDB(db)
+
+	for userID, amount := range map[string]float64{"1": 100, "2": 0, "3": 0} {
+		if err := initBalance(userID, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 40
+	wg := sync.WaitGroup{}
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		recipient := fmt.Sprint(2 + i%2)
+		requestID := fmt.Sprint(i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := pay.SaveTransaction(Transaction{RequestID: requestID, SenderID: "1", RecipientID: recipient,
+				Amount: 10, Currency: "SGD"})
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	paid := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			paid++
+		case ErrInsufficientBalance:
+		default:
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+
+	if paid != 10 {
+		t.Errorf("expected 10 payments to go through, got %d", paid)
+	}
+
+	var total float64
+	for _, userID := range []string{"1", "2", "3"} {
+		b, err := pay.GetBalance(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b.Amount < 0 {
+			t.Errorf("expected no overdraft, user %s has %v", userID, b.Amount)
+		}
+		total += b.Amount
+	}
+
+	if total != 100 {
+		t.Errorf("expected the 100 SGD to be spread over the users, got %v", total)
+	}
+}
+
+func TestSQLDatabase_SetLocks(t *testing.T) {
+	pay := NewSQLDatabase(db)
+
+	if err := pay.SetLocks(LocksConfig{Strategy: "pair"}); err == nil {
+		t.Error("expected an unknown strategy to be refused")
+	}
+}
@@ -0,0 +1,279 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	MoneyRequestPending   = "pending"
+	MoneyRequestPaid      = "paid"
+	MoneyRequestDeclined  = "declined"
+	MoneyRequestExpired   = "expired"
+	MoneyRequestCancelled = "cancelled"
+
+	DefaultMoneyRequestDuration = 7 * 24 * time.Hour
+
+	RolePayer     = "payer"
+	RoleRequester = "requester"
+)
+
+var (
+	ErrMoneyRequestNotFound   = errors.New("money request not found")
+	ErrMoneyRequestNotPending = errors.New("money request is not pending")
+	ErrRequestToSelf          = errors.New("users cannot request money from themselves")
+)
+
+// moneyRequestNamespace derives the request_id of the payment from the money request, so that it is paid once
+var moneyRequestNamespace = uuid.NewV5(uuid.NamespaceURL, "payment/money-requests")
+
+// MoneyRequest asks the payer to send money to the requester. It stays pending until the payer
+// accepts or declines it, the requester cancels it or it expires.
+type MoneyRequest struct {
+	MoneyRequestID string    `json:"money_request_id"`
+	RequestID      string    `json:"request_id"`
+	RequesterID    string    `json:"requester_id"`
+	PayerID        string    `json:"payer_id"`
+	Amount         float64   `json:"amount"`
+	Currency       string    `json:"currency"`
+	Message        string    `json:"message"`
+	Status         string    `json:"status"`
+	TransactionID  string    `json:"transaction_id,omitempty"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type CreateMoneyRequest struct {
+	RequestID   string  `json:"request_id"`
+	RequesterID string  `json:"requester_id"`
+	PayerID     string  `json:"payer_id"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+	Message     string  `json:"message"`
+	// ExpiresIn is the lifetime of the request in seconds, DefaultMoneyRequestDuration when 0
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// ListMoneyRequests lists the requests the user has to pay, or the ones they sent, optionally with a given status
+type ListMoneyRequests struct {
+	UserID string
+	Role   string
+	Status string
+}
+
+// pending requests past their expiry are reported as expired even before ExpireMoneyRequests updates them
+const moneyRequestColumns = `moneyrequestid, requestid, requesterid, payerid, amount, currency, COALESCE(message, ''),
+	CASE WHEN status = 'pending' AND expiresat <= NOW() THEN 'expired' ELSE status END AS status,
+	COALESCE(transactionid, ''), expiresat, createdat`
+
+func scanMoneyRequest(row scanner) (MoneyRequest, error) {
+	m := MoneyRequest{}
+	err := row.Scan(&m.MoneyRequestID, &m.RequestID, &m.RequesterID, &m.PayerID, &m.Amount, &m.Currency, &m.Message,
+		&m.Status, &m.TransactionID, &m.ExpiresAt, &m.CreatedAt)
+	return m, err
+}
+
+func (s *SQLDatabase) GetMoneyRequest(moneyRequestID string) (*MoneyRequest, error) {
+	return getMoneyRequest(s.db, moneyRequestID)
+}
+
+func getMoneyRequest(q querier, moneyRequestID string) (*MoneyRequest, error) {
+	query := "SELECT " + moneyRequestColumns + " FROM money_requests WHERE moneyrequestid = $1"
+
+	m, err := scanMoneyRequest(q.QueryRow(query, moneyRequestID))
+	if err == sql.ErrNoRows {
+		return nil, ErrMoneyRequestNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// CreateMoneyRequest sends a money request to the payer, it is idempotent on the request_id
+func (s *SQLDatabase) CreateMoneyRequest(c CreateMoneyRequest) (*MoneyRequest, error) {
+	if c.Amount <= 0 {
+		return nil, ErrNegativeAmount
+	}
+
+	if c.RequesterID == c.PayerID {
+		return nil, ErrRequestToSelf
+	}
+
+	for _, userID := range []string{c.RequesterID, c.PayerID} {
+		if _, err := s.GetBalance(userID); err != nil {
+			return nil, err
+		}
+	}
+
+	duration := DefaultMoneyRequestDuration
+	if c.ExpiresIn > 0 {
+		duration = time.Duration(c.ExpiresIn) * time.Second
+	}
+
+	query := `INSERT into money_requests (moneyrequestid, requestid, requesterid, payerid, amount, currency, message, status, expiresat)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW() + $9 * INTERVAL '1 second')
+			  ON CONFLICT (requestid) DO NOTHING`
+
+	_, err := s.db.Exec(query, uuid.NewV4().String(), c.RequestID, c.RequesterID, c.PayerID, c.Amount, c.Currency, c.Message,
+		MoneyRequestPending, duration.Seconds())
+	if err != nil {
+		log.Error().Err(err)
+		return nil, err
+	}
+
+	m, err := scanMoneyRequest(s.db.QueryRow("SELECT "+moneyRequestColumns+" FROM money_requests WHERE requestid = $1", c.RequestID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &m, nil
+}
+
+// ListMoneyRequests returns the money requests of the user, most recent first
+func (s *SQLDatabase) ListMoneyRequests(l ListMoneyRequests) ([]MoneyRequest, error) {
+	userColumn := "payerid"
+	if l.Role == RoleRequester {
+		userColumn = "requesterid"
+	}
+
+	query := `SELECT * FROM (SELECT ` + moneyRequestColumns + `, id FROM money_requests WHERE ` + userColumn + ` = $1) r
+			  WHERE $2 = '' OR status = $2 ORDER BY id DESC`
+
+	rows, err := s.db.Query(query, l.UserID, l.Status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []MoneyRequest{}
+	for rows.Next() {
+		var id int
+		m := MoneyRequest{}
+		err := rows.Scan(&m.MoneyRequestID, &m.RequestID, &m.RequesterID, &m.PayerID, &m.Amount, &m.Currency, &m.Message,
+			&m.Status, &m.TransactionID, &m.ExpiresAt, &m.CreatedAt, &id)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, m)
+	}
+
+	return requests, rows.Err()
+}
+
+// AcceptMoneyRequest pays the requester. The request is checked and marked as paid under the lock of the payment,
+// so that it cannot be paid twice nor paid once declined or cancelled.
+func (s *SQLDatabase) AcceptMoneyRequest(moneyRequestID string) (*MoneyRequest, error) {
+	m, err := s.GetMoneyRequest(moneyRequestID)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Status != MoneyRequestPending {
+		return nil, ErrMoneyRequestNotPending
+	}
+
+	t := Transaction{
+		RequestID:   uuid.NewV5(moneyRequestNamespace, moneyRequestID).String(),
+		SenderID:    m.PayerID,
+		RecipientID: m.RequesterID,
+		Message:     m.Message,
+		Amount:      m.Amount,
+		Currency:    m.Currency,
+	}
+
+	_, err = s.pay(t, transferHooks{
+		check: func(q querier, t *Transaction) error {
+			m, err := getMoneyRequest(q, moneyRequestID)
+			if err != nil {
+				return err
+			}
+
+			if m.Status != MoneyRequestPending {
+				return ErrMoneyRequestNotPending
+			}
+
+			return nil
+		},
+		write: func(tx *sql.Tx, txID string) error {
+			query := `UPDATE money_requests SET status = $1, transactionid = $2, updatedat = NOW()
+					  WHERE moneyrequestid = $3 AND status = $4`
+
+			_, err := tx.Exec(query, MoneyRequestPaid, txID, moneyRequestID, MoneyRequestPending)
+			if err != nil {
+				return err
+			}
+
+			return closeSplit(tx, moneyRequestID)
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetMoneyRequest(moneyRequestID)
+}
+
+// DeclineMoneyRequest is the payer refusing to pay
+func (s *SQLDatabase) DeclineMoneyRequest(moneyRequestID string) (*MoneyRequest, error) {
+	return s.closeMoneyRequest(moneyRequestID, MoneyRequestDeclined)
+}
+
+// CancelMoneyRequest is the requester withdrawing their request
+func (s *SQLDatabase) CancelMoneyRequest(moneyRequestID string) (*MoneyRequest, error) {
+	return s.closeMoneyRequest(moneyRequestID, MoneyRequestCancelled)
+}
+
+// closeMoneyRequest takes the lock of the payment so that a request is not closed while it is being paid
+func (s *SQLDatabase) closeMoneyRequest(moneyRequestID, status string) (*MoneyRequest, error) {
+	m, err := s.GetMoneyRequest(moneyRequestID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.withLock(Transaction{SenderID: m.PayerID, RecipientID: m.RequesterID}, func() error {
+		query := `UPDATE money_requests SET status = $1, updatedat = NOW()
+				  WHERE moneyrequestid = $2 AND status = $3 AND expiresat > NOW()`
+
+		res, err := s.db.Exec(query, status, moneyRequestID, MoneyRequestPending)
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return ErrMoneyRequestNotPending
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetMoneyRequest(moneyRequestID)
+}
+
+// ExpireMoneyRequests marks the pending requests past their expiry as expired
+func (s *SQLDatabase) ExpireMoneyRequests() (int64, error) {
+	res, err := s.db.Exec(`UPDATE money_requests SET status = $1, updatedat = NOW() WHERE status = $2 AND expiresat <= NOW()`,
+		MoneyRequestExpired, MoneyRequestPending)
+	if err != nil {
+		log.Error().Err(err)
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
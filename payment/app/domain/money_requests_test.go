@@ -0,0 +1,113 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestSQLDatabase_MoneyRequests(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	cleanDB(db)
+
+	if err := initBalance("1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initBalance("2", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(requestID string, amount float64) *MoneyRequest {
+		m, err := pay.CreateMoneyRequest(CreateMoneyRequest{
+			RequestID:   requestID,
+			RequesterID: "1",
+			PayerID:     "2",
+			Amount:      amount,
+			Currency:    "SGD",
+			Message:     "dinner",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	if _, err := pay.CreateMoneyRequest(CreateMoneyRequest{RequestID: "self", RequesterID: "1", PayerID: "1", Amount: 1}); err != ErrRequestToSelf {
+		t.Fatalf("expected %v, got %v", ErrRequestToSelf, err)
+	}
+
+	tooMuch := create("request-1", 50)
+	accepted := create("request-2", 20)
+	declined := create("request-3", 5)
+	cancelled := create("request-4", 5)
+
+	if replayed := create("request-2", 20); replayed.MoneyRequestID != accepted.MoneyRequestID {
+		t.Fatalf("expected money request %s, got %s", accepted.MoneyRequestID, replayed.MoneyRequestID)
+	}
+
+	pending, err := pay.ListMoneyRequests(ListMoneyRequests{UserID: "2", Role: RolePayer, Status: MoneyRequestPending})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pending) != 4 {
+		t.Fatalf("expected 4 pending money requests, got %d", len(pending))
+	}
+
+	// a refused payment leaves the request pending
+	if _, err := pay.AcceptMoneyRequest(tooMuch.MoneyRequestID); err != ErrInsufficientBalance {
+		t.Fatalf("expected %v, got %v", ErrInsufficientBalance, err)
+	}
+
+	m, err := pay.AcceptMoneyRequest(accepted.MoneyRequestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Status != MoneyRequestPaid || m.TransactionID == "" {
+		t.Fatalf("expected a paid money request, got %+v", m)
+	}
+
+	if _, err := pay.AcceptMoneyRequest(accepted.MoneyRequestID); err != ErrMoneyRequestNotPending {
+		t.Fatalf("expected %v, got %v", ErrMoneyRequestNotPending, err)
+	}
+
+	if m, err := pay.DeclineMoneyRequest(declined.MoneyRequestID); err != nil || m.Status != MoneyRequestDeclined {
+		t.Fatalf("expected a declined money request, got %+v, %v", m, err)
+	}
+
+	if m, err := pay.CancelMoneyRequest(cancelled.MoneyRequestID); err != nil || m.Status != MoneyRequestCancelled {
+		t.Fatalf("expected a cancelled money request, got %+v, %v", m, err)
+	}
+
+	if _, err := pay.AcceptMoneyRequest(cancelled.MoneyRequestID); err != ErrMoneyRequestNotPending {
+		t.Fatalf("expected %v, got %v", ErrMoneyRequestNotPending, err)
+	}
+
+	// expired requests can no longer be paid
+	if _, err := db.Exec(`UPDATE money_requests SET expiresat = NOW() WHERE moneyrequestid = $1`, tooMuch.MoneyRequestID); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err := pay.GetMoneyRequest(tooMuch.MoneyRequestID); err != nil || m.Status != MoneyRequestExpired {
+		t.Fatalf("expected an expired money request, got %+v, %v", m, err)
+	}
+
+	if _, err := pay.AcceptMoneyRequest(tooMuch.MoneyRequestID); err != ErrMoneyRequestNotPending {
+		t.Fatalf("expected %v, got %v", ErrMoneyRequestNotPending, err)
+	}
+
+	if n, err := pay.ExpireMoneyRequests(); err != nil || n != 1 {
+		t.Fatalf("expected 1 money request to expire, got %d, %v", n, err)
+	}
+
+	sent, err := pay.ListMoneyRequests(ListMoneyRequests{UserID: "1", Role: RoleRequester})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sent) != 4 {
+		t.Fatalf("expected 4 money requests, got %d", len(sent))
+	}
+
+	expectBalances(t, pay, 20, 10)
+}
@@ -0,0 +1,178 @@
+package domain
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	EventPaymentCompleted = "PaymentCompleted"
+	EventPaymentFailed    = "PaymentFailed"
+
+	relayBatchSize = 100
+)
+
+var errPublishFailed = errors.New("publish failed")
+
+// Event tells the world outside the payment service that something happened to a transaction
+type Event struct {
+	EventID     string      `json:"event_id"`
+	Type        string      `json:"type"`
+	OccurredAt  time.Time   `json:"occurred_at"`
+	Transaction Transaction `json:"transaction"`
+}
+
+// Publisher sends events to their consumers. Events are sent at least once, consumers tell duplicates
+// apart with the event_id.
+type Publisher interface {
+	Publish(e Event) error
+}
+
+// Publishers publishes each event to all of its publishers. An event one of them fails to publish is published
+// to all of them again, which is fine since events are sent at least once.
+type Publishers []Publisher
+
+func (p Publishers) Publish(e Event) error {
+	for _, publisher := range p {
+		if err := publisher.Publish(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEvent adds an event about the transaction to the outbox, in the SQL transaction writing it
+// so that the event is published if and only if the transaction is committed
+func writeEvent(tx *sql.Tx, eventType, txID string) error {
+	t, err := scanTransaction(tx.QueryRow("SELECT "+transactionColumns+" FROM transactions WHERE transactionid = $1", txID))
+	if err != nil {
+		return err
+	}
+
+	e := Event{
+		EventID:     uuid.NewV4().String(),
+		Type:        eventType,
+		OccurredAt:  time.Now().UTC(),
+		Transaction: t,
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT into outbox (eventid, type, senderid, receiverid, payload) VALUES ($1, $2, $3, $4, $5)`
+
+	_, err = tx.Exec(query, e.EventID, e.Type, t.SenderID, t.RecipientID, payload)
+	return err
+}
+
+type outboxEntry struct {
+	event     Event
+	accountID []string
+}
+
+// RelayEvents publishes the events of the outbox in the order they were written, it returns how many were published.
+// When an event cannot be published, the later events of its accounts wait for the next relay so that the events
+// of an account are always published in order, those of other accounts are published meanwhile.
+func (s *SQLDatabase) RelayEvents(p Publisher) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// the rows stay locked until the relay is done, so concurrent relays do not publish the same events
+	query := `SELECT payload, senderid, receiverid FROM outbox WHERE publishedat IS NULL ORDER BY id LIMIT $1 FOR UPDATE`
+
+	rows, err := tx.Query(query, relayBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var entries []outboxEntry
+	for rows.Next() {
+		var payload []byte
+		var sender, recipient string
+
+		if err := rows.Scan(&payload, &sender, &recipient); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		e := outboxEntry{accountID: []string{sender, recipient}}
+		if err := json.Unmarshal(payload, &e.event); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		entries = append(entries, e)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	blocked := map[string]bool{}
+
+	for _, e := range entries {
+		if blocked[e.accountID[0]] || blocked[e.accountID[1]] {
+			continue
+		}
+
+		err := p.Publish(e.event)
+		if err != nil {
+			blocked[e.accountID[0]], blocked[e.accountID[1]] = true, true
+
+			_, err = tx.Exec(`UPDATE outbox SET attempts = attempts + 1, lasterror = LEFT($1, 256) WHERE eventid = $2`,
+				err.Error(), e.event.EventID)
+			if err != nil {
+				return published, err
+			}
+			continue
+		}
+
+		_, err = tx.Exec(`UPDATE outbox SET attempts = attempts + 1, publishedat = NOW() WHERE eventid = $1`, e.event.EventID)
+		if err != nil {
+			return published, err
+		}
+		published++
+	}
+
+	return published, tx.Commit()
+}
+
+// MemoryPublisher keeps the events it is given, for tests
+type MemoryPublisher struct {
+	mu     sync.Mutex
+	events []Event
+	// Fail makes Publish fail for the events of the transactions it returns true for
+	Fail func(e Event) bool
+}
+
+func (m *MemoryPublisher) Publish(e Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.Fail != nil && m.Fail(e) {
+		return errPublishFailed
+	}
+
+	m.events = append(m.events, e)
+	return nil
+}
+
+// Events returns the events published so far, in the order they were published
+func (m *MemoryPublisher) Events() []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Event(nil), m.events...)
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSQLDatabase_RelayEvents(t *testing.T) {
+	cleanDB(db)
+	pay := NewSQLDatabase(db)
+
+	for userID, amount := range map[string]float64{"1": 100, "2": 0, "3": 100, "4": 0} {
+		if err := initBalance(userID, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	payments := []Transaction{
+		{RequestID: "a", SenderID: "1", RecipientID: "2", Amount: 10, Currency: "SGD"},
+		{RequestID: "b", SenderID: "3", RecipientID: "4", Amount: 10, Currency: "SGD"},
+		{RequestID: "c", SenderID: "1", RecipientID: "2", Amount: 1000, Currency: "SGD"},
+		{RequestID: "d", SenderID: "3", RecipientID: "4", Amount: 20, Currency: "SGD"},
+		{RequestID: "e", SenderID: "1", RecipientID: "2", Amount: 20, Currency: "SGD"},
+	}
+
+	for _, p := range payments {
+		_, _ = pay.SaveTransaction(p)
+	}
+
+	// the first event of users 1 and 2 cannot be published, theirs wait while those of users 3 and 4 go
+	p := &MemoryPublisher{Fail: func(e Event) bool { return e.Transaction.RequestID == "a" }}
+
+	n, err := pay.RelayEvents(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("expected 2 events to be published, got %d", n)
+	}
+
+	p.Fail = nil
+
+	n, err = pay.RelayEvents(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Errorf("expected the 3 remaining events to be published, got %d", n)
+	}
+
+	n, err = pay.RelayEvents(p)
+	if err != nil || n != 0 {
+		t.Errorf("expected nothing left to publish, got %d, %v", n, err)
+	}
+
+	var published [][2]string
+	for _, e := range p.Events() {
+		published = append(published, [2]string{e.Transaction.RequestID, e.Type})
+	}
+
+	expected := [][2]string{
+		{"b", EventPaymentCompleted},
+		{"d", EventPaymentCompleted},
+		{"a", EventPaymentCompleted},
+		{"c", EventPaymentFailed},
+		{"e", EventPaymentCompleted},
+	}
+
+	if !reflect.DeepEqual(published, expected) {
+		t.Errorf("expected events %v, got %v", expected, published)
+	}
+}
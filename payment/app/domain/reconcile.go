@@ -0,0 +1,126 @@
+package domain
+
+import (
+	"math"
+	"time"
+
+	"github.com/lib/pq"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Discrepancy is a balance that differs from the sum of the transactions of its user
+type Discrepancy struct {
+	UserID          string  `json:"user_id"`
+	StoredBalance   float64 `json:"stored_balance"`
+	ComputedBalance float64 `json:"computed_balance"`
+	// Difference is what the stored balance has on top of the computed one
+	Difference        float64 `json:"difference"`
+	LastTransactionID string  `json:"last_transaction_id,omitempty"`
+}
+
+// Reconciliation is the report of a comparison of every balance with the transactions of its user
+type Reconciliation struct {
+	RunID         string        `json:"run_id"`
+	StartedAt     time.Time     `json:"started_at"`
+	FinishedAt    time.Time     `json:"finished_at"`
+	Accounts      int           `json:"accounts"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+// Reconcile recomputes every balance from the transactions that moved money and reports those that differ from
+// the stored balance. It changes no balance, so it can run any number of times alongside payments: balances and
+// transactions are read in a single query and so in a single snapshot.
+//
+// With record, the discrepancies are also written to the discrepancies table. A user has at most one open
+// discrepancy, updated by each run that still finds it and resolved by the first run that does not.
+func (s *SQLDatabase) Reconcile(record bool) (*Reconciliation, error) {
+	r := &Reconciliation{
+		RunID:         uuid.NewV4().String(),
+		StartedAt:     time.Now().UTC(),
+		Discrepancies: []Discrepancy{},
+	}
+
+	query := `SELECT b.userid, b.amount, COALESCE(t.total, 0), COALESCE(b.lasttransactionid, '') FROM balance b
+			  LEFT JOIN (
+				SELECT userid, SUM(amount) AS total FROM (
+				  SELECT receiverid AS userid, amount FROM transactions WHERE ` + movedMoney + `
+				  UNION ALL
+				  SELECT senderid AS userid, -amount FROM transactions WHERE ` + movedMoney + `
+				) moves GROUP BY userid
+			  ) t ON t.userid = b.userid
+			  ORDER BY b.userid`
+
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := Discrepancy{}
+		if err := rows.Scan(&d.UserID, &d.StoredBalance, &d.ComputedBalance, &d.LastTransactionID); err != nil {
+			return nil, err
+		}
+		r.Accounts++
+
+		// balances are compared in cents, floats summed in another order differ by less
+		stored, computed := math.Round(d.StoredBalance*100), math.Round(d.ComputedBalance*100)
+		if stored == computed {
+			continue
+		}
+
+		d.StoredBalance, d.ComputedBalance, d.Difference = stored/100, computed/100, (stored-computed)/100
+		r.Discrepancies = append(r.Discrepancies, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if record {
+		err = s.recordDiscrepancies(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.FinishedAt = time.Now().UTC()
+	return r, nil
+}
+
+func (s *SQLDatabase) recordDiscrepancies(r *Reconciliation) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// runs recording at the same time would resolve each other's discrepancies
+	_, err = tx.Exec("LOCK TABLE discrepancies IN EXCLUSIVE MODE")
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT into discrepancies (userid, storedbalance, computedbalance, difference, lasttransactionid, firstrunid, lastrunid)
+			  VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $6)
+			  ON CONFLICT (userid) WHERE resolvedat IS NULL DO UPDATE SET storedbalance = EXCLUDED.storedbalance,
+			  computedbalance = EXCLUDED.computedbalance, difference = EXCLUDED.difference,
+			  lasttransactionid = EXCLUDED.lasttransactionid, lastrunid = EXCLUDED.lastrunid, lastseenat = NOW()`
+
+	userIDs := make([]string, 0, len(r.Discrepancies))
+	for _, d := range r.Discrepancies {
+		_, err := tx.Exec(query, d.UserID, d.StoredBalance, d.ComputedBalance, d.Difference, d.LastTransactionID, r.RunID)
+		if err != nil {
+			return err
+		}
+		userIDs = append(userIDs, d.UserID)
+	}
+
+	_, err = tx.Exec(`UPDATE discrepancies SET resolvedat = NOW() WHERE resolvedat IS NULL AND NOT (userid = ANY($1))`,
+		pq.Array(userIDs))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
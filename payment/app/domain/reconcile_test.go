@@ -0,0 +1,67 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestSQLDatabase_Reconcile(t *testing.T) {
+	cleanDB(db)
+	pay := NewSQLDatabase(db)
+
+	// a balance given without a transaction is money the ledger does not know about
+	if err := initBalance("1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	openDiscrepancies := func() int {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM discrepancies WHERE resolvedat IS NULL").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	for i := 0; i < 2; i++ {
+		r, err := pay.Reconcile(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if r.Accounts != 2 || len(r.Discrepancies) != 1 {
+			t.Fatalf("expected 1 discrepancy over 2 accounts, got %+v", r)
+		}
+
+		d := r.Discrepancies[0]
+		if d.UserID != "1" || d.StoredBalance != 100 || d.ComputedBalance != 0 || d.Difference != 100 {
+			t.Errorf("unexpected discrepancy %+v", d)
+		}
+
+		// running again updates the open discrepancy
+		if count := openDiscrepancies(); count != 1 {
+			t.Errorf("expected 1 open discrepancy, got %d", count)
+		}
+	}
+
+	if err := initBalance("1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := pay.Reconcile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Discrepancies) != 0 {
+		t.Errorf("expected no discrepancy, got %+v", r.Discrepancies)
+	}
+
+	if count := openDiscrepancies(); count != 0 {
+		t.Errorf("expected the discrepancy to be resolved, got %d open", count)
+	}
+
+	expectBalances(t, pay, 0, 0)
+}
@@ -0,0 +1,148 @@
+package domain
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FreqDaily   = "DAILY"
+	FreqWeekly  = "WEEKLY"
+	FreqMonthly = "MONTHLY"
+	FreqYearly  = "YEARLY"
+)
+
+var ErrInvalidRecurrence = errors.New("recurrence must look like FREQ=MONTHLY;INTERVAL=1;COUNT=12 or FREQ=WEEKLY;UNTIL=20261231")
+
+// Recurrence is the subset of an iCalendar RRULE supported by scheduled payments: FREQ, INTERVAL
+// and an optional end, either COUNT occurrences or UNTIL a date. An empty rule runs once.
+type Recurrence struct {
+	Freq     string
+	Interval int
+	Count    int
+	Until    *time.Time
+}
+
+// ParseRecurrence parses a rule such as "FREQ=MONTHLY;INTERVAL=1;COUNT=12"
+func ParseRecurrence(rule string) (Recurrence, error) {
+	if strings.TrimSpace(rule) == "" {
+		return Recurrence{Count: 1}, nil
+	}
+
+	r := Recurrence{Interval: 1}
+
+	for _, part := range strings.Split(strings.TrimPrefix(rule, "RRULE:"), ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+
+		var err error
+
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(kv[1])
+		case "INTERVAL":
+			r.Interval, err = strconv.Atoi(kv[1])
+			if r.Interval < 1 {
+				err = ErrInvalidRecurrence
+			}
+		case "COUNT":
+			r.Count, err = strconv.Atoi(kv[1])
+			if r.Count < 1 {
+				err = ErrInvalidRecurrence
+			}
+		case "UNTIL":
+			var until time.Time
+			until, err = parseUntil(kv[1])
+			r.Until = &until
+		default:
+			err = ErrInvalidRecurrence
+		}
+
+		if err != nil {
+			return Recurrence{}, ErrInvalidRecurrence
+		}
+	}
+
+	switch r.Freq {
+	case FreqDaily, FreqWeekly, FreqMonthly, FreqYearly:
+	default:
+		return Recurrence{}, ErrInvalidRecurrence
+	}
+
+	// as in RFC 5545, COUNT and UNTIL cannot be used together
+	if r.Count > 0 && r.Until != nil {
+		return Recurrence{}, ErrInvalidRecurrence
+	}
+
+	return r, nil
+}
+
+// parseUntil accepts the RRULE date and date-time formats, a date alone lasts until the end of that day
+func parseUntil(s string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", s); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err := time.Parse("20060102", s)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return t.AddDate(0, 0, 1).Add(-time.Second), nil
+}
+
+// Occurrence returns the n-th occurrence, starting from 0, and false once the recurrence has ended.
+// Occurrences are computed from the start so that they never drift: a monthly payment starting on the
+// 31st falls on the last day of shorter months and is back on the 31st afterwards.
+func (r Recurrence) Occurrence(start time.Time, n int) (time.Time, bool) {
+	if r.Count > 0 && n >= r.Count {
+		return time.Time{}, false
+	}
+
+	var t time.Time
+
+	switch r.Freq {
+	case FreqDaily:
+		t = start.AddDate(0, 0, n*r.Interval)
+	case FreqWeekly:
+		t = start.AddDate(0, 0, 7*n*r.Interval)
+	case FreqMonthly:
+		t = addMonths(start, n*r.Interval)
+	case FreqYearly:
+		t = addMonths(start, 12*n*r.Interval)
+	default:
+		// runs once
+		if n > 0 {
+			return time.Time{}, false
+		}
+		t = start
+	}
+
+	if r.Until != nil && t.After(*r.Until) {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+// addMonths keeps the day of the month, or the last day of the month when it is shorter
+func addMonths(t time.Time, months int) time.Time {
+	year, month, day := t.Date()
+
+	first := time.Date(year, month+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+
+	if day > last {
+		day = last
+	}
+
+	return first.AddDate(0, 0, day-1)
+}
@@ -0,0 +1,109 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	until := time.Date(2026, 12, 31, 23, 59, 59, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		rule      string
+		expected  Recurrence
+		expectErr bool
+	}{
+		{name: "empty rule runs once", rule: "", expected: Recurrence{Count: 1}},
+		{name: "monthly", rule: "FREQ=MONTHLY", expected: Recurrence{Freq: FreqMonthly, Interval: 1}},
+		{name: "with count", rule: "RRULE:FREQ=WEEKLY;INTERVAL=2;COUNT=10", expected: Recurrence{Freq: FreqWeekly, Interval: 2, Count: 10}},
+		{name: "until a date", rule: "FREQ=DAILY;UNTIL=20261231", expected: Recurrence{Freq: FreqDaily, Interval: 1, Until: &until}},
+		{name: "until a date-time", rule: "FREQ=DAILY;UNTIL=20261231T235959Z", expected: Recurrence{Freq: FreqDaily, Interval: 1, Until: &until}},
+		{name: "unknown frequency", rule: "FREQ=HOURLY", expectErr: true},
+		{name: "missing frequency", rule: "COUNT=3", expectErr: true},
+		{name: "unsupported part", rule: "FREQ=MONTHLY;BYDAY=MO", expectErr: true},
+		{name: "zero interval", rule: "FREQ=MONTHLY;INTERVAL=0", expectErr: true},
+		{name: "count and until", rule: "FREQ=MONTHLY;COUNT=3;UNTIL=20261231", expectErr: true},
+		{name: "malformed", rule: "FREQ", expectErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := ParseRecurrence(test.rule)
+			if test.expectErr {
+				if err != ErrInvalidRecurrence {
+					t.Fatalf("expected %v, got %v", ErrInvalidRecurrence, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Freq != test.expected.Freq || r.Interval != test.expected.Interval || r.Count != test.expected.Count {
+				t.Errorf("expected %+v, got %+v", test.expected, r)
+			}
+
+			if (r.Until == nil) != (test.expected.Until == nil) || r.Until != nil && !r.Until.Equal(*test.expected.Until) {
+				t.Errorf("expected until %v, got %v", test.expected.Until, r.Until)
+			}
+		})
+	}
+}
+
+func TestRecurrence_Occurrence(t *testing.T) {
+	start := time.Date(2026, 1, 31, 9, 0, 0, 0, time.UTC)
+	until := time.Date(2026, 2, 14, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		recurrence Recurrence
+		expected   []time.Time
+	}{
+		{
+			name:       "once",
+			recurrence: Recurrence{Count: 1},
+			expected:   []time.Time{start},
+		},
+		{
+			name:       "monthly keeps the end of the month",
+			recurrence: Recurrence{Freq: FreqMonthly, Interval: 1, Count: 4},
+			expected: []time.Time{
+				start,
+				time.Date(2026, 2, 28, 9, 0, 0, 0, time.UTC),
+				time.Date(2026, 3, 31, 9, 0, 0, 0, time.UTC),
+				time.Date(2026, 4, 30, 9, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:       "weekly until a date",
+			recurrence: Recurrence{Freq: FreqWeekly, Interval: 1, Until: &until},
+			expected: []time.Time{
+				start,
+				time.Date(2026, 2, 7, 9, 0, 0, 0, time.UTC),
+				time.Date(2026, 2, 14, 9, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:       "every other year",
+			recurrence: Recurrence{Freq: FreqYearly, Interval: 2, Count: 2},
+			expected:   []time.Time{start, time.Date(2028, 1, 31, 9, 0, 0, 0, time.UTC)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for n, expected := range test.expected {
+				occurrence, ok := test.recurrence.Occurrence(start, n)
+				if !ok || !occurrence.Equal(expected) {
+					t.Errorf("occurrence %d: expected %v, got %v (%v)", n, expected, occurrence, ok)
+				}
+			}
+
+			if occurrence, ok := test.recurrence.Occurrence(start, len(test.expected)); ok {
+				t.Errorf("expected the recurrence to end, got %v", occurrence)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+)
+
+var (
+	ErrTransactionNotFound = errors.New("transaction not found")
+	ErrNotRefundable       = errors.New("only completed payments can be refunded")
+	ErrRefundExceeded      = errors.New("refunds would exceed the original amount")
+	ErrDuplicateRequest    = errors.New("request_id was already used for another transaction")
+
+	errReplayedRefund = errors.New("refund was already made")
+)
+
+// RefundRequest reverses all or part of a payment.
+// When Amount is 0 the whole remaining amount is refunded.
+type RefundRequest struct {
+	RequestID     string  `json:"request_id"`
+	TransactionID string  `json:"-"`
+	Amount        float64 `json:"amount"`
+	Message       string  `json:"message"`
+}
+
+func (s *SQLDatabase) GetTransaction(transactionID string) (*Transaction, error) {
+	query := "SELECT " + transactionColumns + " FROM transactions WHERE transactionid = $1"
+
+	t, err := scanTransaction(s.db.QueryRow(query, transactionID))
+	if err == sql.ErrNoRows {
+		return nil, ErrTransactionNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// Refund sends money back from the recipient of a payment to its sender.
+// Refunds are idempotent on their request_id and all the refunds of a payment can never exceed its amount.
+func (s *SQLDatabase) Refund(r RefundRequest) (*Transaction, error) {
+	original, err := s.GetTransaction(r.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if original.Kind != KindPayment || original.Status == StatusFailed || original.Status == StatusPending {
+		return nil, ErrNotRefundable
+	}
+
+	refund, err := existingRefund(s.db, r)
+	if refund != nil || err != nil {
+		return refund, err
+	}
+
+	t := Transaction{
+		RequestID:             r.RequestID,
+		SenderID:              original.RecipientID,
+		RecipientID:           original.SenderID,
+		Message:               r.Message,
+		Amount:                r.Amount,
+		Currency:              original.Currency,
+		Kind:                  KindRefund,
+		OriginalTransactionID: original.TransactionID,
+	}
+
+	// refunds run under the same lock as the original payment, the sender and recipient being swapped,
+	// so the refunded amount cannot change between this check and the write
+	var replayed *Transaction
+	txID, err := s.transfer(t, transferHooks{
+		check: func(q querier, t *Transaction) error {
+			existing, err := existingRefund(q, r)
+			if err != nil {
+				return err
+			}
+
+			// a concurrent call with the same request_id made the refund while we were waiting for the lock
+			if existing != nil {
+				replayed = existing
+				return errReplayedRefund
+			}
+
+			refunded, err := refundedAmount(q, original.TransactionID)
+			if err != nil {
+				return err
+			}
+
+			remaining := original.Amount - refunded
+			if t.Amount == 0 {
+				t.Amount = remaining
+			}
+
+			if t.Amount <= 0 || !lessOrEqual(t.Amount, remaining) {
+				return ErrRefundExceeded
+			}
+
+			return nil
+		},
+		write: func(tx *sql.Tx, txID string) error {
+			return markReversed(tx, original.TransactionID)
+		},
+	})
+
+	if err == errReplayedRefund {
+		return replayed, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetTransaction(*txID)
+}
+
+// existingRefund returns the refund already made with the same request_id, if any
+func existingRefund(q querier, r RefundRequest) (*Transaction, error) {
+	query := "SELECT " + transactionColumns + " FROM transactions WHERE requestid = $1"
+
+	t, err := scanTransaction(q.QueryRow(query, r.RequestID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Kind != KindRefund || t.OriginalTransactionID != r.TransactionID {
+		return nil, ErrDuplicateRequest
+	}
+
+	return &t, nil
+}
+
+func refundedAmount(q querier, transactionID string) (float64, error) {
+	var refunded float64
+
+	query := "SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE originaltransactionid = $1 AND kind = $2 AND status = $3"
+
+	err := q.QueryRow(query, transactionID, KindRefund, StatusCompleted).Scan(&refunded)
+	return refunded, err
+}
+
+// lessOrEqual compares amounts to the cent so that float rounding does not refuse a full refund
+func lessOrEqual(a, b float64) bool {
+	return math.Round(a*100) <= math.Round(b*100)
+}
@@ -0,0 +1,138 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestSQLDatabase_Refund(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	cleanDB(db)
+
+	if err := initBalance("1", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	txID, err := pay.SaveTransaction(Transaction{
+		RequestID:   "pay-1",
+		SenderID:    "1",
+		RecipientID: "2",
+		Amount:      60,
+		Currency:    "SGD",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                     string
+		request                  RefundRequest
+		expectErr                error
+		expectedAmount           float64
+		senderExpectedBalance    float64
+		recipientExpectedBalance float64
+	}{
+		{
+			name:                     "partial refund",
+			request:                  RefundRequest{RequestID: "refund-1", TransactionID: *txID, Amount: 20},
+			expectedAmount:           20,
+			senderExpectedBalance:    60,
+			recipientExpectedBalance: 40,
+		},
+		{
+			name:                     "replayed refund is idempotent",
+			request:                  RefundRequest{RequestID: "refund-1", TransactionID: *txID, Amount: 20},
+			expectedAmount:           20,
+			senderExpectedBalance:    60,
+			recipientExpectedBalance: 40,
+		},
+		{
+			name:                     "refund exceeding the remaining amount",
+			request:                  RefundRequest{RequestID: "refund-2", TransactionID: *txID, Amount: 40.01},
+			expectErr:                ErrRefundExceeded,
+			senderExpectedBalance:    60,
+			recipientExpectedBalance: 40,
+		},
+		{
+			name:                     "refund of the remaining amount",
+			request:                  RefundRequest{RequestID: "refund-3", TransactionID: *txID},
+			expectedAmount:           40,
+			senderExpectedBalance:    100,
+			recipientExpectedBalance: 0,
+		},
+		{
+			name:                     "fully refunded payment",
+			request:                  RefundRequest{RequestID: "refund-4", TransactionID: *txID, Amount: 1},
+			expectErr:                ErrRefundExceeded,
+			senderExpectedBalance:    100,
+			recipientExpectedBalance: 0,
+		},
+		{
+			name:                     "request_id of another transaction",
+			request:                  RefundRequest{RequestID: "pay-1", TransactionID: *txID, Amount: 1},
+			expectErr:                ErrDuplicateRequest,
+			senderExpectedBalance:    100,
+			recipientExpectedBalance: 0,
+		},
+		{
+			name:                     "unknown transaction",
+			request:                  RefundRequest{RequestID: "refund-5", TransactionID: "unknown", Amount: 1},
+			expectErr:                ErrTransactionNotFound,
+			senderExpectedBalance:    100,
+			recipientExpectedBalance: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			refund, err := pay.Refund(test.request)
+			if err != test.expectErr {
+				t.Fatalf("expected error %v got %v", test.expectErr, err)
+			}
+
+			if err == nil {
+				if refund.Amount != test.expectedAmount || refund.OriginalTransactionID != *txID || refund.Kind != KindRefund {
+					t.Fatalf("unexpected refund %+v", refund)
+				}
+
+				if refund.SenderID != "2" || refund.RecipientID != "1" {
+					t.Fatalf("expected refund to go from 2 to 1, got %+v", refund)
+				}
+			}
+
+			senderBalance, err := pay.GetBalance("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if senderBalance.Amount != test.senderExpectedBalance {
+				t.Fatalf("expected sender balance to be %f got %f", test.senderExpectedBalance, senderBalance.Amount)
+			}
+
+			recipientBalance, err := pay.GetBalance("2")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if recipientBalance.Amount != test.recipientExpectedBalance {
+				t.Fatalf("expected recipient balance to be %f got %f", test.recipientExpectedBalance, recipientBalance.Amount)
+			}
+		})
+	}
+
+	results, err := pay.GetAllTransactions(GetTransactions{UserID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("expected the payment and its 2 refunds got %d transactions", len(results))
+	}
+
+	if len(results[0].Refunds) != 2 || results[0].RefundedAmount != 60 {
+		t.Fatalf("expected the payment to link its refunds, got %+v", results[0])
+	}
+}
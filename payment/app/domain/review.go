@@ -0,0 +1,134 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var ErrNotPendingReview = errors.New("transaction is not pending a review")
+
+// ListPendingTransactions returns the payments sent to review by the risk rules, oldest first
+func (s *SQLDatabase) ListPendingTransactions() ([]Transaction, error) {
+	query := "SELECT " + transactionColumns + " FROM transactions WHERE status = $1 AND kind = $2 ORDER BY createdat"
+
+	rows, err := s.db.Query(query, StatusPending, KindPayment)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs := []Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, t)
+	}
+
+	return txs, rows.Err()
+}
+
+// ReleaseTransaction moves the money of a payment pending a review, the amount it held is spent
+func (s *SQLDatabase) ReleaseTransaction(transactionID string) (*Transaction, error) {
+	t, err := s.GetTransaction(transactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.lockedTx(*t, func(tx *sql.Tx) error {
+		return s.releaseTx(tx, *t)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetTransaction(transactionID)
+}
+
+func (s *SQLDatabase) releaseTx(tx *sql.Tx, t Transaction) error {
+	err := setReviewed(tx, t.TransactionID, StatusCompleted, "")
+	if err != nil {
+		return err
+	}
+
+	// the accounts may have been frozen or closed during the review
+	err = checkAccounts(tx, t.SenderID, t.RecipientID)
+	if err != nil {
+		return err
+	}
+
+	bal, err := getBalance(tx, t.SenderID)
+	if err != nil {
+		return err
+	}
+
+	// the payment is no longer pending in the SQL transaction, it is not part of what is held
+	held, err := s.heldAmount(tx, t.SenderID, "")
+	if err != nil {
+		return err
+	}
+
+	err = checkTransaction(bal.Amount-held, t.Amount+t.Fee)
+	if err != nil {
+		return err
+	}
+
+	err = s.moveMoney(tx, t, t.TransactionID)
+	if err != nil {
+		return err
+	}
+
+	return writeEvent(tx, EventPaymentCompleted, t.TransactionID)
+}
+
+// RejectTransaction fails a payment pending a review, what it held is available again
+func (s *SQLDatabase) RejectTransaction(transactionID, reason string) (*Transaction, error) {
+	t, err := s.GetTransaction(transactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if reason == "" {
+		reason = "rejected after review"
+	}
+
+	err = s.lockedTx(*t, func(tx *sql.Tx) error {
+		err := setReviewed(tx, transactionID, StatusFailed, reason)
+		if err != nil {
+			return err
+		}
+
+		return writeEvent(tx, EventPaymentFailed, transactionID)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetTransaction(transactionID)
+}
+
+// setReviewed ends the review of a pending payment, failing if it already ended. A released payment is settled now.
+func setReviewed(tx *sql.Tx, transactionID, status, reason string) error {
+	query := `UPDATE transactions SET status = $1, failurereason = NULLIF($2, ''),
+			  settledat = CASE WHEN $6 THEN NOW() END
+			  WHERE transactionid = $3 AND status = $4 AND kind = $5`
+
+	res, err := tx.Exec(query, status, reason, transactionID, StatusPending, KindPayment, status == StatusCompleted)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotPendingReview
+	}
+
+	return nil
+}
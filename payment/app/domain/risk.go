@@ -0,0 +1,167 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	RiskAllow  = "allow"
+	RiskDeny   = "deny"
+	RiskReview = "review"
+
+	RuleAmount          = "amount"
+	RuleNewRecipient    = "new_recipient"
+	RuleRecipientsBurst = "recipients_burst"
+	RuleRoundTrip       = "round_trip"
+)
+
+var ErrInvalidRiskRule = errors.New("invalid risk rule")
+
+// RiskDecision is the action to take on a payment and the reasons for it
+type RiskDecision struct {
+	Action  string
+	Reasons []string
+}
+
+// RiskEvaluator decides whether a payment can be made before it is written
+type RiskEvaluator interface {
+	Evaluate(t Transaction, history RiskHistory) (RiskDecision, error)
+}
+
+// RiskHistory answers the questions risk rules ask about the payments made before, a window of 0 is all time
+type RiskHistory interface {
+	// PaymentsCount counts the payments from the sender to the recipient
+	PaymentsCount(senderID, recipientID string, window time.Duration) (int, error)
+	// RecipientsCount counts the distinct users the sender paid
+	RecipientsCount(senderID string, window time.Duration) (int, error)
+}
+
+// RiskError refuses a payment denied by the risk rules
+type RiskError struct {
+	Reasons []string
+}
+
+func (e *RiskError) Error() string {
+	return "denied by risk rules: " + strings.Join(e.Reasons, ", ")
+}
+
+// RiskRule matches payments and tells what to do with them.
+// Depending on its type a rule matches payments of at least MinAmount, the first payment to a recipient, payments
+// making the sender pay at least MinRecipients distinct users within Window, or payments back to a user who paid
+// the sender within Window.
+type RiskRule struct {
+	Name          string        `json:"name"`
+	Type          string        `json:"type"`
+	Action        string        `json:"action"`
+	MinAmount     float64       `json:"min_amount" yaml:"min_amount"`
+	MinRecipients int           `json:"min_recipients" yaml:"min_recipients"`
+	Window        time.Duration `json:"window"`
+}
+
+type RiskConfig struct {
+	Rules []RiskRule `json:"rules"`
+}
+
+// RuleEngine evaluates payments against rules, a payment matching several rules gets the strictest action
+type RuleEngine struct {
+	rules []RiskRule
+}
+
+func NewRuleEngine(config RiskConfig) (*RuleEngine, error) {
+	for _, r := range config.Rules {
+		switch r.Type {
+		case RuleAmount, RuleNewRecipient, RuleRecipientsBurst, RuleRoundTrip:
+		default:
+			return nil, fmt.Errorf("%w %s: unknown type %q", ErrInvalidRiskRule, r.Name, r.Type)
+		}
+
+		if r.Action != RiskDeny && r.Action != RiskReview {
+			return nil, fmt.Errorf("%w %s: action must be deny or review", ErrInvalidRiskRule, r.Name)
+		}
+	}
+
+	return &RuleEngine{rules: config.Rules}, nil
+}
+
+func (e *RuleEngine) Evaluate(t Transaction, history RiskHistory) (RiskDecision, error) {
+	decision := RiskDecision{Action: RiskAllow}
+
+	for _, r := range e.rules {
+		matched, err := r.matches(t, history)
+		if err != nil {
+			return RiskDecision{}, err
+		}
+
+		if !matched {
+			continue
+		}
+
+		decision.Reasons = append(decision.Reasons, r.Name)
+		if r.Action == RiskDeny || decision.Action == RiskAllow {
+			decision.Action = r.Action
+		}
+	}
+
+	return decision, nil
+}
+
+func (r RiskRule) matches(t Transaction, history RiskHistory) (bool, error) {
+	if t.Amount < r.MinAmount {
+		return false, nil
+	}
+
+	switch r.Type {
+	case RuleNewRecipient:
+		n, err := history.PaymentsCount(t.SenderID, t.RecipientID, 0)
+		return n == 0, err
+
+	case RuleRecipientsBurst:
+		n, err := history.RecipientsCount(t.SenderID, r.Window)
+		if err != nil {
+			return false, err
+		}
+
+		paid, err := history.PaymentsCount(t.SenderID, t.RecipientID, r.Window)
+		if paid == 0 {
+			n++
+		}
+		return n >= r.MinRecipients, err
+
+	case RuleRoundTrip:
+		n, err := history.PaymentsCount(t.RecipientID, t.SenderID, r.Window)
+		return n > 0, err
+	}
+
+	return true, nil
+}
+
+// SetRiskEvaluator makes payments go through the evaluator before they are written
+func (s *SQLDatabase) SetRiskEvaluator(risk RiskEvaluator) {
+	s.risk = risk
+}
+
+// txHistory reads the history in the SQL transaction of the payment
+type txHistory struct {
+	tx *sql.Tx
+}
+
+// counted payments are those that moved money or may still do
+const countedPayments = `kind = 'payment' AND status <> 'failed' AND ($1 = 0 OR createdat > NOW() - $1 * INTERVAL '1 second')`
+
+func (h txHistory) PaymentsCount(senderID, recipientID string, window time.Duration) (int, error) {
+	var n int
+	err := h.tx.QueryRow(`SELECT COUNT(*) FROM transactions WHERE senderid = $2 AND receiverid = $3 AND `+countedPayments,
+		window.Seconds(), senderID, recipientID).Scan(&n)
+	return n, err
+}
+
+func (h txHistory) RecipientsCount(senderID string, window time.Duration) (int, error) {
+	var n int
+	err := h.tx.QueryRow(`SELECT COUNT(DISTINCT receiverid) FROM transactions WHERE senderid = $2 AND `+countedPayments,
+		window.Seconds(), senderID).Scan(&n)
+	return n, err
+}
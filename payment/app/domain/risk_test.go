@@ -0,0 +1,166 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeHistory holds the payments made as "sender>recipient" keys
+type fakeHistory map[string]int
+
+func (h fakeHistory) PaymentsCount(senderID, recipientID string, window time.Duration) (int, error) {
+	return h[senderID+">"+recipientID], nil
+}
+
+func (h fakeHistory) RecipientsCount(senderID string, window time.Duration) (int, error) {
+	n := 0
+	for pair := range h {
+		if len(pair) > len(senderID) && pair[:len(senderID)+1] == senderID+">" {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestRuleEngine_Evaluate(t *testing.T) {
+	engine, err := NewRuleEngine(RiskConfig{Rules: []RiskRule{
+		{Name: "new_recipient", Type: RuleNewRecipient, Action: RiskReview, MinAmount: 500},
+		{Name: "burst", Type: RuleRecipientsBurst, Action: RiskDeny, MinRecipients: 3, Window: time.Hour},
+		{Name: "round_trip", Type: RuleRoundTrip, Action: RiskReview, Window: time.Hour},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		history  fakeHistory
+		amount   float64
+		expected RiskDecision
+	}{
+		{name: "known recipient", history: fakeHistory{"1>2": 1}, amount: 1000, expected: RiskDecision{Action: RiskAllow}},
+		{name: "small amount to new recipient", amount: 499, expected: RiskDecision{Action: RiskAllow}},
+		{name: "large amount to new recipient", amount: 500, expected: RiskDecision{Action: RiskReview, Reasons: []string{"new_recipient"}}},
+		{name: "paying back", history: fakeHistory{"1>2": 1, "2>1": 1}, amount: 10, expected: RiskDecision{Action: RiskReview, Reasons: []string{"round_trip"}}},
+		{name: "known recipient counted once", history: fakeHistory{"1>2": 1, "1>3": 1}, amount: 10, expected: RiskDecision{Action: RiskAllow}},
+		{
+			name:     "deny wins over review",
+			history:  fakeHistory{"1>3": 1, "1>4": 1},
+			amount:   500,
+			expected: RiskDecision{Action: RiskDeny, Reasons: []string{"new_recipient", "burst"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, err := engine.Evaluate(Transaction{SenderID: "1", RecipientID: "2", Amount: test.amount}, test.history)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(d, test.expected) {
+				t.Errorf("expected %+v, got %+v", test.expected, d)
+			}
+		})
+	}
+}
+
+func TestNewRuleEngine_Invalid(t *testing.T) {
+	for _, r := range []RiskRule{
+		{Name: "unknown type", Type: "other", Action: RiskDeny},
+		{Name: "allow action", Type: RuleAmount, Action: RiskAllow},
+	} {
+		if _, err := NewRuleEngine(RiskConfig{Rules: []RiskRule{r}}); err == nil {
+			t.Errorf("expected rule %q to be refused", r.Name)
+		}
+	}
+}
+
+func TestSQLDatabase_Review(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	engine, err := NewRuleEngine(RiskConfig{Rules: []RiskRule{
+		{Name: "large", Type: RuleAmount, Action: RiskReview, MinAmount: 50},
+		{Name: "huge", Type: RuleAmount, Action: RiskDeny, MinAmount: 90},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay.SetRiskEvaluator(engine)
+
+	tests := []struct {
+		name     string
+		release  bool
+		expected string
+		sender   float64
+	}{
+		{name: "released", release: true, expected: StatusCompleted, sender: 40},
+		{name: "rejected", expected: StatusFailed, sender: 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cleanDB(db)
+			if err := initBalance("1", 100); err != nil {
+				t.Fatal(err)
+			}
+			if err := initBalance("2", 0); err != nil {
+				t.Fatal(err)
+			}
+
+			txID, err := pay.SaveTransaction(Transaction{RequestID: "review", SenderID: "1", RecipientID: "2", Amount: 60, Currency: "SGD"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pending, err := pay.GetTransaction(*txID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pending.Status != StatusPending || pending.RiskReasons != "large" {
+				t.Fatalf("expected a pending payment for rule large, got %s with %q", pending.Status, pending.RiskReasons)
+			}
+			expectBalances(t, pay, 100, 0)
+
+			// the pending payment holds its amount
+			_, err = pay.SaveTransaction(Transaction{RequestID: "other", SenderID: "1", RecipientID: "2", Amount: 45, Currency: "SGD"})
+			if err != ErrInsufficientBalance {
+				t.Fatalf("expected %v, got %v", ErrInsufficientBalance, err)
+			}
+
+			var reviewed *Transaction
+			if test.release {
+				reviewed, err = pay.ReleaseTransaction(*txID)
+			} else {
+				reviewed, err = pay.RejectTransaction(*txID, "")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reviewed.Status != test.expected {
+				t.Errorf("expected status %s, got %s", test.expected, reviewed.Status)
+			}
+			expectBalances(t, pay, test.sender, 100-test.sender)
+
+			if _, err := pay.ReleaseTransaction(*txID); err != ErrNotPendingReview {
+				t.Errorf("expected %v, got %v", ErrNotPendingReview, err)
+			}
+		})
+	}
+
+	_, err = pay.SaveTransaction(Transaction{RequestID: "denied", SenderID: "1", RecipientID: "2", Amount: 90, Currency: "SGD"})
+	if _, ok := err.(*RiskError); !ok {
+		t.Fatalf("expected a risk error, got %v", err)
+	}
+
+	denied, err := pay.GetTransactionByRequestID("denied")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if denied.Status != StatusFailed {
+		t.Errorf("expected the denied payment to be recorded as failed, got %s", denied.Status)
+	}
+}
@@ -0,0 +1,331 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	ScheduleActive    = "active"
+	ScheduleCancelled = "cancelled"
+	ScheduleFinished  = "finished"
+)
+
+var (
+	ErrScheduleNotFound  = errors.New("scheduled payment not found")
+	ErrScheduleNotActive = errors.New("scheduled payment is not active")
+	ErrScheduleInPast    = errors.New("start_at must not be in the past")
+)
+
+// scheduleNamespace derives the request_id of each run from the schedule and the occurrence,
+// a run that is executed again after a crash is then refused as a duplicate instead of paying twice
+var scheduleNamespace = uuid.NewV5(uuid.NamespaceURL, "payment/scheduled-payments")
+
+// Schedule is a standing order paying the recipient at each occurrence of its recurrence
+type Schedule struct {
+	ScheduleID  string     `json:"schedule_id"`
+	RequestID   string     `json:"request_id"`
+	SenderID    string     `json:"sender_id"`
+	RecipientID string     `json:"recipient_id"`
+	Amount      float64    `json:"amount"`
+	Currency    string     `json:"currency"`
+	Message     string     `json:"message"`
+	Recurrence  string     `json:"recurrence"`
+	StartAt     time.Time  `json:"start_at"`
+	Status      string     `json:"status"`
+	NextRunAt   *time.Time `json:"next_run_at,omitempty"`
+	RunCount    int        `json:"run_count"`
+	CreatedAt   time.Time  `json:"created_at"`
+	// Runs is only set when a single schedule is retrieved
+	Runs []ScheduleRun `json:"runs,omitempty"`
+}
+
+type CreateSchedule struct {
+	RequestID   string  `json:"request_id"`
+	SenderID    string  `json:"sender_id"`
+	RecipientID string  `json:"recipient_id"`
+	Amount      float64 `json:"amount"`
+	Currency    string  `json:"currency"`
+	Message     string  `json:"message"`
+	// Recurrence is an RRULE such as FREQ=MONTHLY;COUNT=12, the payment runs once when it is empty
+	Recurrence string `json:"recurrence"`
+	// StartAt is the first occurrence, now when it is missing
+	StartAt time.Time `json:"start_at"`
+}
+
+// ScheduleRun is the outcome of one occurrence of a schedule
+type ScheduleRun struct {
+	Occurrence    int       `json:"occurrence"`
+	ScheduledAt   time.Time `json:"scheduled_at"`
+	RequestID     string    `json:"request_id"`
+	TransactionID string    `json:"transaction_id"`
+	Status        string    `json:"status"`
+	FailureReason string    `json:"failure_reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+const scheduleColumns = `scheduleid, requestid, senderid, receiverid, amount, currency, COALESCE(message, ''), recurrence,
+	startat, status, nextrunat, runcount, createdat`
+
+func scanSchedule(row scanner) (Schedule, error) {
+	sc := Schedule{}
+	err := row.Scan(&sc.ScheduleID, &sc.RequestID, &sc.SenderID, &sc.RecipientID, &sc.Amount, &sc.Currency, &sc.Message,
+		&sc.Recurrence, &sc.StartAt, &sc.Status, &sc.NextRunAt, &sc.RunCount, &sc.CreatedAt)
+	return sc, err
+}
+
+// CreateSchedule sets up a scheduled payment, it is idempotent on the request_id
+func (s *SQLDatabase) CreateSchedule(c CreateSchedule) (*Schedule, error) {
+	if c.Amount <= 0 {
+		return nil, ErrNegativeAmount
+	}
+
+	if _, err := ParseRecurrence(c.Recurrence); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if c.StartAt.IsZero() {
+		c.StartAt = now
+	}
+
+	if c.StartAt.Before(now.Add(-time.Minute)) {
+		return nil, ErrScheduleInPast
+	}
+
+	for _, userID := range []string{c.SenderID, c.RecipientID} {
+		if _, err := s.GetBalance(userID); err != nil {
+			return nil, err
+		}
+	}
+
+	// occurrences are computed in UTC
+	query := `INSERT into schedules (scheduleid, requestid, senderid, receiverid, amount, currency, message, recurrence,
+			  startat, status, nextrunat)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $9)
+			  ON CONFLICT (requestid) DO NOTHING`
+
+	_, err := s.db.Exec(query, uuid.NewV4().String(), c.RequestID, c.SenderID, c.RecipientID, c.Amount, c.Currency, c.Message,
+		c.Recurrence, c.StartAt.UTC(), ScheduleActive)
+	if err != nil {
+		log.Error().Err(err)
+		return nil, err
+	}
+
+	sc, err := scanSchedule(s.db.QueryRow("SELECT "+scheduleColumns+" FROM schedules WHERE requestid = $1", c.RequestID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &sc, nil
+}
+
+// GetSchedule returns the schedule along with the outcome of its runs
+func (s *SQLDatabase) GetSchedule(scheduleID string) (*Schedule, error) {
+	sc, err := scanSchedule(s.db.QueryRow("SELECT "+scheduleColumns+" FROM schedules WHERE scheduleid = $1", scheduleID))
+	if err == sql.ErrNoRows {
+		return nil, ErrScheduleNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT occurrence, scheduledat, requestid, transactionid, status, COALESCE(failurereason, ''), createdat
+			  FROM schedule_runs WHERE scheduleid = $1 ORDER BY occurrence`
+
+	rows, err := s.db.Query(query, scheduleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		run := ScheduleRun{}
+		err := rows.Scan(&run.Occurrence, &run.ScheduledAt, &run.RequestID, &run.TransactionID, &run.Status,
+			&run.FailureReason, &run.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		sc.Runs = append(sc.Runs, run)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &sc, nil
+}
+
+// ListSchedules returns the schedules sent by the user, most recent first
+func (s *SQLDatabase) ListSchedules(userID string) ([]Schedule, error) {
+	rows, err := s.db.Query("SELECT "+scheduleColumns+" FROM schedules WHERE senderid = $1 ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []Schedule{}
+	for rows.Next() {
+		sc, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, sc)
+	}
+
+	return schedules, rows.Err()
+}
+
+// CancelSchedule stops the future runs of the schedule
+func (s *SQLDatabase) CancelSchedule(scheduleID string) (*Schedule, error) {
+	res, err := s.db.Exec(`UPDATE schedules SET status = $1, nextrunat = NULL, updatedat = NOW() WHERE scheduleid = $2 AND status = $3`,
+		ScheduleCancelled, scheduleID, ScheduleActive)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	sc, err := s.GetSchedule(scheduleID)
+	if err != nil {
+		return nil, err
+	}
+
+	if n == 0 {
+		return nil, ErrScheduleNotActive
+	}
+
+	return sc, nil
+}
+
+// RunDueSchedules pays the next occurrence of every schedule that is due and returns how many ran.
+// A schedule that is late by several occurrences catches up one occurrence per call.
+func (s *SQLDatabase) RunDueSchedules() (int, error) {
+	query := "SELECT " + scheduleColumns + " FROM schedules WHERE status = $1 AND nextrunat <= NOW() ORDER BY nextrunat LIMIT 100"
+
+	rows, err := s.db.Query(query, ScheduleActive)
+	if err != nil {
+		return 0, err
+	}
+
+	var due []Schedule
+	for rows.Next() {
+		sc, err := scanSchedule(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, sc)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	ran := 0
+	for _, sc := range due {
+		err := s.runSchedule(sc)
+		if err != nil {
+			log.Error().Err(err).Str("scheduleid", sc.ScheduleID).Msg("scheduled payment could not run")
+			continue
+		}
+		ran++
+	}
+
+	return ran, nil
+}
+
+// runSchedule pays the next occurrence of the schedule through SaveTransaction then records the outcome.
+// Refused payments are recorded as failed runs, other errors leave the occurrence due so that it runs again.
+func (s *SQLDatabase) runSchedule(sc Schedule) error {
+	recurrence, err := ParseRecurrence(sc.Recurrence)
+	if err != nil {
+		return err
+	}
+
+	run := ScheduleRun{
+		Occurrence:  sc.RunCount,
+		ScheduledAt: *sc.NextRunAt,
+		RequestID:   runRequestID(sc.ScheduleID, sc.RunCount),
+	}
+
+	_, err = s.SaveTransaction(Transaction{
+		RequestID:   run.RequestID,
+		SenderID:    sc.SenderID,
+		RecipientID: sc.RecipientID,
+		Message:     sc.Message,
+		Amount:      sc.Amount,
+		Currency:    sc.Currency,
+	})
+
+	// a duplicate is a run that was paid before the service stopped, without its outcome being recorded
+	if err != nil && err != ErrDuplicateRequest && !isRejection(err) {
+		return err
+	}
+
+	t, err := s.GetTransactionByRequestID(run.RequestID)
+	if err != nil {
+		return err
+	}
+
+	run.TransactionID = t.TransactionID
+	run.Status = t.Status
+	run.FailureReason = t.FailureReason
+
+	return s.recordRun(sc, recurrence, run)
+}
+
+// recordRun saves the outcome of the run and moves the schedule to its next occurrence
+func (s *SQLDatabase) recordRun(sc Schedule, recurrence Recurrence, run ScheduleRun) error {
+	status := ScheduleActive
+	var nextRunAt *time.Time
+
+	next, ok := recurrence.Occurrence(sc.StartAt.UTC(), run.Occurrence+1)
+	if ok {
+		nextRunAt = &next
+	} else {
+		status = ScheduleFinished
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT into schedule_runs (scheduleid, occurrence, scheduledat, requestid, transactionid, status, failurereason)
+			  VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+			  ON CONFLICT (scheduleid, occurrence) DO NOTHING`
+
+	_, err = tx.Exec(query, sc.ScheduleID, run.Occurrence, run.ScheduledAt, run.RequestID, run.TransactionID, run.Status,
+		run.FailureReason)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// the run count guards against another worker having already moved the schedule on
+	query = `UPDATE schedules SET runcount = $1 + 1, nextrunat = $2, status = $3, updatedat = NOW()
+			 WHERE scheduleid = $4 AND runcount = $1 AND status = $5`
+
+	_, err = tx.Exec(query, run.Occurrence, nextRunAt, status, sc.ScheduleID, ScheduleActive)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func runRequestID(scheduleID string, occurrence int) string {
+	return uuid.NewV5(scheduleNamespace, scheduleID+"/"+strconv.Itoa(occurrence)).String()
+}
@@ -0,0 +1,156 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSQLDatabase_RunDueSchedules(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	cleanDB(db)
+
+	if err := initBalance("1", 150); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	sc, err := pay.CreateSchedule(CreateSchedule{
+		RequestID:   "schedule-1",
+		SenderID:    "1",
+		RecipientID: "2",
+		Amount:      100,
+		Currency:    "SGD",
+		Recurrence:  "FREQ=DAILY;COUNT=3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replaying the creation returns the same schedule
+	replayed, err := pay.CreateSchedule(CreateSchedule{RequestID: "schedule-1", SenderID: "1", RecipientID: "2", Amount: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replayed.ScheduleID != sc.ScheduleID {
+		t.Fatalf("expected schedule %s, got %s", sc.ScheduleID, replayed.ScheduleID)
+	}
+
+	runSchedules(t, pay, 1)
+	// the next occurrence is tomorrow
+	runSchedules(t, pay, 0)
+	expectBalances(t, pay, 50, 100)
+
+	// the second occurrence was paid but the service stopped before recording the run
+	if _, err := pay.SaveTransaction(Transaction{
+		RequestID: runRequestID(sc.ScheduleID, 1), SenderID: "1", RecipientID: "2", Amount: 50, Currency: "SGD",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	makeDue(t, sc.ScheduleID)
+	runSchedules(t, pay, 1)
+	expectBalances(t, pay, 0, 150)
+
+	// the last occurrence is refused and recorded as failed
+	makeDue(t, sc.ScheduleID)
+	runSchedules(t, pay, 1)
+	expectBalances(t, pay, 0, 150)
+
+	sc, err = pay.GetSchedule(sc.ScheduleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sc.Status != ScheduleFinished || sc.NextRunAt != nil || sc.RunCount != 3 || len(sc.Runs) != 3 {
+		t.Fatalf("expected a finished schedule with 3 runs, got %+v", sc)
+	}
+
+	for i, status := range []string{StatusCompleted, StatusCompleted, StatusFailed} {
+		if sc.Runs[i].Status != status || sc.Runs[i].RequestID != runRequestID(sc.ScheduleID, i) {
+			t.Errorf("run %d: expected %s, got %+v", i, status, sc.Runs[i])
+		}
+	}
+
+	if sc.Runs[2].FailureReason != ErrInsufficientBalance.Error() {
+		t.Errorf("expected the failure reason, got %q", sc.Runs[2].FailureReason)
+	}
+}
+
+func TestSQLDatabase_CancelSchedule(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	cleanDB(db)
+
+	if err := initBalance("1", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := pay.CreateSchedule(CreateSchedule{RequestID: "schedule-0", SenderID: "1", RecipientID: "2", Amount: 10,
+		StartAt: time.Now().Add(-time.Hour)})
+	if err != ErrScheduleInPast {
+		t.Fatalf("expected %v, got %v", ErrScheduleInPast, err)
+	}
+
+	sc, err := pay.CreateSchedule(CreateSchedule{RequestID: "schedule-1", SenderID: "1", RecipientID: "2", Amount: 10,
+		Recurrence: "FREQ=MONTHLY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pay.CancelSchedule(sc.ScheduleID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pay.CancelSchedule(sc.ScheduleID); err != ErrScheduleNotActive {
+		t.Fatalf("expected %v, got %v", ErrScheduleNotActive, err)
+	}
+
+	runSchedules(t, pay, 0)
+	expectBalances(t, pay, 100, 0)
+
+	schedules, err := pay.ListSchedules("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(schedules) != 1 || schedules[0].Status != ScheduleCancelled {
+		t.Fatalf("expected the cancelled schedule, got %+v", schedules)
+	}
+}
+
+func runSchedules(t *testing.T, pay *SQLDatabase, expected int) {
+	n, err := pay.RunDueSchedules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != expected {
+		t.Fatalf("expected %d scheduled payments to run, got %d", expected, n)
+	}
+}
+
+func makeDue(t *testing.T, scheduleID string) {
+	if _, err := db.Exec(`UPDATE schedules SET nextrunat = NOW() WHERE scheduleid = $1`, scheduleID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectBalances(t *testing.T, pay *SQLDatabase, sender, recipient float64) {
+	for userID, expected := range map[string]float64{"1": sender, "2": recipient} {
+		b, err := pay.GetBalance(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b.Amount != expected {
+			t.Errorf("expected balance of user %s to be %v, got %v", userID, expected, b.Amount)
+		}
+	}
+}
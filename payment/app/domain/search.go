@@ -0,0 +1,105 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	searchDefaultLimit = 100
+	searchMaxLimit     = 1000
+)
+
+// TransactionSearch filters the transactions of all users, empty fields do not filter
+type TransactionSearch struct {
+	// UserID matches the transactions the user sent or received
+	UserID      string     `json:"user_id,omitempty"`
+	SenderID    string     `json:"sender_id,omitempty"`
+	RecipientID string     `json:"recipient_id,omitempty"`
+	Kind        string     `json:"kind,omitempty"`
+	Status      string     `json:"status,omitempty"`
+	Currency    string     `json:"currency,omitempty"`
+	From        *time.Time `json:"from,omitempty"`
+	To          *time.Time `json:"to,omitempty"`
+	MinAmount   float64    `json:"min_amount,omitempty"`
+	MaxAmount   float64    `json:"max_amount,omitempty"`
+	Limit       int        `json:"limit,omitempty"`
+}
+
+// SearchTransactions returns the transactions of all users matching the search, newest first.
+// Operators see the data of every user, so each search is written to the audit log.
+func (s *SQLDatabase) SearchTransactions(q TransactionSearch, actor string) ([]Transaction, error) {
+	if q.Limit <= 0 || q.Limit > searchMaxLimit {
+		q.Limit = searchDefaultLimit
+	}
+
+	var conditions []string
+	var args []interface{}
+
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if q.UserID != "" {
+		where("(senderid = $%[1]d OR receiverid = $%[1]d)", q.UserID)
+	}
+	if q.SenderID != "" {
+		where("senderid = $%d", q.SenderID)
+	}
+	if q.RecipientID != "" {
+		where("receiverid = $%d", q.RecipientID)
+	}
+	if q.Kind != "" {
+		where("kind = $%d", q.Kind)
+	}
+	if q.Status != "" {
+		where("status = $%d", q.Status)
+	}
+	if q.Currency != "" {
+		where("currency = $%d", q.Currency)
+	}
+	if q.From != nil {
+		where("createdat >= $%d", *q.From)
+	}
+	if q.To != nil {
+		where("createdat < $%d", *q.To)
+	}
+	if q.MinAmount > 0 {
+		where("amount >= $%d", q.MinAmount)
+	}
+	if q.MaxAmount > 0 {
+		where("amount <= $%d", q.MaxAmount)
+	}
+
+	query := "SELECT " + transactionColumns + " FROM transactions"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	args = append(args, q.Limit)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	err := audit(s.db, actor, AuditTransactionsSearch, q.UserID, q)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	txs := []Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, t)
+	}
+
+	return txs, rows.Err()
+}
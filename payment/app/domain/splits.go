@@ -0,0 +1,347 @@
+package domain
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	SplitEqual  = "equal"
+	SplitShares = "shares"
+	SplitExact  = "exact"
+
+	SplitOpen   = "open"
+	SplitClosed = "closed"
+
+	MaxSplitParticipants = 100
+)
+
+var (
+	ErrSplitNotFound = errors.New("split not found")
+	ErrInvalidSplit  = errors.New("a split needs a method, equal, shares or exact, and distinct participants who each owe at least 0.01")
+	ErrSplitMismatch = errors.New("exact amounts must add up to the total amount")
+)
+
+// splitNamespace derives the request_id of the money request of each participant from the split
+var splitNamespace = uuid.NewV5(uuid.NamespaceURL, "payment/splits")
+
+// Split divides a bill paid by its creator among participants, each of them is sent a money request for their part.
+// The creator may be one of the participants, their part is then already paid.
+type Split struct {
+	SplitID     string      `json:"split_id"`
+	RequestID   string      `json:"request_id"`
+	CreatorID   string      `json:"creator_id"`
+	TotalAmount float64     `json:"total_amount"`
+	Currency    string      `json:"currency"`
+	Message     string      `json:"message"`
+	Method      string      `json:"method"`
+	Status      string      `json:"status"`
+	PaidAmount  float64     `json:"paid_amount"`
+	Parts       []SplitPart `json:"parts"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// SplitPart is what a participant owes, its status is the one of their money request
+type SplitPart struct {
+	UserID         string  `json:"user_id"`
+	Amount         float64 `json:"amount"`
+	Status         string  `json:"status"`
+	MoneyRequestID string  `json:"money_request_id,omitempty"`
+}
+
+type CreateSplit struct {
+	RequestID    string             `json:"request_id"`
+	CreatorID    string             `json:"creator_id"`
+	TotalAmount  float64            `json:"total_amount"`
+	Currency     string             `json:"currency"`
+	Message      string             `json:"message"`
+	Method       string             `json:"method"`
+	Participants []SplitParticipant `json:"participants"`
+	// ExpiresIn is the lifetime of the money requests in seconds, DefaultMoneyRequestDuration when 0
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// SplitParticipant gives the Shares of the participant with the shares method, or their Amount with the exact method
+type SplitParticipant struct {
+	UserID string  `json:"user_id"`
+	Shares int     `json:"shares"`
+	Amount float64 `json:"amount"`
+}
+
+// splitAmounts divides the total in cents. The cents left over by the equal method go to the first participants,
+// with the shares method to the largest remainders, ties going to the first participants.
+func splitAmounts(total float64, method string, participants []SplitParticipant) ([]float64, error) {
+	cents := int64(math.Round(total * 100))
+	parts := make([]int64, len(participants))
+
+	switch method {
+	case SplitEqual:
+		n := int64(len(participants))
+		for i := range parts {
+			parts[i] = cents / n
+			if int64(i) < cents%n {
+				parts[i]++
+			}
+		}
+
+	case SplitShares:
+		var totalShares int64
+		for _, p := range participants {
+			if p.Shares <= 0 {
+				return nil, ErrInvalidSplit
+			}
+			totalShares += int64(p.Shares)
+		}
+
+		remainders := make([]int, len(participants))
+		left := cents
+		for i, p := range participants {
+			parts[i] = cents * int64(p.Shares) / totalShares
+			left -= parts[i]
+			remainders[i] = i
+		}
+
+		sort.SliceStable(remainders, func(a, b int) bool {
+			ra := cents * int64(participants[remainders[a]].Shares) % totalShares
+			rb := cents * int64(participants[remainders[b]].Shares) % totalShares
+			return ra > rb
+		})
+
+		for i := int64(0); i < left; i++ {
+			parts[remainders[i]]++
+		}
+
+	case SplitExact:
+		var sum int64
+		for i, p := range participants {
+			parts[i] = int64(math.Round(p.Amount * 100))
+			sum += parts[i]
+		}
+
+		if sum != cents {
+			return nil, ErrSplitMismatch
+		}
+
+	default:
+		return nil, ErrInvalidSplit
+	}
+
+	amounts := make([]float64, len(parts))
+	for i, part := range parts {
+		if part <= 0 {
+			return nil, ErrInvalidSplit
+		}
+		amounts[i] = float64(part) / 100
+	}
+
+	return amounts, nil
+}
+
+// CreateSplit divides the bill and sends a money request to each participant. It is idempotent on the request_id,
+// the money requests that are missing after an interruption are sent again.
+func (s *SQLDatabase) CreateSplit(c CreateSplit) (*Split, error) {
+	var splitID string
+
+	err := s.db.QueryRow("SELECT splitid FROM splits WHERE requestid = $1", c.RequestID).Scan(&splitID)
+	if err == sql.ErrNoRows {
+		splitID, err = s.insertSplit(c)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	split, err := s.GetSplit(splitID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range split.Parts {
+		if part.UserID == split.CreatorID || part.MoneyRequestID != "" {
+			continue
+		}
+
+		m, err := s.CreateMoneyRequest(CreateMoneyRequest{
+			RequestID:   uuid.NewV5(splitNamespace, splitID+"/"+part.UserID).String(),
+			RequesterID: split.CreatorID,
+			PayerID:     part.UserID,
+			Amount:      part.Amount,
+			Currency:    split.Currency,
+			Message:     split.Message,
+			ExpiresIn:   c.ExpiresIn,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.linkSplitPart(splitID, part.UserID, m.MoneyRequestID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.GetSplit(splitID)
+}
+
+func (s *SQLDatabase) insertSplit(c CreateSplit) (string, error) {
+	if len(c.Participants) == 0 || len(c.Participants) > MaxSplitParticipants {
+		return "", ErrInvalidSplit
+	}
+
+	seen := map[string]bool{}
+	for _, p := range c.Participants {
+		if seen[p.UserID] {
+			return "", ErrInvalidSplit
+		}
+		seen[p.UserID] = true
+
+		if _, err := s.GetBalance(p.UserID); err != nil {
+			return "", err
+		}
+	}
+
+	// the creator alone cannot split a bill
+	if len(c.Participants) == 1 && seen[c.CreatorID] {
+		return "", ErrInvalidSplit
+	}
+
+	if _, err := s.GetBalance(c.CreatorID); err != nil {
+		return "", err
+	}
+
+	amounts, err := splitAmounts(c.TotalAmount, c.Method, c.Participants)
+	if err != nil {
+		return "", err
+	}
+
+	splitID := uuid.NewV4().String()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := tx.Exec(`INSERT into splits (splitid, requestid, creatorid, totalamount, currency, message, method, status)
+						 VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (requestid) DO NOTHING`,
+		splitID, c.RequestID, c.CreatorID, c.TotalAmount, c.Currency, c.Message, c.Method, SplitOpen)
+	if err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	// the same split was created concurrently
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		tx.Rollback()
+		if err != nil {
+			return "", err
+		}
+		return splitID, s.db.QueryRow("SELECT splitid FROM splits WHERE requestid = $1", c.RequestID).Scan(&splitID)
+	}
+
+	for i, p := range c.Participants {
+		_, err := tx.Exec(`INSERT into split_parts (splitid, idx, userid, amount) VALUES ($1, $2, $3, $4)`,
+			splitID, i, p.UserID, amounts[i])
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
+	return splitID, tx.Commit()
+}
+
+func (s *SQLDatabase) linkSplitPart(splitID, userID, moneyRequestID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE split_parts SET moneyrequestid = $1 WHERE splitid = $2 AND userid = $3`, moneyRequestID, splitID, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`UPDATE money_requests SET splitid = $1 WHERE moneyrequestid = $2`, splitID, moneyRequestID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// closeSplit closes the split of the money request once all its money requests are paid.
+// It runs in the SQL transaction that marks the money request as paid.
+func closeSplit(tx *sql.Tx, moneyRequestID string) error {
+	query := `UPDATE splits SET status = $1, updatedat = NOW()
+			  WHERE splitid = (SELECT splitid FROM money_requests WHERE moneyrequestid = $2) AND status = $3
+			  AND NOT EXISTS (
+				SELECT 1 FROM split_parts p LEFT JOIN money_requests m ON m.moneyrequestid = p.moneyrequestid
+				WHERE p.splitid = splits.splitid AND p.userid <> splits.creatorid AND COALESCE(m.status, '') <> $4
+			  )`
+
+	_, err := tx.Exec(query, SplitClosed, moneyRequestID, SplitOpen, MoneyRequestPaid)
+	return err
+}
+
+// GetSplit returns the split with the settlement of each part
+func (s *SQLDatabase) GetSplit(splitID string) (*Split, error) {
+	split := Split{}
+
+	query := `SELECT splitid, requestid, creatorid, totalamount, currency, COALESCE(message, ''), method, status, createdat
+			  FROM splits WHERE splitid = $1`
+
+	err := s.db.QueryRow(query, splitID).Scan(&split.SplitID, &split.RequestID, &split.CreatorID, &split.TotalAmount,
+		&split.Currency, &split.Message, &split.Method, &split.Status, &split.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrSplitNotFound
+	}
+
+	if err != nil {
+		log.Error().Err(err)
+		return nil, err
+	}
+
+	query = `SELECT p.userid, p.amount, COALESCE(p.moneyrequestid, ''),
+			 CASE WHEN p.userid = $2 THEN $3
+				  WHEN m.id IS NULL THEN $4
+				  WHEN m.status = $4 AND m.expiresat <= NOW() THEN $5
+				  ELSE m.status END
+			 FROM split_parts p LEFT JOIN money_requests m ON m.moneyrequestid = p.moneyrequestid
+			 WHERE p.splitid = $1 ORDER BY p.idx`
+
+	rows, err := s.db.Query(query, splitID, split.CreatorID, MoneyRequestPaid, MoneyRequestPending, MoneyRequestExpired)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		part := SplitPart{}
+		err := rows.Scan(&part.UserID, &part.Amount, &part.MoneyRequestID, &part.Status)
+		if err != nil {
+			return nil, err
+		}
+
+		if part.Status == MoneyRequestPaid {
+			split.PaidAmount += part.Amount
+		}
+
+		split.Parts = append(split.Parts, part)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	split.PaidAmount = math.Round(split.PaidAmount*100) / 100
+
+	return &split, nil
+}
@@ -0,0 +1,180 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitAmounts(t *testing.T) {
+	three := []SplitParticipant{{UserID: "1"}, {UserID: "2"}, {UserID: "3"}}
+
+	tests := []struct {
+		name         string
+		total        float64
+		method       string
+		participants []SplitParticipant
+		expected     []float64
+		expectErr    error
+	}{
+		{
+			name:         "equal with leftover cents going to the first participants",
+			total:        100,
+			method:       SplitEqual,
+			participants: three,
+			expected:     []float64{33.34, 33.33, 33.33},
+		},
+		{
+			name:         "equal with two leftover cents",
+			total:        0.05,
+			method:       SplitEqual,
+			participants: three,
+			expected:     []float64{0.02, 0.02, 0.01},
+		},
+		{
+			name:   "shares with leftover cents going to the largest remainders",
+			total:  10,
+			method: SplitShares,
+			participants: []SplitParticipant{
+				{UserID: "1", Shares: 1},
+				{UserID: "2", Shares: 2},
+			},
+			expected: []float64{3.33, 6.67},
+		},
+		{
+			name:   "shares with tied remainders going to the first participants",
+			total:  10,
+			method: SplitShares,
+			participants: []SplitParticipant{
+				{UserID: "1", Shares: 1},
+				{UserID: "2", Shares: 1},
+				{UserID: "3", Shares: 4},
+			},
+			expected: []float64{1.67, 1.67, 6.66},
+		},
+		{
+			name:   "exact",
+			total:  12.5,
+			method: SplitExact,
+			participants: []SplitParticipant{
+				{UserID: "1", Amount: 10},
+				{UserID: "2", Amount: 2.5},
+			},
+			expected: []float64{10, 2.5},
+		},
+		{
+			name:   "exact amounts not adding up",
+			total:  12.5,
+			method: SplitExact,
+			participants: []SplitParticipant{
+				{UserID: "1", Amount: 10},
+				{UserID: "2", Amount: 2.49},
+			},
+			expectErr: ErrSplitMismatch,
+		},
+		{
+			name:         "parts under a cent",
+			total:        0.02,
+			method:       SplitEqual,
+			participants: three,
+			expectErr:    ErrInvalidSplit,
+		},
+		{
+			name:         "missing shares",
+			total:        10,
+			method:       SplitShares,
+			participants: three,
+			expectErr:    ErrInvalidSplit,
+		},
+		{
+			name:         "unknown method",
+			total:        10,
+			method:       "fair",
+			participants: three,
+			expectErr:    ErrInvalidSplit,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			amounts, err := splitAmounts(test.total, test.method, test.participants)
+			if err != test.expectErr {
+				t.Fatalf("expected %v, got %v", test.expectErr, err)
+			}
+
+			if !reflect.DeepEqual(amounts, test.expected) && test.expectErr == nil {
+				t.Errorf("expected %v, got %v", test.expected, amounts)
+			}
+		})
+	}
+}
+
+func TestSQLDatabase_CreateSplit(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	cleanDB(db)
+
+	for userID, amount := range map[string]float64{"1": 0, "2": 50, "3": 50} {
+		if err := initBalance(userID, amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := CreateSplit{
+		RequestID:    "split-1",
+		CreatorID:    "1",
+		TotalAmount:  90,
+		Currency:     "SGD",
+		Message:      "dinner",
+		Method:       SplitEqual,
+		Participants: []SplitParticipant{{UserID: "1"}, {UserID: "2"}, {UserID: "3"}},
+	}
+
+	split, err := pay.CreateSplit(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if split.Status != SplitOpen || split.PaidAmount != 30 || len(split.Parts) != 3 {
+		t.Fatalf("expected an open split with the part of the creator paid, got %+v", split)
+	}
+
+	if split.Parts[0].MoneyRequestID != "" || split.Parts[1].MoneyRequestID == "" || split.Parts[2].MoneyRequestID == "" {
+		t.Fatalf("expected a money request for each participant but the creator, got %+v", split.Parts)
+	}
+
+	replayed, err := pay.CreateSplit(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(replayed.Parts, split.Parts) {
+		t.Fatalf("expected the same split, got %+v", replayed)
+	}
+
+	if _, err := pay.AcceptMoneyRequest(split.Parts[1].MoneyRequestID); err != nil {
+		t.Fatal(err)
+	}
+
+	split, err = pay.GetSplit(split.SplitID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if split.Status != SplitOpen || split.PaidAmount != 60 {
+		t.Fatalf("expected an open split with 60 paid, got %+v", split)
+	}
+
+	if _, err := pay.AcceptMoneyRequest(split.Parts[2].MoneyRequestID); err != nil {
+		t.Fatal(err)
+	}
+
+	split, err = pay.GetSplit(split.SplitID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if split.Status != SplitClosed || split.PaidAmount != 90 {
+		t.Fatalf("expected a closed split, got %+v", split)
+	}
+
+	expectBalances(t, pay, 60, 20)
+}
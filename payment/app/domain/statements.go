@@ -0,0 +1,152 @@
+package domain
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"time"
+)
+
+// statementCurrency is the currency of statements of users without transactions, balances are in a single currency
+const statementCurrency = "SGD"
+
+var ErrInvalidPeriod = errors.New("from must be before to")
+
+type GetStatement struct {
+	UserID string
+	From   time.Time
+	To     time.Time
+}
+
+// Statement is the period a statement covers and the balance of the user at its start and end
+type Statement struct {
+	UserID         string    `json:"user_id"`
+	Currency       string    `json:"currency"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	OpeningBalance float64   `json:"opening_balance"`
+	ClosingBalance float64   `json:"closing_balance"`
+}
+
+// StatementLine is a transaction that moved money in or out of the balance, Amount is negative when money went out.
+// Balance is the balance once the transaction was written.
+type StatementLine struct {
+	TransactionID string    `json:"transaction_id"`
+	Date          time.Time `json:"date"`
+	Kind          string    `json:"kind"`
+	Counterparty  string    `json:"counterparty"`
+	Description   string    `json:"description"`
+	Amount        float64   `json:"amount"`
+	Currency      string    `json:"currency"`
+	Balance       float64   `json:"balance"`
+}
+
+// StatementWriter writes a statement in a format, the lines are given one at a time as they are read
+type StatementWriter interface {
+	Begin(s Statement) error
+	Line(l StatementLine) error
+	End(s Statement) error
+}
+
+// movedMoney is the condition of the transactions that changed balances, pending and failed ones did not
+const movedMoney = "status IN ('" + StatusCompleted + "', '" + StatusReversed + "')"
+
+// WriteStatement writes the statement of the user over the period, from included and to excluded, of the settlement
+// of the transactions. The lines are read from the transactions of the user and written as they are read, so long
+// periods are not held in memory.
+// The balances are derived from the current balance, read in the same snapshot as the transactions.
+func (s *SQLDatabase) WriteStatement(ctx context.Context, g GetStatement, w StatementWriter) error {
+	if !g.From.Before(g.To) {
+		return ErrInvalidPeriod
+	}
+
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	balance, err := getBalance(tx, g.UserID)
+	if err != nil {
+		return err
+	}
+
+	// what moved since the start of the period is taken back from the current balance
+	var since float64
+	query := `SELECT COALESCE(SUM(CASE WHEN receiverid = $1 THEN amount ELSE -amount END), 0) FROM transactions
+			  WHERE (senderid = $1 OR receiverid = $1) AND ` + movedMoney + ` AND settledat >= $2`
+
+	err = tx.QueryRowContext(ctx, query, g.UserID, g.From).Scan(&since)
+	if err != nil {
+		return err
+	}
+
+	statement := Statement{
+		UserID:         g.UserID,
+		Currency:       statementCurrency,
+		From:           g.From,
+		To:             g.To,
+		OpeningBalance: roundCents(balance.Amount - since),
+	}
+
+	err = tx.QueryRowContext(ctx, `SELECT currency FROM transactions WHERE senderid = $1 OR receiverid = $1
+								   ORDER BY id DESC LIMIT 1`, g.UserID).Scan(&statement.Currency)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	err = w.Begin(statement)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, userTransactionsSQL+" AND "+movedMoney+" AND settledat >= $2 AND settledat < $3 ORDER BY settledat, id",
+		g.UserID, g.From, g.To)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	running := statement.OpeningBalance
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return err
+		}
+
+		line := StatementLine{
+			TransactionID: t.TransactionID,
+			Date:          *t.SettledAt,
+			Kind:          t.Kind,
+			Counterparty:  t.SenderID,
+			Description:   t.Message,
+			Amount:        t.Amount,
+			Currency:      t.Currency,
+		}
+
+		if t.SenderID == g.UserID {
+			line.Counterparty = t.RecipientID
+			line.Amount = -t.Amount
+		}
+
+		running = roundCents(running + line.Amount)
+		line.Balance = running
+
+		err = w.Line(line)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	statement.ClosingBalance = running
+	return w.End(statement)
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,143 @@
+package domain
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// memoryStatement keeps what it is given, for tests
+type memoryStatement struct {
+	begin, end Statement
+	lines      []StatementLine
+}
+
+func (m *memoryStatement) Begin(s Statement) error {
+	m.begin = s
+	return nil
+}
+
+func (m *memoryStatement) Line(l StatementLine) error {
+	m.lines = append(m.lines, l)
+	return nil
+}
+
+func (m *memoryStatement) End(s Statement) error {
+	m.end = s
+	return nil
+}
+
+func TestSQLDatabase_WriteStatement(t *testing.T) {
+	cleanDB(db)
+	pay := NewSQLDatabase(db)
+
+	if err := initBalance("1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []Transaction{
+		{RequestID: "a", SenderID: "1", RecipientID: "2", Amount: 10, Currency: "SGD"},
+		{RequestID: "b", SenderID: "2", RecipientID: "1", Amount: 4, Currency: "SGD"},
+		{RequestID: "c", SenderID: "1", RecipientID: "2", Amount: 1000, Currency: "SGD"},
+		{RequestID: "d", SenderID: "1", RecipientID: "2", Amount: 20, Currency: "SGD"},
+	} {
+		_, _ = pay.SaveTransaction(p)
+	}
+
+	// a is before the statement and d after it
+	_, err := db.Exec(`UPDATE transactions SET createdat = CASE requestid WHEN 'a' THEN NOW() - INTERVAL '2 day'
+					   WHEN 'd' THEN NOW() + INTERVAL '2 day' ELSE createdat END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec(`UPDATE transactions SET settledat = CASE requestid WHEN 'a' THEN NOW() - INTERVAL '2 day'
+					  WHEN 'd' THEN NOW() + INTERVAL '2 day' ELSE settledat END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &memoryStatement{}
+	err = pay.WriteStatement(context.Background(), GetStatement{UserID: "1", From: time.Now().Add(-24 * time.Hour),
+		To: time.Now().Add(24 * time.Hour)}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the failed payment c did not move money
+	if len(m.lines) != 1 || m.lines[0].Amount != 4 || m.lines[0].Counterparty != "2" || m.lines[0].Balance != 94 {
+		t.Errorf("expected the payment received from 2 to take the balance to 94, got %+v", m.lines)
+	}
+
+	if m.begin.OpeningBalance != 90 || m.end.ClosingBalance != 94 {
+		t.Errorf("expected balances from 90 to 94, got %v to %v", m.begin.OpeningBalance, m.end.ClosingBalance)
+	}
+
+	err = pay.WriteStatement(context.Background(), GetStatement{UserID: "1", From: time.Now(), To: time.Now().Add(-time.Hour)}, m)
+	if err != ErrInvalidPeriod {
+		t.Errorf("expected %v, got %v", ErrInvalidPeriod, err)
+	}
+}
+
+func TestSQLDatabase_WriteStatementReleased(t *testing.T) {
+	cleanDB(db)
+	pay := NewSQLDatabase(db)
+
+	engine, err := NewRuleEngine(RiskConfig{Rules: []RiskRule{{Name: "large", Type: RuleAmount, Action: RiskReview, MinAmount: 50}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pay.SetRiskEvaluator(engine)
+
+	if err := initBalance("1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	txID, err := pay.SaveTransaction(Transaction{RequestID: "review", SenderID: "1", RecipientID: "2", Amount: 60, Currency: "SGD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the payment was made two days ago and released now, after the end of the first statement
+	_, err = db.Exec("UPDATE transactions SET createdat = NOW() - INTERVAL '2 day' WHERE transactionid = $1", *txID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pay.ReleaseTransaction(*txID); err != nil {
+		t.Fatal(err)
+	}
+
+	before := &memoryStatement{}
+	err = pay.WriteStatement(context.Background(), GetStatement{UserID: "1", From: time.Now().Add(-72 * time.Hour),
+		To: time.Now().Add(-24 * time.Hour)}, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(before.lines) != 0 || before.begin.OpeningBalance != 100 || before.end.ClosingBalance != 100 {
+		t.Errorf("expected no line and a balance of 100 before the release, got %+v from %v to %v", before.lines,
+			before.begin.OpeningBalance, before.end.ClosingBalance)
+	}
+
+	after := &memoryStatement{}
+	err = pay.WriteStatement(context.Background(), GetStatement{UserID: "1", From: time.Now().Add(-24 * time.Hour),
+		To: time.Now().Add(24 * time.Hour)}, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(after.lines) != 1 || after.lines[0].Amount != -60 || time.Since(after.lines[0].Date) > time.Hour {
+		t.Errorf("expected the payment dated when it was released, got %+v", after.lines)
+	}
+
+	if after.begin.OpeningBalance != 100 || after.end.ClosingBalance != 40 {
+		t.Errorf("expected balances from 100 to 40, got %v to %v", after.begin.OpeningBalance, after.end.ClosingBalance)
+	}
+}
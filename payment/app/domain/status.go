@@ -0,0 +1,91 @@
+package domain
+
+import (
+	"database/sql"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+// A transaction is pending while it waits for an asynchronous decision, completed once the money moved,
+// failed when it was refused and reversed once it has been fully refunded
+const (
+	StatusPending   = "pending"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusReversed  = "reversed"
+)
+
+// isRejection reports whether the transfer was refused because of the request itself rather than a system failure
+func isRejection(err error) bool {
+	switch err.(type) {
+	case *LimitError, *RiskError:
+		return true
+	}
+
+	switch err {
+	case ErrNegativeAmount, ErrInsufficientBalance, ErrAccountNotFound, ErrAccountFrozen, ErrAccountClosed,
+		ErrAccountReceiveOnly, ErrRecipientUnavailable:
+		return true
+	}
+	return false
+}
+
+// recordFailure saves a refused transaction so that clients can find out what happened to their request
+func (s *SQLDatabase) recordFailure(t Transaction, reason error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Error().Err(err).Msg("could not record failed transaction")
+		return
+	}
+
+	t.Status = StatusFailed
+	t.FailureReason = reason.Error()
+
+	txID := uuid.NewV4().String()
+
+	err = saveTransaction(tx, t, txID)
+	if err == ErrDuplicateRequest {
+		return
+	}
+
+	if err == nil {
+		err = writeEvent(tx, EventPaymentFailed, txID)
+	}
+
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("requestid", t.RequestID).Msg("could not record failed transaction")
+	}
+}
+
+// GetTransactionByRequestID lets clients find out what happened to a request, e.g. after a timeout
+func (s *SQLDatabase) GetTransactionByRequestID(requestID string) (*Transaction, error) {
+	query := "SELECT " + transactionColumns + " FROM transactions WHERE requestid = $1"
+
+	t, err := scanTransaction(s.db.QueryRow(query, requestID))
+	if err == sql.ErrNoRows {
+		return nil, ErrTransactionNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// markReversed sets the payment as reversed once its refunds add up to its amount
+func markReversed(tx *sql.Tx, transactionID string) error {
+	query := `UPDATE transactions SET status = $1 WHERE transactionid = $2 AND status = $3 AND amount - 0.005 <= (
+				SELECT COALESCE(SUM(amount), 0) FROM transactions WHERE originaltransactionid = $2 AND kind = $4 AND status = $3
+			  )`
+
+	_, err := tx.Exec(query, StatusReversed, transactionID, StatusCompleted, KindRefund)
+	return err
+}
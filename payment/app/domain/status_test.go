@@ -0,0 +1,90 @@
+package domain
+
+import (
+	"testing"
+)
+
+func TestSQLDatabase_TransactionStatus(t *testing.T) {
+	pay := NewSQLDatabase(db)
+	cleanDB(db)
+
+	if err := initBalance("1", 50); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	payment := Transaction{RequestID: "pay-1", SenderID: "1", RecipientID: "2", Amount: 80, Currency: "SGD"}
+
+	_, err := pay.SaveTransaction(payment)
+	if err != ErrInsufficientBalance {
+		t.Fatalf("expected %v, got %v", ErrInsufficientBalance, err)
+	}
+
+	failed, err := pay.GetTransactionByRequestID("pay-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed.Status != StatusFailed || failed.FailureReason != ErrInsufficientBalance.Error() {
+		t.Fatalf("expected a failed transaction with a reason, got %+v", failed)
+	}
+
+	if _, err := pay.Refund(RefundRequest{RequestID: "refund-0", TransactionID: failed.TransactionID}); err != ErrNotRefundable {
+		t.Fatalf("expected %v, got %v", ErrNotRefundable, err)
+	}
+
+	// the same request can be retried once the reason of the failure is gone, the outcome sent along is ignored
+	payment.Amount = 50
+	payment.FailureReason = "sent by the client"
+	payment.RiskReasons = "sent by the client"
+
+	txID, err := pay.SaveTransaction(payment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	completed, err := pay.GetTransaction(*txID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if completed.Status != StatusCompleted || completed.FailureReason != "" || completed.RiskReasons != "" ||
+		completed.RequestID != "pay-1" {
+		t.Fatalf("expected the retry to complete, got %+v", completed)
+	}
+
+	if _, err := pay.SaveTransaction(payment); err != ErrDuplicateRequest {
+		t.Fatalf("expected %v, got %v", ErrDuplicateRequest, err)
+	}
+
+	if _, err := pay.Refund(RefundRequest{RequestID: "refund-1", TransactionID: *txID, Amount: 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := transactionStatus(t, pay, *txID); status != StatusCompleted {
+		t.Fatalf("expected a partially refunded payment to stay %s, got %s", StatusCompleted, status)
+	}
+
+	if _, err := pay.Refund(RefundRequest{RequestID: "refund-2", TransactionID: *txID}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := transactionStatus(t, pay, *txID); status != StatusReversed {
+		t.Fatalf("expected a fully refunded payment to be %s, got %s", StatusReversed, status)
+	}
+
+	if _, err := pay.GetTransactionByRequestID("unknown"); err != ErrTransactionNotFound {
+		t.Fatalf("expected %v, got %v", ErrTransactionNotFound, err)
+	}
+}
+
+func transactionStatus(t *testing.T, pay *SQLDatabase, txID string) string {
+	tx, err := pay.GetTransaction(txID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx.Status
+}
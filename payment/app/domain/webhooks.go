@@ -0,0 +1,652 @@
+package domain
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	WebhookActive  = "active"
+	WebhookDeleted = "deleted"
+
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryDead deliveries failed too many times, they are only sent again when replayed
+	DeliveryDead = "dead"
+
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookEventIDHeader   = "X-Webhook-Event-Id"
+	WebhookEventTypeHeader = "X-Webhook-Event-Type"
+
+	webhookBatchSize = 20
+	// webhookLease is how long a delivery being sent is kept from other workers on top of the time the worker may take
+	// to send all the deliveries it claimed before it
+	webhookLease = time.Minute
+	// webhookResponseSize is how much of the response of the subscriber is kept
+	webhookResponseSize = 1024
+	webhookMaxBackoff   = 6 * time.Hour
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook subscription not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidWebhook   = errors.New("url must be an absolute http or https URL of a public host and event_types known event types")
+
+	errBlockedAddress = errors.New("webhook address is not public")
+)
+
+// nonPublicNetworks are the networks webhooks are never sent to, on top of the loopback, link-local, multicast
+// and unspecified addresses: deliveries are made from inside our network and their responses can be read back
+var nonPublicNetworks = parseCIDRs("0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.0.0.0/24",
+	"192.168.0.0/16", "198.18.0.0/15", "240.0.0.0/4", "fc00::/7")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// publicHost refuses the hosts that can only be those of our network: private addresses and names without a dot,
+// such as those of our services. Names are resolved again when a delivery is sent, see NewWebhookClient.
+func publicHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return publicIP(ip)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.Contains(host, ".") {
+		return false
+	}
+
+	for _, suffix := range []string{".localhost", ".local", ".internal"} {
+		if strings.HasSuffix(host, suffix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewWebhookClient returns the client deliveries are sent with. It refuses to connect to an address that is not
+// public, whatever the URL of the subscription resolves to when it is sent, and does not follow redirects.
+func NewWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// the address is the resolved one, so a name changed to point inside our network after it was checked is refused
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return errBlockedAddress
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		// no proxy, it would connect to the subscriber on our behalf
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// WebhooksConfig sets how deliveries are retried, zero values get the defaults
+type WebhooksConfig struct {
+	// RetryBase is the wait after the first failed attempt, doubled after each of the next ones
+	RetryBase   time.Duration `json:"retry_base" yaml:"retry_base"`
+	MaxAttempts int           `json:"max_attempts" yaml:"max_attempts"`
+	// Interval is how often the deliveries that are due are sent
+	Interval time.Duration `json:"interval"`
+}
+
+// WebhookSubscription sends the events of a user to a URL. The secret signs the deliveries,
+// it is only returned when the subscription is created.
+type WebhookSubscription struct {
+	SubscriptionID string    `json:"subscription_id"`
+	UserID         string    `json:"user_id"`
+	URL            string    `json:"url"`
+	Secret         string    `json:"secret,omitempty"`
+	EventTypes     []string  `json:"event_types"`
+	Status         string    `json:"status"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+type CreateWebhookSubscription struct {
+	UserID     string   `json:"user_id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// WebhookDelivery is an event sent to a subscription, along with what happened each time it was sent
+type WebhookDelivery struct {
+	DeliveryID     string           `json:"delivery_id"`
+	SubscriptionID string           `json:"subscription_id"`
+	UserID         string           `json:"user_id"`
+	EventID        string           `json:"event_id"`
+	EventType      string           `json:"event_type"`
+	Status         string           `json:"status"`
+	AttemptCount   int              `json:"attempt_count"`
+	NextAttemptAt  *time.Time       `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	UpdatedAt      time.Time        `json:"updated_at"`
+	Attempts       []WebhookAttempt `json:"attempts,omitempty"`
+}
+
+// WebhookAttempt is the response of the subscriber to a delivery, or the error that kept it from responding
+type WebhookAttempt struct {
+	StatusCode int       `json:"status_code,omitempty"`
+	Response   string    `json:"response,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type ListWebhookDeliveries struct {
+	UserID string
+	Status string
+}
+
+// SetWebhooks sets how deliveries are retried
+func (s *SQLDatabase) SetWebhooks(c WebhooksConfig) {
+	if c.RetryBase <= 0 {
+		c.RetryBase = 30 * time.Second
+	}
+
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = 8
+	}
+
+	s.webhooks = c
+}
+
+// webhookBackoff is the wait before the next attempt once a delivery failed the given number of times
+func webhookBackoff(base time.Duration, failures int) time.Duration {
+	wait := base
+	for i := 1; i < failures && wait < webhookMaxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > webhookMaxBackoff {
+		wait = webhookMaxBackoff
+	}
+	return wait
+}
+
+// SignWebhook returns the signature of a delivery: the hex encoded HMAC-SHA256 of the timestamp and body
+// separated by a dot, so that subscribers can check the delivery comes from us and is recent
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func validWebhook(c CreateWebhookSubscription) bool {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(c.URL) > 512 {
+		return false
+	}
+
+	if !publicHost(u.Hostname()) {
+		return false
+	}
+
+	if len(c.EventTypes) == 0 {
+		return false
+	}
+
+	for _, t := range c.EventTypes {
+		if t != EventPaymentCompleted && t != EventPaymentFailed {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *SQLDatabase) CreateWebhookSubscription(c CreateWebhookSubscription) (*WebhookSubscription, error) {
+	if !validWebhook(c) {
+		return nil, ErrInvalidWebhook
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	subscriptionID := uuid.NewV4().String()
+
+	query := `INSERT into webhook_subscriptions (subscriptionid, userid, url, secret, eventtypes, status)
+			  VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err := s.db.Exec(query, subscriptionID, c.UserID, c.URL, secret, strings.Join(c.EventTypes, ","), WebhookActive)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := s.GetWebhookSubscription(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	w.Secret = secret
+	return w, nil
+}
+
+const webhookColumns = `subscriptionid, userid, url, eventtypes, status, createdat`
+
+func scanWebhook(row scanner) (WebhookSubscription, error) {
+	w := WebhookSubscription{}
+	var eventTypes string
+
+	err := row.Scan(&w.SubscriptionID, &w.UserID, &w.URL, &eventTypes, &w.Status, &w.CreatedAt)
+	w.EventTypes = strings.Split(eventTypes, ",")
+	return w, err
+}
+
+func (s *SQLDatabase) GetWebhookSubscription(subscriptionID string) (*WebhookSubscription, error) {
+	query := "SELECT " + webhookColumns + " FROM webhook_subscriptions WHERE subscriptionid = $1"
+
+	w, err := scanWebhook(s.db.QueryRow(query, subscriptionID))
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+// ListWebhookSubscriptions returns the active subscriptions of the user
+func (s *SQLDatabase) ListWebhookSubscriptions(userID string) ([]WebhookSubscription, error) {
+	query := "SELECT " + webhookColumns + " FROM webhook_subscriptions WHERE userid = $1 AND status = $2 ORDER BY id"
+
+	rows, err := s.db.Query(query, userID, WebhookActive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []WebhookSubscription{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhookSubscription stops the deliveries to the subscription, those not delivered yet are not sent
+func (s *SQLDatabase) DeleteWebhookSubscription(subscriptionID string) (*WebhookSubscription, error) {
+	query := `UPDATE webhook_subscriptions SET status = $1 WHERE subscriptionid = $2`
+
+	_, err := s.db.Exec(query, WebhookDeleted, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetWebhookSubscription(subscriptionID)
+}
+
+// WebhookPublisher turns the events it is given into deliveries to the subscriptions of the sender and recipient
+func (s *SQLDatabase) WebhookPublisher() Publisher {
+	return webhookPublisher{s}
+}
+
+type webhookPublisher struct {
+	s *SQLDatabase
+}
+
+func (p webhookPublisher) Publish(e Event) error {
+	query := "SELECT " + webhookColumns + " FROM webhook_subscriptions WHERE userid IN ($1, $2) AND status = $3"
+
+	rows, err := p.s.db.Query(query, e.Transaction.SenderID, e.Transaction.RecipientID, WebhookActive)
+	if err != nil {
+		return err
+	}
+
+	var subscriptions []WebhookSubscription
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		subscriptions = append(subscriptions, w)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	for _, w := range subscriptions {
+		if !contains(w.EventTypes, e.Type) {
+			continue
+		}
+
+		// events are published at least once, an event is only delivered once to each subscription
+		query := `INSERT into webhook_deliveries (deliveryid, subscriptionid, eventid, eventtype, payload, status, nextattemptat)
+				  VALUES ($1, $2, $3, $4, $5, $6, NOW()) ON CONFLICT (subscriptionid, eventid) DO NOTHING`
+
+		_, err := p.s.db.Exec(query, uuid.NewV4().String(), w.SubscriptionID, e.EventID, e.Type, payload, DeliveryPending)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// dueDelivery is a delivery claimed by a worker, along with where it goes
+type dueDelivery struct {
+	deliveryID string
+	// leaseID tells whether the delivery is still leased by the worker, once the lease expired another worker may send it
+	leaseID   string
+	eventID   string
+	eventType string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// DeliverWebhooks sends the deliveries that are due and returns how many were sent. Failed deliveries are retried
+// with an exponential backoff and dead-lettered after too many attempts.
+func (s *SQLDatabase) DeliverWebhooks(client *http.Client) (int, error) {
+	// the deliveries are leased, so that workers do not send them twice and a crashed worker's are sent later.
+	// They are sent one after the other, the lease covers each of them taking as long as the client allows.
+	lease := webhookLease + webhookBatchSize*client.Timeout
+	leaseID := uuid.NewV4().String()
+
+	query := `UPDATE webhook_deliveries d SET nextattemptat = NOW() + $1::float8 * INTERVAL '1 second', leaseid = $5,
+			  updatedat = NOW()
+			  FROM webhook_subscriptions w
+			  WHERE w.subscriptionid = d.subscriptionid AND d.deliveryid IN (
+				SELECT deliveryid FROM webhook_deliveries
+				WHERE status = $2 AND nextattemptat <= NOW()
+				ORDER BY nextattemptat LIMIT $3 FOR UPDATE SKIP LOCKED
+			  ) AND w.status = $4
+			  RETURNING d.deliveryid, d.eventid, d.eventtype, d.payload, d.attempts, w.url, w.secret`
+
+	rows, err := s.db.Query(query, lease.Seconds(), DeliveryPending, webhookBatchSize, WebhookActive, leaseID)
+	if err != nil {
+		return 0, err
+	}
+
+	var due []dueDelivery
+	for rows.Next() {
+		d := dueDelivery{leaseID: leaseID}
+		if err := rows.Scan(&d.deliveryID, &d.eventID, &d.eventType, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, d := range due {
+		attempt := send(client, d)
+
+		err := s.recordAttempt(d, attempt)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(due), nil
+}
+
+func send(client *http.Client, d dueDelivery) WebhookAttempt {
+	start := time.Now()
+	attempt := WebhookAttempt{}
+
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventIDHeader, d.eventID)
+	req.Header.Set(WebhookEventTypeHeader, d.eventType)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(d.secret, timestamp, d.payload))
+
+	resp, err := client.Do(req)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, webhookResponseSize))
+
+	attempt.StatusCode = resp.StatusCode
+	attempt.Response = strings.ToValidUTF8(string(body), "")
+	return attempt
+}
+
+// recordAttempt records the attempt and schedules the next one, unless the lease of the delivery expired and another
+// worker claimed it, which then records its own attempt
+func (s *SQLDatabase) recordAttempt(d dueDelivery, a WebhookAttempt) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status := DeliveryPending
+	var next *time.Duration
+
+	switch {
+	case a.StatusCode >= 200 && a.StatusCode < 300:
+		status = DeliveryDelivered
+	case d.attempts+1 >= s.webhooks.MaxAttempts:
+		status = DeliveryDead
+	default:
+		wait := webhookBackoff(s.webhooks.RetryBase, d.attempts+1)
+		next = &wait
+	}
+
+	var nextSeconds *float64
+	if next != nil {
+		seconds := next.Seconds()
+		nextSeconds = &seconds
+	}
+
+	query := `UPDATE webhook_deliveries SET status = $1, attempts = attempts + 1, leaseid = NULL,
+			  nextattemptat = NOW() + $2::float8 * INTERVAL '1 second', updatedat = NOW()
+			  WHERE deliveryid = $3 AND leaseid = $4`
+
+	res, err := tx.Exec(query, status, nextSeconds, d.deliveryID, d.leaseID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			log.Warn().Str("deliveryid", d.deliveryID).Msg("webhook delivery lease lost, attempt not recorded")
+		}
+		return err
+	}
+
+	if status == DeliveryDead {
+		log.Error().Str("deliveryid", d.deliveryID).Msg("webhook delivery dead-lettered")
+	}
+
+	query = `INSERT into webhook_attempts (deliveryid, statuscode, response, error, durationms)
+			 VALUES ($1, NULLIF($2, 0), NULLIF($3, ''), NULLIF(LEFT($4, 256), ''), $5)`
+
+	_, err = tx.Exec(query, d.deliveryID, a.StatusCode, a.Response, a.Error, a.DurationMs)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const deliveryColumns = `d.deliveryid, d.subscriptionid, w.userid, d.eventid, d.eventtype, d.status, d.attempts, d.nextattemptat,
+	d.createdat, d.updatedat`
+
+func scanDelivery(row scanner) (WebhookDelivery, error) {
+	d := WebhookDelivery{}
+	err := row.Scan(&d.DeliveryID, &d.SubscriptionID, &d.UserID, &d.EventID, &d.EventType, &d.Status, &d.AttemptCount,
+		&d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt)
+	return d, err
+}
+
+// GetWebhookDelivery returns the delivery and each of its attempts, oldest first
+func (s *SQLDatabase) GetWebhookDelivery(deliveryID string) (*WebhookDelivery, error) {
+	query := "SELECT " + deliveryColumns + ` FROM webhook_deliveries d
+			  JOIN webhook_subscriptions w ON w.subscriptionid = d.subscriptionid WHERE d.deliveryid = $1`
+
+	d, err := scanDelivery(s.db.QueryRow(query, deliveryID))
+	if err == sql.ErrNoRows {
+		return nil, ErrDeliveryNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	query = `SELECT COALESCE(statuscode, 0), COALESCE(response, ''), COALESCE(error, ''), durationms, createdat
+			 FROM webhook_attempts WHERE deliveryid = $1 ORDER BY id`
+
+	rows, err := s.db.Query(query, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a := WebhookAttempt{}
+		if err := rows.Scan(&a.StatusCode, &a.Response, &a.Error, &a.DurationMs, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.Attempts = append(d.Attempts, a)
+	}
+
+	return &d, rows.Err()
+}
+
+// ListWebhookDeliveries returns the latest deliveries to the subscriptions of the user, optionally with a given status
+func (s *SQLDatabase) ListWebhookDeliveries(l ListWebhookDeliveries) ([]WebhookDelivery, error) {
+	query := "SELECT " + deliveryColumns + ` FROM webhook_deliveries d
+			  JOIN webhook_subscriptions w ON w.subscriptionid = d.subscriptionid
+			  WHERE w.userid = $1 AND ($2 = '' OR d.status = $2) ORDER BY d.id DESC LIMIT 100`
+
+	rows, err := s.db.Query(query, l.UserID, l.Status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// ReplayWebhookDelivery sends the delivery again as soon as possible, with all its attempts ahead of it
+func (s *SQLDatabase) ReplayWebhookDelivery(deliveryID string) (*WebhookDelivery, error) {
+	query := `UPDATE webhook_deliveries SET status = $1, attempts = 0, nextattemptat = NOW(), updatedat = NOW()
+			  WHERE deliveryid = $2`
+
+	res, err := s.db.Exec(query, DeliveryPending, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrDeliveryNotFound
+		}
+		return nil, err
+	}
+
+	return s.GetWebhookDelivery(deliveryID)
+}
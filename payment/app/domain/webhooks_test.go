@@ -0,0 +1,241 @@
+package domain
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{failures: 1, expected: 30 * time.Second},
+		{failures: 2, expected: time.Minute},
+		{failures: 4, expected: 4 * time.Minute},
+		{failures: 20, expected: webhookMaxBackoff},
+	}
+
+	for _, test := range tests {
+		if got := webhookBackoff(30*time.Second, test.failures); got != test.expected {
+			t.Errorf("after %d failures, expected %v, got %v", test.failures, test.expected, got)
+		}
+	}
+}
+
+func TestPublicHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{"hooks.example.com", true},
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"auth", false},
+		{"payment", false},
+		{"localhost", false},
+		{"metadata.google.internal", false},
+		{"127.0.0.1", false},
+		{"10.0.0.7", false},
+		{"172.20.0.3", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		if got := publicHost(test.host); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.host, test.expected, got)
+		}
+	}
+}
+
+func TestNewWebhookClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// the test server listens on the loopback, as an internal service would
+	_, err := NewWebhookClient(time.Second).Post(server.URL, "application/json", nil)
+	if err == nil {
+		t.Error("expected the client to refuse to connect to a loopback address")
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+
+	if got := SignWebhook("secret", "1700000000", []byte("{}")); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	if SignWebhook("secret", "1700000000", []byte("{}")) == SignWebhook("secret", "1700000001", []byte("{}")) {
+		t.Error("expected the timestamp to be signed")
+	}
+}
+
+// receiver records the deliveries it gets and responds with the given statuses, then 200
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	rc.received = append(rc.received, r)
+	rc.bodies = append(rc.bodies, body)
+
+	status := http.StatusOK
+	if len(rc.statuses) > 0 {
+		status, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte("status " + http.StatusText(status)))
+}
+
+func TestSQLDatabase_DeliverWebhooks(t *testing.T) {
+	cleanDB(db)
+	pay := NewSQLDatabase(db)
+	pay.SetWebhooks(WebhooksConfig{RetryBase: time.Millisecond, MaxAttempts: 3})
+
+	if err := initBalance("1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := initBalance("2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &receiver{statuses: []int{http.StatusInternalServerError}}
+	server := httptest.NewServer(rc)
+	defer server.Close()
+
+	// the subscriber is reached through a public name, the client connects to the test server instead
+	client := server.Client()
+	client.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}
+
+	webhook, err := pay.CreateWebhookSubscription(CreateWebhookSubscription{UserID: "2", URL: "http://hooks.example.com/payments",
+		EventTypes: []string{EventPaymentCompleted}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{"ftp://example.com", server.URL, "http://auth/signing_secret", "http://169.254.169.254/latest"} {
+		_, err = pay.CreateWebhookSubscription(CreateWebhookSubscription{UserID: "2", URL: url,
+			EventTypes: []string{EventPaymentCompleted}})
+		if err != ErrInvalidWebhook {
+			t.Errorf("%s: expected %v, got %v", url, ErrInvalidWebhook, err)
+		}
+	}
+
+	_, _ = pay.SaveTransaction(Transaction{RequestID: "a", SenderID: "1", RecipientID: "2", Amount: 10, Currency: "SGD"})
+	// a failed payment is not delivered, the webhook is not subscribed to its event
+	_, _ = pay.SaveTransaction(Transaction{RequestID: "b", SenderID: "1", RecipientID: "2", Amount: 1000, Currency: "SGD"})
+
+	publisher := Publishers{pay.WebhookPublisher()}
+	if _, err := pay.RelayEvents(publisher); err != nil {
+		t.Fatal(err)
+	}
+
+	deliver := func() int {
+		time.Sleep(10 * time.Millisecond)
+		n, err := pay.DeliverWebhooks(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// the first attempt fails, the second succeeds and nothing is left to deliver
+	for i, expected := range []int{1, 1, 0} {
+		if n := deliver(); n != expected {
+			t.Fatalf("run %d: expected %d deliveries, got %d", i, expected, n)
+		}
+	}
+
+	r := rc.received[1]
+	signature := SignWebhook(webhook.Secret, r.Header.Get(WebhookTimestampHeader), rc.bodies[1])
+	if r.Header.Get(WebhookSignatureHeader) != signature || r.Header.Get(WebhookEventTypeHeader) != EventPaymentCompleted {
+		t.Errorf("expected a signed %s delivery, got headers %v", EventPaymentCompleted, r.Header)
+	}
+
+	deliveries, err := pay.ListWebhookDeliveries(ListWebhookDeliveries{UserID: "2"})
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("expected 1 delivery, got %v, %v", deliveries, err)
+	}
+
+	d, err := pay.GetWebhookDelivery(deliveries[0].DeliveryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Status != DeliveryDelivered || len(d.Attempts) != 2 || d.Attempts[0].StatusCode != http.StatusInternalServerError ||
+		d.Attempts[0].Response != "status Internal Server Error" || d.Attempts[1].StatusCode != http.StatusOK {
+		t.Errorf("expected a delivery that failed once then succeeded, got %+v", d)
+	}
+
+	// a delivery failing max_attempts times is dead-lettered until replayed
+	rc.mu.Lock()
+	rc.statuses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}
+	rc.mu.Unlock()
+
+	_, err = pay.ReplayWebhookDelivery(d.DeliveryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		deliver()
+	}
+
+	dead, err := pay.ListWebhookDeliveries(ListWebhookDeliveries{UserID: "2", Status: DeliveryDead})
+	if err != nil || len(dead) != 1 || dead[0].AttemptCount != 3 {
+		t.Fatalf("expected the delivery to be dead after 3 attempts, got %+v, %v", dead, err)
+	}
+
+	_, err = pay.ReplayWebhookDelivery(d.DeliveryID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := deliver(); n != 1 {
+		t.Errorf("expected the replayed delivery to be sent, got %d deliveries", n)
+	}
+
+	d, err = pay.GetWebhookDelivery(d.DeliveryID)
+	if err != nil || d.Status != DeliveryDelivered {
+		t.Fatalf("expected the replayed delivery to be delivered, got %+v, %v", d, err)
+	}
+
+	// the attempt of a worker whose lease expired is left to the worker that claimed the delivery since
+	err = pay.recordAttempt(dueDelivery{deliveryID: d.DeliveryID, leaseID: "expired"}, WebhookAttempt{StatusCode: http.StatusOK})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := pay.GetWebhookDelivery(d.DeliveryID)
+	if err != nil || stale.AttemptCount != d.AttemptCount || len(stale.Attempts) != len(d.Attempts) {
+		t.Errorf("expected the attempt of an expired lease not to be recorded, got %+v, %v", stale, err)
+	}
+}
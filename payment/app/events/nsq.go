@@ -0,0 +1,43 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// NSQ publishes events to a topic of nsqd through its HTTP API
+type NSQ struct {
+	client *http.Client
+	addr   string
+	topic  string
+}
+
+func NewNSQ(client *http.Client, addr, topic string) *NSQ {
+	return &NSQ{client: client, addr: addr, topic: topic}
+}
+
+func (n *NSQ) Publish(e domain.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.addr+"/pub?topic="+url.QueryEscape(n.topic), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("nsqd returned %d: %s", resp.StatusCode, msg)
+	}
+
+	return nil
+}
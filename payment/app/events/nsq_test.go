@@ -0,0 +1,53 @@
+package events
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+func TestNSQ_Publish(t *testing.T) {
+	var published []domain.Event
+
+	nsqd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pub" || r.URL.Query().Get("topic") != "payments" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		e := domain.Event{}
+		if err := json.Unmarshal(body, &e); err != nil || e.EventID == "fail" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		published = append(published, e)
+		w.Write([]byte("OK"))
+	}))
+	defer nsqd.Close()
+
+	n := NewNSQ(nsqd.Client(), nsqd.URL, "payments")
+
+	err := n.Publish(domain.Event{EventID: "1", Type: domain.EventPaymentCompleted})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(published) != 1 || published[0].EventID != "1" || published[0].Type != domain.EventPaymentCompleted {
+		t.Errorf("expected the event to be published, got %+v", published)
+	}
+
+	if err := n.Publish(domain.Event{EventID: "fail"}); err == nil {
+		t.Error("expected an error when nsqd refuses the event")
+	}
+
+	if err := NewNSQ(nsqd.Client(), nsqd.URL, "other").Publish(domain.Event{EventID: "2"}); err == nil {
+		t.Error("expected an error for an unknown topic")
+	}
+}
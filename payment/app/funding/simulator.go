@@ -0,0 +1,80 @@
+package funding
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+const (
+	// SourceFail makes the simulator fail the funding
+	SourceFail = "sim_fail"
+	// SourceReverse makes the simulator complete the funding, then reverse it
+	SourceReverse = "sim_reverse"
+
+	deliveries = 5
+)
+
+var ErrNoSource = errors.New("source is required")
+
+// Simulator is a local funding provider settling fundings after a delay, as a card processor or a bank would.
+// The source of the funding decides its outcome, see SourceFail and SourceReverse, any other source succeeds.
+type Simulator struct {
+	delay  time.Duration
+	notify func(e domain.FundingEvent) error
+}
+
+// NewSimulator sends the outcome of fundings to notify, which is retried until it succeeds as providers do
+func NewSimulator(delay time.Duration, notify func(e domain.FundingEvent) error) *Simulator {
+	return &Simulator{delay: delay, notify: notify}
+}
+
+func (s *Simulator) Start(f domain.Funding) (string, error) {
+	if f.Source == "" {
+		return "", ErrNoSource
+	}
+
+	ref := "sim_" + uuid.NewV4().String()
+
+	go s.settle(f, ref)
+
+	return ref, nil
+}
+
+func (s *Simulator) settle(f domain.Funding, ref string) {
+	event := domain.FundingEvent{FundingID: f.FundingID, ProviderRef: ref, Type: domain.FundingSucceeded}
+	if f.Source == SourceFail {
+		event.Type = domain.FundingFailed
+		event.Reason = "declined by the simulator"
+	}
+
+	time.Sleep(s.delay)
+	s.send(event)
+
+	if f.Source == SourceReverse {
+		time.Sleep(s.delay)
+		event.Type = domain.FundingReversed
+		event.Reason = "reversed by the simulator"
+		s.send(event)
+	}
+}
+
+// send delivers the event, waiting longer after each failed delivery
+func (s *Simulator) send(e domain.FundingEvent) {
+	wait := s.delay
+
+	for i := 0; i < deliveries; i++ {
+		err := s.notify(e)
+		if err == nil {
+			return
+		}
+
+		log.Error().Err(err).Str("fundingid", e.FundingID).Str("type", e.Type).Msg("could not deliver funding event")
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
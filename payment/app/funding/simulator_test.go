@@ -0,0 +1,70 @@
+package funding
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+func TestSimulator(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected []string
+	}{
+		{source: "4242", expected: []string{domain.FundingSucceeded}},
+		{source: SourceFail, expected: []string{domain.FundingFailed}},
+		{source: SourceReverse, expected: []string{domain.FundingSucceeded, domain.FundingReversed}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.source, func(t *testing.T) {
+			var mu sync.Mutex
+			var events []string
+			attempts := 0
+
+			done := make(chan struct{})
+			sim := NewSimulator(time.Millisecond, func(e domain.FundingEvent) error {
+				mu.Lock()
+				defer mu.Unlock()
+
+				// the first delivery fails and is retried
+				attempts++
+				if attempts == 1 {
+					return domain.ErrFundingNotFound
+				}
+
+				if e.FundingID != "f1" || e.ProviderRef == "" {
+					t.Errorf("unexpected event %+v", e)
+				}
+
+				events = append(events, e.Type)
+				if len(events) == len(test.expected) {
+					close(done)
+				}
+				return nil
+			})
+
+			_, err := sim.Start(domain.Funding{FundingID: "f1", Source: test.source})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("events were not delivered")
+			}
+
+			if !reflect.DeepEqual(events, test.expected) {
+				t.Errorf("expected events %v, got %v", test.expected, events)
+			}
+		})
+	}
+
+	if _, err := NewSimulator(0, nil).Start(domain.Funding{}); err != ErrNoSource {
+		t.Errorf("expected %v, got %v", ErrNoSource, err)
+	}
+}
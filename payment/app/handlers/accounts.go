@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// GetAccount returns the balance and state of an account along with who changed its state and why
+func (s *RequestHandler) GetAccount(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	account, err := s.db.GetAccount(mux.Vars(r)["id"])
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, account, traceID)
+}
+
+// SetAccountStatus freezes, closes, restricts or reactivates an account, the caller is recorded as the author
+func (s *RequestHandler) SetAccountStatus(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.SetAccountStatus{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.Status == "" || request.Reason == "" {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "status and reason are required")
+		return
+	}
+
+	request.UserID = mux.Vars(r)["id"]
+	request.ChangedBy = r.Header.Get(common.PrincipalIDHeader)
+
+	log.Info().Str(logTraceID, traceID).
+		Interface("change", request).
+		Msg("account status change")
+
+	account, err := s.db.SetAccountStatus(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not change the account status")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, account, traceID)
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// CreateAdjustment credits or debits a user, adjustments from the approval threshold wait for a second operator
+func (s *RequestHandler) CreateAdjustment(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.CreateAdjustment{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.RequestID == "" || request.UserID == "" || request.Currency == "" {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request",
+			"request_id, user_id, direction, amount, currency, reason_code and ticket are required")
+		return
+	}
+
+	request.CreatedBy = r.Header.Get(common.PrincipalIDHeader)
+
+	log.Info().Str(logTraceID, traceID).
+		Interface("adjustment", request).
+		Msg("adjustment request")
+
+	a, err := s.db.WithContext(r.Context()).CreateAdjustment(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("adjustment failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	status := http.StatusOK
+	if a.Status == domain.AdjustmentPendingApproval {
+		status = http.StatusAccepted
+	}
+
+	writeJSON(w, status, a, traceID)
+}
+
+// ListAdjustments returns the latest adjustments, status=pending_approval lists those waiting for an approver
+func (s *RequestHandler) ListAdjustments(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	adjustments, err := s.db.ListAdjustments(r.URL.Query().Get("status"))
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, adjustments, traceID)
+}
+
+func (s *RequestHandler) GetAdjustment(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	a, err := s.db.GetAdjustment(mux.Vars(r)["id"])
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a, traceID)
+}
+
+// ApproveAdjustment applies an adjustment pending approval, the caller must not be the operator who made it
+func (s *RequestHandler) ApproveAdjustment(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	a, err := s.db.WithContext(r.Context()).ApproveAdjustment(mux.Vars(r)["id"], r.Header.Get(common.PrincipalIDHeader))
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("approval failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a, traceID)
+}
+
+// RejectAdjustment drops an adjustment pending approval
+func (s *RequestHandler) RejectAdjustment(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := rejectRequest{}
+
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &request)
+		if err != nil {
+			common.WriteError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON object")
+			return
+		}
+	}
+
+	a, err := s.db.WithContext(r.Context()).RejectAdjustment(mux.Vars(r)["id"], r.Header.Get(common.PrincipalIDHeader), request.Reason)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("rejection failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a, traceID)
+}
+
+// SearchTransactions searches the transactions of all users
+func (s *RequestHandler) SearchTransactions(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	values := r.URL.Query()
+	search := domain.TransactionSearch{
+		UserID:      values.Get("user_id"),
+		SenderID:    values.Get("sender_id"),
+		RecipientID: values.Get("recipient_id"),
+		Kind:        values.Get("kind"),
+		Status:      values.Get("status"),
+		Currency:    values.Get("currency"),
+	}
+
+	var err error
+	for name, dest := range map[string]**time.Time{"from": &search.From, "to": &search.To} {
+		if v := values.Get(name); v != "" && err == nil {
+			var at time.Time
+			at, err = time.Parse(time.RFC3339, v)
+			*dest = &at
+		}
+	}
+
+	for name, dest := range map[string]*float64{"min_amount": &search.MinAmount, "max_amount": &search.MaxAmount} {
+		if v := values.Get(name); v != "" && err == nil {
+			*dest, err = strconv.ParseFloat(v, 64)
+		}
+	}
+
+	if v := values.Get("limit"); v != "" && err == nil {
+		search.Limit, err = strconv.Atoi(v)
+	}
+
+	if err != nil {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request",
+			"from and to must be RFC 3339 times, min_amount, max_amount and limit numbers")
+		return
+	}
+
+	txs, err := s.db.SearchTransactions(search, r.Header.Get(common.PrincipalIDHeader))
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, txs, traceID)
+}
+
+// ListAuditLog returns the actions of the operators, newest first. Older entries are paged with before,
+// the id of the last entry of the previous page.
+func (s *RequestHandler) ListAuditLog(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	values := r.URL.Query()
+	request := domain.ListAuditLog{
+		Actor:  values.Get("actor"),
+		Action: values.Get("action"),
+		Target: values.Get("target"),
+	}
+
+	var err error
+	if v := values.Get("before"); v != "" {
+		request.Before, err = strconv.ParseInt(v, 10, 64)
+	}
+
+	if v := values.Get("limit"); v != "" && err == nil {
+		request.Limit, err = strconv.Atoi(v)
+	}
+
+	if err != nil {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "before and limit must be numbers")
+		return
+	}
+
+	entries, err := s.db.ListAuditLog(request)
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entries, traceID)
+}
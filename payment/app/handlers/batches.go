@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// CreateBatch makes a list of transfers from a single sender
+func (s *RequestHandler) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.CreateBatch{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.RequestID == "" || request.SenderID == "" {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid batch request")
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request_id, sender_id, mode and transfers are required")
+		return
+	}
+
+	if !canSee(r, request.SenderID) {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "users can only send batches from their own account")
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).
+		Str("requestid", request.RequestID).
+		Str("mode", request.Mode).
+		Int("transfers", len(request.Transfers)).
+		Msg("batch request")
+
+	batch, err := s.db.WithContext(r.Context()).CreateBatch(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("batch failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, batch, traceID)
+}
+
+// GetBatch returns a batch and the result of each of its transfers
+func (s *RequestHandler) GetBatch(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	batch, err := s.db.GetBatch(mux.Vars(r)["id"])
+	if err == nil && !canSee(r, batch.SenderID) {
+		err = domain.ErrBatchNotFound
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, batch, traceID)
+}
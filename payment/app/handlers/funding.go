@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// Deposit tops up the balance of a user from a card or a bank account
+func (s *RequestHandler) Deposit(w http.ResponseWriter, r *http.Request) {
+	s.createFunding(w, r, domain.KindDeposit)
+}
+
+// Withdraw sends money from the balance of a user to a card or a bank account
+func (s *RequestHandler) Withdraw(w http.ResponseWriter, r *http.Request) {
+	s.createFunding(w, r, domain.KindWithdrawal)
+}
+
+func (s *RequestHandler) createFunding(w http.ResponseWriter, r *http.Request, direction string) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.CreateFunding{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.RequestID == "" || request.UserID == "" || request.Source == "" || request.Currency == "" {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid funding request")
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request_id, user_id, method, source, amount and currency are required")
+		return
+	}
+
+	if !canSee(r, request.UserID) {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "users can only fund their own account")
+		return
+	}
+
+	request.Direction = direction
+
+	log.Info().Str(logTraceID, traceID).
+		Interface("funding", request).
+		Msg("funding request")
+
+	f, err := s.db.WithContext(r.Context()).CreateFunding(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("funding failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	status := http.StatusAccepted
+	if f.Status != domain.StatusPending {
+		status = http.StatusOK
+	}
+
+	writeJSON(w, status, f, traceID)
+}
+
+// GetFunding returns a deposit or withdrawal and its status
+func (s *RequestHandler) GetFunding(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	f, err := s.db.GetFunding(mux.Vars(r)["id"])
+	if err == nil && !canSee(r, f.UserID) {
+		err = domain.ErrFundingNotFound
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, f, traceID)
+}
+
+// FundingEvent receives the outcome of a deposit or withdrawal from the funding provider
+func (s *RequestHandler) FundingEvent(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = domain.VerifyFundingEvent(s.fundingEvents, r.Header.Get(domain.FundingTimestampHeader),
+		r.Header.Get(domain.FundingSignatureHeader), body, time.Now())
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("funding event refused")
+		common.WriteError(w, http.StatusUnauthorized, "invalid_signature", err.Error())
+		return
+	}
+
+	event := domain.FundingEvent{}
+
+	err = json.Unmarshal(body, &event)
+	if err != nil || event.FundingID == "" || event.Type == "" {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "funding_id and type are required")
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).
+		Interface("event", event).
+		Msg("funding event")
+
+	f, err := s.db.WithContext(r.Context()).HandleFundingEvent(event)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("funding event failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, f, traceID)
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// GetTransaction returns a transaction and its status from its transaction ID
+func (s *RequestHandler) GetTransaction(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	t, err := s.db.GetTransaction(mux.Vars(r)["id"])
+	s.writeTransaction(w, r, t, err, traceID)
+}
+
+// FindTransaction looks a transaction up from its request_id so that clients can reconcile after a network failure
+func (s *RequestHandler) FindTransaction(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	requestID := r.URL.Query().Get("request_id")
+	if requestID == "" {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request_id is required")
+		return
+	}
+
+	t, err := s.db.GetTransactionByRequestID(requestID)
+	s.writeTransaction(w, r, t, err, traceID)
+}
+
+func (s *RequestHandler) writeTransaction(w http.ResponseWriter, r *http.Request, t *domain.Transaction, err error, traceID string) {
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	// users only see their own transactions, as if the others did not exist
+	if !canSee(r, t.SenderID, t.RecipientID) {
+		writeDomainError(w, domain.ErrTransactionNotFound, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t, traceID)
+}
+
+// canSee reports whether the caller is one of the users, services can see everything
+func canSee(r *http.Request, userIDs ...string) bool {
+	if r.Header.Get(common.PrincipalTypeHeader) != "user" {
+		return true
+	}
+
+	principal := r.Header.Get(common.PrincipalIDHeader)
+	for _, id := range userIDs {
+		if id == principal {
+			return true
+		}
+	}
+	return false
+}
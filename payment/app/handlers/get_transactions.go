@@ -31,6 +31,11 @@ func (s *RequestHandler) GetTransactions(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// users only get their own transactions, whatever user_id they send
+	if r.Header.Get(common.PrincipalTypeHeader) == "user" {
+		request.UserID = r.Header.Get(common.PrincipalIDHeader)
+	}
+
 	txs, err := s.db.GetAllTransactions(request)
 	if err != nil {
 		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not retrieve transactions")
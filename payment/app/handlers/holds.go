@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// CreateHold reserves funds on the sender balance
+func (s *RequestHandler) CreateHold(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.CreateHold{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.RequestID == "" || request.SenderID == "" || request.RecipientID == "" {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid hold request")
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request_id, sender_id, recipient_id and amount are required")
+		return
+	}
+
+	if !canSee(r, request.SenderID) {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "users can only hold funds on their own account")
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).
+		Interface("hold", request).
+		Msg("hold request")
+
+	hold, err := s.db.WithContext(r.Context()).CreateHold(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("hold failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, hold, traceID)
+}
+
+// GetHold returns a hold and its status
+func (s *RequestHandler) GetHold(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	hold, err := s.db.GetHold(mux.Vars(r)["id"])
+	if err == nil && !canSee(r, hold.SenderID, hold.RecipientID) {
+		err = domain.ErrHoldNotFound
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, hold, traceID)
+}
+
+// CaptureHold pays all or part of a hold to its recipient
+func (s *RequestHandler) CaptureHold(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.CaptureHold{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.RequestID == "" {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid capture request")
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request_id is required")
+		return
+	}
+
+	request.HoldID = mux.Vars(r)["id"]
+
+	hold, err := s.db.GetHold(request.HoldID)
+	if err == nil && !canSee(r, hold.SenderID) {
+		err = domain.ErrHoldNotFound
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	t, err := s.db.WithContext(r.Context()).Capture(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("capture failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t, traceID)
+}
+
+// VoidHold releases a hold without paying its recipient
+func (s *RequestHandler) VoidHold(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	holdID := mux.Vars(r)["id"]
+
+	hold, err := s.db.GetHold(holdID)
+	if err == nil && !canSee(r, hold.SenderID) {
+		err = domain.ErrHoldNotFound
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	hold, err = s.db.WithContext(r.Context()).Void(holdID)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("void failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, hold, traceID)
+}
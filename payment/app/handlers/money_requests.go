@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// CreateMoneyRequest asks another user for money
+func (s *RequestHandler) CreateMoneyRequest(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.CreateMoneyRequest{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.RequestID == "" || request.RequesterID == "" || request.PayerID == "" {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid money request")
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request_id, requester_id, payer_id and amount are required")
+		return
+	}
+
+	if !canSee(r, request.RequesterID) {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "users can only request money for themselves")
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).
+		Interface("money_request", request).
+		Msg("money request")
+
+	m, err := s.db.CreateMoneyRequest(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("money request failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m, traceID)
+}
+
+// ListMoneyRequests returns the requests the caller has to pay, or with role=requester the ones they sent.
+// The status query parameter filters them, e.g. status=pending.
+func (s *RequestHandler) ListMoneyRequests(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	query := r.URL.Query()
+
+	request := domain.ListMoneyRequests{
+		UserID: query.Get("user_id"),
+		Role:   query.Get("role"),
+		Status: query.Get("status"),
+	}
+
+	if r.Header.Get(common.PrincipalTypeHeader) == "user" {
+		request.UserID = r.Header.Get(common.PrincipalIDHeader)
+	}
+
+	if request.UserID == "" || request.Role != "" && request.Role != domain.RolePayer && request.Role != domain.RoleRequester {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "user_id is required and role is either payer or requester")
+		return
+	}
+
+	requests, err := s.db.ListMoneyRequests(request)
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, requests, traceID)
+}
+
+// GetMoneyRequest returns a money request to its requester or payer
+func (s *RequestHandler) GetMoneyRequest(w http.ResponseWriter, r *http.Request) {
+	s.moneyRequestAction(w, r, "", nil)
+}
+
+// AcceptMoneyRequest pays a money request, only its payer can accept it
+func (s *RequestHandler) AcceptMoneyRequest(w http.ResponseWriter, r *http.Request) {
+	s.moneyRequestAction(w, r, domain.RolePayer, s.db.WithContext(r.Context()).AcceptMoneyRequest)
+}
+
+// DeclineMoneyRequest refuses a money request, only its payer can decline it
+func (s *RequestHandler) DeclineMoneyRequest(w http.ResponseWriter, r *http.Request) {
+	s.moneyRequestAction(w, r, domain.RolePayer, s.db.DeclineMoneyRequest)
+}
+
+// CancelMoneyRequest withdraws a money request, only its requester can cancel it
+func (s *RequestHandler) CancelMoneyRequest(w http.ResponseWriter, r *http.Request) {
+	s.moneyRequestAction(w, r, domain.RoleRequester, s.db.CancelMoneyRequest)
+}
+
+// moneyRequestAction runs the action once the caller is known to have the role on the money request.
+// Users who are neither its requester nor its payer are told it does not exist.
+func (s *RequestHandler) moneyRequestAction(w http.ResponseWriter, r *http.Request, role string,
+	action func(moneyRequestID string) (*domain.MoneyRequest, error)) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	m, err := s.db.GetMoneyRequest(mux.Vars(r)["id"])
+	if err == nil && !canSee(r, m.RequesterID, m.PayerID) {
+		err = domain.ErrMoneyRequestNotFound
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	if action == nil {
+		writeJSON(w, http.StatusOK, m, traceID)
+		return
+	}
+
+	party := m.PayerID
+	if role == domain.RoleRequester {
+		party = m.RequesterID
+	}
+
+	if !canSee(r, party) {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "only the "+role+" of the money request can do this")
+		return
+	}
+
+	m, err = action(m.MoneyRequestID)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("money request action failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, m, traceID)
+}
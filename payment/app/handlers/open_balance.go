@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// OpenBalance creates a zero balance for a newly registered user, it is called by the auth service
+func (s *RequestHandler) OpenBalance(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.OpenBalance{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.UserID == "" {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid open balance request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = s.db.OpenBalance(request.UserID)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not open balance")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).Str("userid", request.UserID).Msg("balance opened")
+
+	w.WriteHeader(http.StatusCreated)
+}
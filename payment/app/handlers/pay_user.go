@@ -12,13 +12,19 @@ import (
 )
 
 type RequestHandler struct {
-	db domain.DB
+	db            domain.DB
+	fundingEvents domain.FundingEventsConfig
 }
 
 func NewRequestHandler(db domain.DB) *RequestHandler {
 	return &RequestHandler{db: db}
 }
 
+// SetFundingEvents sets the secret the events of the funding provider are signed with
+func (s *RequestHandler) SetFundingEvents(c domain.FundingEventsConfig) {
+	s.fundingEvents = c
+}
+
 const (
 	logTraceID = "traceID"
 )
@@ -39,7 +45,13 @@ func (s *RequestHandler) PayUser(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &request)
 	if err != nil {
 		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not unmarshal request")
-		w.WriteHeader(http.StatusInternalServerError)
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "the request is not valid JSON")
+		return
+	}
+
+	// users pay from their own account, services pay on behalf of any user
+	if !canSee(r, request.SenderID) {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "users can only pay from their own account")
 		return
 	}
 
@@ -47,12 +59,24 @@ func (s *RequestHandler) PayUser(w http.ResponseWriter, r *http.Request) {
 		Interface("user", request).
 		Str("message", "payment request")
 
-	_, err = s.db.SaveTransaction(request)
+	txID, err := s.db.WithContext(r.Context()).SaveTransaction(request)
 	if err != nil {
 		log.Error().Err(err).Str(logTraceID, traceID).Msg("payment failed")
-		w.WriteHeader(http.StatusBadRequest)
+		writeDomainError(w, err, traceID)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	t, err := s.db.GetTransaction(*txID)
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	// payments held for review are accepted but no money moved yet
+	status := http.StatusOK
+	if t.Status == domain.StatusPending {
+		status = http.StatusAccepted
+	}
+
+	writeJSON(w, status, t, traceID)
 }
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+// Quote previews the fee of a payment from the caller, services give the sender in the sender_id query parameter
+func (s *RequestHandler) Quote(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	query := r.URL.Query()
+
+	senderID := query.Get("sender_id")
+	if r.Header.Get(common.PrincipalTypeHeader) == "user" {
+		senderID = r.Header.Get(common.PrincipalIDHeader)
+	}
+
+	amount, err := strconv.ParseFloat(query.Get("amount"), 64)
+	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) || amount <= 0 || senderID == "" || query.Get("currency") == "" {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "sender_id, a positive amount and currency are required")
+		return
+	}
+
+	quote, err := s.db.Quote(senderID, amount, query.Get("currency"))
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, quote, traceID)
+}
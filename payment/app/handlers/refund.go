@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// Refund sends back all or part of a payment to its sender
+func (s *RequestHandler) Refund(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.RefundRequest{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.RequestID == "" || request.Amount < 0 {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid refund request")
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request_id is required and amount cannot be negative")
+		return
+	}
+
+	request.TransactionID = mux.Vars(r)["id"]
+
+	original, err := s.db.GetTransaction(request.TransactionID)
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	// users can only refund payments they received, services act on behalf of the back-office
+	if r.Header.Get(common.PrincipalTypeHeader) == "user" && r.Header.Get(common.PrincipalIDHeader) != original.RecipientID {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "only the recipient of a payment can refund it")
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).
+		Interface("refund", request).
+		Msg("refund request")
+
+	refund, err := s.db.WithContext(r.Context()).Refund(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("refund failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, refund, traceID)
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+type domainError struct {
+	status int
+	code   string
+}
+
+// domainErrors maps the errors of the domain package to the status and code returned to clients
+var domainErrors = map[error]domainError{
+	domain.ErrTransactionNotFound: {http.StatusNotFound, "transaction_not_found"},
+	domain.ErrNotRefundable:       {http.StatusBadRequest, "not_refundable"},
+	domain.ErrRefundExceeded:      {http.StatusBadRequest, "refund_exceeded"},
+	domain.ErrDuplicateRequest:    {http.StatusConflict, "duplicate_request"},
+	domain.ErrNegativeAmount:      {http.StatusBadRequest, "negative_amount"},
+	domain.ErrInsufficientBalance: {http.StatusBadRequest, "insufficient_balance"},
+	domain.ErrAccountNotFound:     {http.StatusBadRequest, "account_not_found"},
+	domain.ErrHoldNotFound:        {http.StatusNotFound, "hold_not_found"},
+	domain.ErrHoldNotActive:       {http.StatusConflict, "hold_not_active"},
+	domain.ErrCaptureExceedHold:   {http.StatusBadRequest, "capture_exceeds_hold"},
+	domain.ErrScheduleNotFound:    {http.StatusNotFound, "schedule_not_found"},
+	domain.ErrScheduleNotActive:   {http.StatusConflict, "schedule_not_active"},
+	domain.ErrScheduleInPast:      {http.StatusBadRequest, "invalid_schedule"},
+	domain.ErrInvalidRecurrence:   {http.StatusBadRequest, "invalid_schedule"},
+
+	domain.ErrMoneyRequestNotFound:   {http.StatusNotFound, "money_request_not_found"},
+	domain.ErrMoneyRequestNotPending: {http.StatusConflict, "money_request_not_pending"},
+	domain.ErrRequestToSelf:          {http.StatusBadRequest, "request_to_self"},
+
+	domain.ErrBatchNotFound: {http.StatusNotFound, "batch_not_found"},
+	domain.ErrInvalidBatch:  {http.StatusBadRequest, "invalid_batch"},
+
+	domain.ErrSplitNotFound: {http.StatusNotFound, "split_not_found"},
+	domain.ErrInvalidSplit:  {http.StatusBadRequest, "invalid_split"},
+	domain.ErrSplitMismatch: {http.StatusBadRequest, "invalid_split"},
+
+	domain.ErrNotPendingReview: {http.StatusConflict, "not_pending_review"},
+
+	domain.ErrFundingNotFound:     {http.StatusNotFound, "funding_not_found"},
+	domain.ErrInvalidFunding:      {http.StatusBadRequest, "invalid_request"},
+	domain.ErrFundingEventInvalid: {http.StatusConflict, "invalid_funding_event"},
+	domain.ErrNoFundingProvider:   {http.StatusServiceUnavailable, "funding_unavailable"},
+
+	domain.ErrWebhookNotFound:  {http.StatusNotFound, "webhook_not_found"},
+	domain.ErrDeliveryNotFound: {http.StatusNotFound, "delivery_not_found"},
+	domain.ErrInvalidWebhook:   {http.StatusBadRequest, "invalid_webhook"},
+
+	domain.ErrAccountFrozen:         {http.StatusForbidden, "account_frozen"},
+	domain.ErrAccountClosed:         {http.StatusForbidden, "account_closed"},
+	domain.ErrAccountReceiveOnly:    {http.StatusForbidden, "account_receive_only"},
+	domain.ErrRecipientUnavailable:  {http.StatusBadRequest, "recipient_unavailable"},
+	domain.ErrAccountNotEmpty:       {http.StatusConflict, "account_not_empty"},
+	domain.ErrInvalidAccountStatus:  {http.StatusBadRequest, "invalid_request"},
+	domain.ErrAccountChangeNoReason: {http.StatusBadRequest, "invalid_request"},
+
+	domain.ErrAdjustmentNotFound:   {http.StatusNotFound, "adjustment_not_found"},
+	domain.ErrInvalidAdjustment:    {http.StatusBadRequest, "invalid_adjustment"},
+	domain.ErrAdjustmentNotPending: {http.StatusConflict, "adjustment_not_pending"},
+	domain.ErrSelfApproval:         {http.StatusForbidden, "self_approval"},
+
+	domain.ErrInvalidPeriod: {http.StatusBadRequest, "invalid_request"},
+
+	domain.ErrLockTimeout: {http.StatusServiceUnavailable, "lock_timeout"},
+}
+
+// riskErrorResponse tells the client which risk rules refused the payment
+type riskErrorResponse struct {
+	common.ErrorResponse
+	Reasons []string `json:"reasons"`
+}
+
+// limitErrorResponse tells the client which limit was hit and when it resets
+type limitErrorResponse struct {
+	common.ErrorResponse
+	Limit    string     `json:"limit"`
+	Max      float64    `json:"max"`
+	ResetsAt *time.Time `json:"resets_at,omitempty"`
+}
+
+func writeDomainError(w http.ResponseWriter, err error, traceID string) {
+	if le, ok := err.(*domain.LimitError); ok {
+		writeJSON(w, http.StatusBadRequest, limitErrorResponse{
+			ErrorResponse: common.ErrorResponse{Code: "limit_exceeded", Message: le.Error()},
+			Limit:         le.Limit,
+			Max:           le.Max,
+			ResetsAt:      le.ResetsAt,
+		}, traceID)
+		return
+	}
+
+	if re, ok := err.(*domain.RiskError); ok {
+		writeJSON(w, http.StatusForbidden, riskErrorResponse{
+			ErrorResponse: common.ErrorResponse{Code: "risk_denied", Message: re.Error()},
+			Reasons:       re.Reasons,
+		}, traceID)
+		return
+	}
+
+	e, ok := domainErrors[err]
+	if !ok {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the payment was not attempted, the same request can be sent again
+	if err == domain.ErrLockTimeout {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	common.WriteError(w, e.status, e.code, err.Error())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}, traceID string) {
+	response, err := json.Marshal(v)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(response)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("error")
+	}
+}
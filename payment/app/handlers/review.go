@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+)
+
+type rejectRequest struct {
+	Reason string `json:"reason"`
+}
+
+// ListReviews returns the payments waiting for an operator to release or reject them
+func (s *RequestHandler) ListReviews(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	txs, err := s.db.ListPendingTransactions()
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, txs, traceID)
+}
+
+// ReleaseTransaction makes a payment held for review
+func (s *RequestHandler) ReleaseTransaction(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	t, err := s.db.WithContext(r.Context()).ReleaseTransaction(mux.Vars(r)["id"])
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("release failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t, traceID)
+}
+
+// RejectTransaction fails a payment held for review
+func (s *RequestHandler) RejectTransaction(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	if !isOperator(w, r) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := rejectRequest{}
+
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &request)
+		if err != nil {
+			common.WriteError(w, http.StatusBadRequest, "invalid_request", "body must be a JSON object")
+			return
+		}
+	}
+
+	t, err := s.db.WithContext(r.Context()).RejectTransaction(mux.Vars(r)["id"], request.Reason)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("reject failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t, traceID)
+}
+
+// isOperator refuses users, reviews and account changes are made by back-office services
+func isOperator(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(common.PrincipalTypeHeader) == "user" {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "only operators can do this")
+		return false
+	}
+	return true
+}
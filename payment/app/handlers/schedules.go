@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// CreateSchedule sets up a one-off or recurring payment executed by the scheduler
+func (s *RequestHandler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.CreateSchedule{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.RequestID == "" || request.SenderID == "" || request.RecipientID == "" {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid schedule request")
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request_id, sender_id, recipient_id and amount are required")
+		return
+	}
+
+	if !canSee(r, request.SenderID) {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "users can only schedule payments from their own account")
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).
+		Interface("schedule", request).
+		Msg("schedule request")
+
+	schedule, err := s.db.CreateSchedule(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("schedule failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schedule, traceID)
+}
+
+// ListSchedules returns the schedules of the caller, services give the user in the user_id query parameter
+func (s *RequestHandler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	userID := r.URL.Query().Get("user_id")
+	if r.Header.Get(common.PrincipalTypeHeader) == "user" {
+		userID = r.Header.Get(common.PrincipalIDHeader)
+	}
+
+	if userID == "" {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "user_id is required")
+		return
+	}
+
+	schedules, err := s.db.ListSchedules(userID)
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schedules, traceID)
+}
+
+// GetSchedule returns a schedule and the outcome of each of its runs
+func (s *RequestHandler) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	schedule, err := s.db.GetSchedule(mux.Vars(r)["id"])
+	if err == nil && !canSee(r, schedule.SenderID) {
+		err = domain.ErrScheduleNotFound
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schedule, traceID)
+}
+
+// CancelSchedule stops the future runs of a schedule
+func (s *RequestHandler) CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	scheduleID := mux.Vars(r)["id"]
+
+	schedule, err := s.db.GetSchedule(scheduleID)
+	if err == nil && !canSee(r, schedule.SenderID) {
+		err = domain.ErrScheduleNotFound
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	schedule, err = s.db.CancelSchedule(scheduleID)
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schedule, traceID)
+}
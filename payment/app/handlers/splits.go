@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// CreateSplit divides a bill among participants and sends each of them a money request
+func (s *RequestHandler) CreateSplit(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.CreateSplit{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.RequestID == "" || request.CreatorID == "" {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("invalid split request")
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "request_id, creator_id, total_amount, method and participants are required")
+		return
+	}
+
+	if !canSee(r, request.CreatorID) {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "users can only split their own bills")
+		return
+	}
+
+	log.Info().Str(logTraceID, traceID).
+		Interface("split", request).
+		Msg("split request")
+
+	split, err := s.db.WithContext(r.Context()).CreateSplit(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("split failed")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, split, traceID)
+}
+
+// GetSplit returns a split and its settlement to its creator and participants
+func (s *RequestHandler) GetSplit(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	split, err := s.db.GetSplit(mux.Vars(r)["id"])
+	if err == nil {
+		userIDs := []string{split.CreatorID}
+		for _, part := range split.Parts {
+			userIDs = append(userIDs, part.UserID)
+		}
+
+		if !canSee(r, userIDs...) {
+			err = domain.ErrSplitNotFound
+		}
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, split, traceID)
+}
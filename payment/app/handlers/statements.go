@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/statements"
+)
+
+const dateFormat = "2006-01-02"
+
+var statementFormats = map[string]struct {
+	contentType string
+	writer      func(w *streamResponse) domain.StatementWriter
+}{
+	"json": {"application/json", func(w *streamResponse) domain.StatementWriter { return statements.NewJSON(w) }},
+	"csv":  {"text/csv", func(w *streamResponse) domain.StatementWriter { return statements.NewCSV(w) }},
+	"ofx":  {"application/x-ofx", func(w *streamResponse) domain.StatementWriter { return statements.NewOFX(w) }},
+}
+
+// streamResponse sends the headers of a successful response with the first bytes of the body,
+// until then the handler can still respond with an error
+type streamResponse struct {
+	w           http.ResponseWriter
+	contentType string
+	filename    string
+	started     bool
+}
+
+func (s *streamResponse) Write(p []byte) (int, error) {
+	if !s.started {
+		s.started = true
+		s.w.Header().Set("Content-Type", s.contentType)
+		s.w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, s.filename))
+		s.w.WriteHeader(http.StatusOK)
+	}
+	return s.w.Write(p)
+}
+
+// parseStatementTime reads a RFC 3339 time or a date, a date given as the end of the period is included in it
+func parseStatementTime(v string, end bool) (time.Time, error) {
+	if d, err := time.Parse(dateFormat, v); err == nil {
+		if end {
+			d = d.AddDate(0, 0, 1)
+		}
+		return d, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// GetStatement streams the statement of the caller over a period as JSON, CSV or OFX.
+// Services give the user in the user_id query parameter.
+func (s *RequestHandler) GetStatement(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	values := r.URL.Query()
+
+	userID := values.Get("user_id")
+	if r.Header.Get(common.PrincipalTypeHeader) == "user" {
+		userID = r.Header.Get(common.PrincipalIDHeader)
+	}
+
+	format := values.Get("format")
+	if format == "" {
+		format = "json"
+	}
+
+	f, ok := statementFormats[format]
+	from, fromErr := parseStatementTime(values.Get("from"), false)
+	to, toErr := parseStatementTime(values.Get("to"), true)
+
+	if userID == "" || !ok || fromErr != nil || toErr != nil {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request",
+			"user_id, from and to as dates or RFC 3339 times are required, format must be json, csv or ofx")
+		return
+	}
+
+	response := &streamResponse{
+		w:           w,
+		contentType: f.contentType,
+		filename:    fmt.Sprintf("statement-%s-%s-%s.%s", userID, from.Format(dateFormat), to.Format(dateFormat), format),
+	}
+
+	err := s.db.WriteStatement(r.Context(), domain.GetStatement{UserID: userID, From: from, To: to}, f.writer(response))
+	if err == nil {
+		return
+	}
+
+	log.Error().Err(err).Str(logTraceID, traceID).Msg("could not write statement")
+
+	if !response.started {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	// part of the statement was sent, the response is cut short so that the client does not take it for a whole one
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/common"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// CreateWebhook subscribes a URL to the payment events of a user, the secret signing the deliveries is only
+// returned in the response
+func (s *RequestHandler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not read request")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	request := domain.CreateWebhookSubscription{}
+
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.UserID == "" || request.URL == "" {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "user_id, url and event_types are required")
+		return
+	}
+
+	if !canSee(r, request.UserID) {
+		common.WriteError(w, http.StatusForbidden, "forbidden", "users can only subscribe to their own events")
+		return
+	}
+
+	webhook, err := s.db.CreateWebhookSubscription(request)
+	if err != nil {
+		log.Error().Err(err).Str(logTraceID, traceID).Msg("could not create webhook")
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webhook, traceID)
+}
+
+// ListWebhooks returns the webhooks of the caller, services give the user in the user_id query parameter
+func (s *RequestHandler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	userID := r.URL.Query().Get("user_id")
+	if r.Header.Get(common.PrincipalTypeHeader) == "user" {
+		userID = r.Header.Get(common.PrincipalIDHeader)
+	}
+
+	if userID == "" {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "user_id is required")
+		return
+	}
+
+	webhooks, err := s.db.ListWebhookSubscriptions(userID)
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webhooks, traceID)
+}
+
+// DeleteWebhook stops the deliveries to a webhook
+func (s *RequestHandler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	subscriptionID := mux.Vars(r)["id"]
+
+	webhook, err := s.db.GetWebhookSubscription(subscriptionID)
+	if err == nil && !canSee(r, webhook.UserID) {
+		err = domain.ErrWebhookNotFound
+	}
+
+	if err == nil {
+		webhook, err = s.db.DeleteWebhookSubscription(subscriptionID)
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, webhook, traceID)
+}
+
+// ListWebhookDeliveries returns the latest deliveries to the webhooks of the caller, status=dead lists
+// those that gave up
+func (s *RequestHandler) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	request := domain.ListWebhookDeliveries{
+		UserID: r.URL.Query().Get("user_id"),
+		Status: r.URL.Query().Get("status"),
+	}
+
+	if r.Header.Get(common.PrincipalTypeHeader) == "user" {
+		request.UserID = r.Header.Get(common.PrincipalIDHeader)
+	}
+
+	if request.UserID == "" {
+		common.WriteError(w, http.StatusBadRequest, "invalid_request", "user_id is required")
+		return
+	}
+
+	deliveries, err := s.db.ListWebhookDeliveries(request)
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deliveries, traceID)
+}
+
+// GetWebhookDelivery returns a delivery along with the response to each of its attempts
+func (s *RequestHandler) GetWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	delivery, err := s.db.GetWebhookDelivery(mux.Vars(r)["id"])
+	if err == nil && !canSee(r, delivery.UserID) {
+		err = domain.ErrDeliveryNotFound
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery, traceID)
+}
+
+// ReplayWebhookDelivery sends a delivery again, dead-lettered deliveries included
+func (s *RequestHandler) ReplayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	traceID := common.ExtractTraceIDFromReq(r)
+
+	deliveryID := mux.Vars(r)["id"]
+
+	delivery, err := s.db.GetWebhookDelivery(deliveryID)
+	if err == nil && !canSee(r, delivery.UserID) {
+		err = domain.ErrDeliveryNotFound
+	}
+
+	if err == nil {
+		delivery, err = s.db.ReplayWebhookDelivery(deliveryID)
+	}
+
+	if err != nil {
+		writeDomainError(w, err, traceID)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery, traceID)
+}
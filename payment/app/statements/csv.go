@@ -0,0 +1,49 @@
+package statements
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+const timeFormat = time.RFC3339
+
+// CSV writes statements as CSV, the opening and closing balances are the first and last rows
+type CSV struct {
+	w *csv.Writer
+}
+
+func NewCSV(w io.Writer) *CSV {
+	return &CSV{w: csv.NewWriter(w)}
+}
+
+func (c *CSV) Begin(s domain.Statement) error {
+	err := c.w.Write([]string{"date", "transaction_id", "kind", "counterparty", "description", "amount", "currency", "balance"})
+	if err != nil {
+		return err
+	}
+
+	return c.w.Write([]string{s.From.UTC().Format(timeFormat), "", "", "", "Opening balance", "", s.Currency, amount(s.OpeningBalance)})
+}
+
+func (c *CSV) Line(l domain.StatementLine) error {
+	return c.w.Write([]string{l.Date.UTC().Format(timeFormat), l.TransactionID, l.Kind, l.Counterparty, l.Description,
+		amount(l.Amount), l.Currency, amount(l.Balance)})
+}
+
+func (c *CSV) End(s domain.Statement) error {
+	err := c.w.Write([]string{s.To.UTC().Format(timeFormat), "", "", "", "Closing balance", "", s.Currency, amount(s.ClosingBalance)})
+	if err != nil {
+		return err
+	}
+
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func amount(a float64) string {
+	return strconv.FormatFloat(a, 'f', 2, 64)
+}
@@ -0,0 +1,60 @@
+package statements
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+// JSON writes statements as a JSON object whose lines are written as they come
+type JSON struct {
+	w     io.Writer
+	lines int
+}
+
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{w: w}
+}
+
+func (j *JSON) Begin(s domain.Statement) error {
+	header, err := json.Marshal(struct {
+		UserID         string  `json:"user_id"`
+		Currency       string  `json:"currency"`
+		From           string  `json:"from"`
+		To             string  `json:"to"`
+		OpeningBalance float64 `json:"opening_balance"`
+	}{s.UserID, s.Currency, s.From.UTC().Format(timeFormat), s.To.UTC().Format(timeFormat), s.OpeningBalance})
+	if err != nil {
+		return err
+	}
+
+	// the object is left open for the lines
+	_, err = j.w.Write(append(header[:len(header)-1], `,"lines":[`...))
+	return err
+}
+
+func (j *JSON) Line(l domain.StatementLine) error {
+	line, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	if j.lines > 0 {
+		line = append([]byte(","), line...)
+	}
+	j.lines++
+
+	_, err = j.w.Write(line)
+	return err
+}
+
+func (j *JSON) End(s domain.Statement) error {
+	closing, err := json.Marshal(s.ClosingBalance)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.w.Write(append(append([]byte(`],"closing_balance":`), closing...), '}'))
+	return err
+}
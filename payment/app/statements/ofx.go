@@ -0,0 +1,76 @@
+package statements
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+const ofxTimeFormat = "20060102150405"
+
+// OFX writes statements as OFX 2.2 bank statements, which accounting tools import. OFX has no opening balance
+// nor running balance, the closing balance is the ledger balance.
+type OFX struct {
+	w   io.Writer
+	err error
+}
+
+func NewOFX(w io.Writer) *OFX {
+	return &OFX{w: w}
+}
+
+// printf writes until the first error, which is returned by the method that wrote
+func (o *OFX) printf(format string, args ...interface{}) {
+	if o.err == nil {
+		_, o.err = fmt.Fprintf(o.w, format, args...)
+	}
+}
+
+func (o *OFX) Begin(s domain.Statement) error {
+	o.printf(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n")
+	o.printf(`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n")
+	o.printf("<OFX><SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>")
+	o.printf("<DTSERVER>%s</DTSERVER><LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>\n", time.Now().UTC().Format(ofxTimeFormat))
+	o.printf("<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>")
+	o.printf("<STMTRS><CURDEF>%s</CURDEF>", escape(s.Currency))
+	o.printf("<BANKACCTFROM><BANKID>PAYMENT</BANKID><ACCTID>%s</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>\n",
+		escape(s.UserID))
+	o.printf("<BANKTRANLIST><DTSTART>%s</DTSTART><DTEND>%s</DTEND>\n",
+		s.From.UTC().Format(ofxTimeFormat), s.To.UTC().Format(ofxTimeFormat))
+	return o.err
+}
+
+func (o *OFX) Line(l domain.StatementLine) error {
+	trnType := "CREDIT"
+	switch {
+	case l.Kind == domain.KindFee:
+		trnType = "FEE"
+	case l.Amount < 0:
+		trnType = "DEBIT"
+	}
+
+	o.printf("<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%s</TRNAMT><FITID>%s</FITID><NAME>%s</NAME>",
+		trnType, l.Date.UTC().Format(ofxTimeFormat), amount(l.Amount), escape(l.TransactionID), escape(l.Counterparty))
+	if l.Description != "" {
+		o.printf("<MEMO>%s</MEMO>", escape(l.Description))
+	}
+	o.printf("</STMTTRN>\n")
+	return o.err
+}
+
+func (o *OFX) End(s domain.Statement) error {
+	o.printf("</BANKTRANLIST><LEDGERBAL><BALAMT>%s</BALAMT><DTASOF>%s</DTASOF></LEDGERBAL>",
+		amount(s.ClosingBalance), s.To.UTC().Format(ofxTimeFormat))
+	o.printf("</STMTRS></STMTTRNRS></BANKMSGSRSV1></OFX>\n")
+	return o.err
+}
+
+func escape(s string) string {
+	b := strings.Builder{}
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package statements
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+)
+
+var (
+	statement = domain.Statement{
+		UserID:         "1",
+		Currency:       "SGD",
+		From:           time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+		To:             time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+		OpeningBalance: 100,
+		ClosingBalance: 79.5,
+	}
+
+	lines = []domain.StatementLine{
+		{TransactionID: "a", Date: time.Date(2026, 10, 2, 9, 30, 0, 0, time.UTC), Kind: domain.KindPayment, Counterparty: "2",
+			Description: `dinner, "the usual"`, Amount: -20, Currency: "SGD", Balance: 80},
+		{TransactionID: "b", Date: time.Date(2026, 10, 3, 9, 30, 0, 0, time.UTC), Kind: domain.KindFee, Counterparty: "house",
+			Amount: -0.5, Currency: "SGD", Balance: 79.5},
+	}
+)
+
+func write(t *testing.T, w domain.StatementWriter) {
+	if err := w.Begin(statement); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, l := range lines {
+		if err := w.Line(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.End(statement); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCSV(t *testing.T) {
+	b := &bytes.Buffer{}
+	write(t, NewCSV(b))
+
+	expected := `date,transaction_id,kind,counterparty,description,amount,currency,balance
+2026-10-01T00:00:00Z,,,,Opening balance,,SGD,100.00
+2026-10-02T09:30:00Z,a,payment,2,"dinner, ""the usual""",-20.00,SGD,80.00
+2026-10-03T09:30:00Z,b,fee,house,,-0.50,SGD,79.50
+2026-11-01T00:00:00Z,,,,Closing balance,,SGD,79.50
+`
+
+	if b.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, b.String())
+	}
+}
+
+func TestJSON(t *testing.T) {
+	b := &bytes.Buffer{}
+	write(t, NewJSON(b))
+
+	got := struct {
+		UserID         string                 `json:"user_id"`
+		OpeningBalance float64                `json:"opening_balance"`
+		ClosingBalance float64                `json:"closing_balance"`
+		Lines          []domain.StatementLine `json:"lines"`
+	}{}
+
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("expected valid JSON, got %v: %s", err, b.String())
+	}
+
+	if got.UserID != "1" || got.OpeningBalance != 100 || got.ClosingBalance != 79.5 || len(got.Lines) != 2 || got.Lines[1].Balance != 79.5 {
+		t.Errorf("unexpected statement %+v", got)
+	}
+
+	b.Reset()
+	w := NewJSON(b)
+	if err := w.Begin(statement); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.End(statement); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil || len(got.Lines) != 0 {
+		t.Errorf("expected a statement without lines, got %v: %s", err, b.String())
+	}
+}
+
+func TestOFX(t *testing.T) {
+	b := &bytes.Buffer{}
+	write(t, NewOFX(b))
+
+	for _, expected := range []string{
+		"<CURDEF>SGD</CURDEF>",
+		"<ACCTID>1</ACCTID>",
+		"<DTSTART>20261001000000</DTSTART><DTEND>20261101000000</DTEND>",
+		"<STMTTRN><TRNTYPE>DEBIT</TRNTYPE><DTPOSTED>20261002093000</DTPOSTED><TRNAMT>-20.00</TRNAMT><FITID>a</FITID>" +
+			"<NAME>2</NAME><MEMO>dinner, &#34;the usual&#34;</MEMO></STMTTRN>",
+		"<TRNTYPE>FEE</TRNTYPE>",
+		"<LEDGERBAL><BALAMT>79.50</BALAMT>",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected %s in\n%s", expected, b.String())
+		}
+	}
+}
@@ -2,14 +2,21 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"expvar"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
 
 	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/domain"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/events"
+	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/funding"
 	"github.com/heetch/MehdiSouilhed-technical-test/payment/app/handlers"
 )
 
@@ -24,9 +31,17 @@ const (
 // Make sure a postgres instance is running or these tests will fail
 
 func main() {
+	reconcileOnce := flag.Bool("reconcile", false, "reconcile the balances with the transactions, print the report as JSON and exit")
+	record := flag.Bool("record", false, "with -reconcile, write the discrepancies to the discrepancies table")
+	flag.Parse()
+
 	r := mux.NewRouter()
 
-	var err error
+	config, err := domain.ParseFileConfig("config.yaml")
+	if err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
 
 	psqlInfo := fmt.Sprintf(
 		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
@@ -40,13 +55,231 @@ func main() {
 	defer db.Close()
 
 	sqlDB := domain.NewSQLDatabase(db)
+	sqlDB.SetLimits(config.Limits)
+
+	risk, err := domain.NewRuleEngine(config.Risk)
+	if err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+	sqlDB.SetRiskEvaluator(risk)
+
+	err = sqlDB.SetFees(config.Fees)
+	if err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+
+	// the simulator settles fundings in process, a real provider would call /funding/events
+	switch config.Funding.Provider {
+	case "":
+		log.Print("no funding provider, deposits and withdrawals are refused")
+	case domain.FundingProviderSimulator:
+		sqlDB.SetFundingProvider(funding.NewSimulator(config.Funding.SimulatorDelay, func(e domain.FundingEvent) error {
+			_, err := sqlDB.HandleFundingEvent(e)
+			return err
+		}))
+	default:
+		log.Printf("unknown funding provider %q", config.Funding.Provider)
+		os.Exit(2)
+	}
+
+	sqlDB.SetWebhooks(config.Webhooks)
+	sqlDB.SetAdmin(config.Admin)
+
+	err = sqlDB.SetLocks(config.Locks)
+	if err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+
+	err = sqlDB.SetConsistency(config.Consistency)
+	if err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+
+	// the exit status is 1 when discrepancies were found, so that scripts can alert on it
+	if *reconcileOnce {
+		report, err := sqlDB.Reconcile(*record)
+		if err != nil {
+			log.Print(err)
+			os.Exit(2)
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			log.Print(err)
+			os.Exit(2)
+		}
+
+		if len(report.Discrepancies) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
 	handler := handlers.NewRequestHandler(sqlDB)
+	handler.SetFundingEvents(config.FundingEvents)
 
 	r.HandleFunc("/pay_user", handler.PayUser).Methods(http.MethodPost)
+	r.HandleFunc("/quote", handler.Quote).Methods(http.MethodGet)
 	r.HandleFunc("/get_transactions", handler.GetTransactions).Methods(http.MethodPost)
+	r.HandleFunc("/transactions", handler.FindTransaction).Methods(http.MethodGet)
+	r.HandleFunc("/statements", handler.GetStatement).Methods(http.MethodGet)
+	r.HandleFunc("/transactions/{id}", handler.GetTransaction).Methods(http.MethodGet)
+	r.HandleFunc("/transactions/{id}/refund", handler.Refund).Methods(http.MethodPost)
+	r.HandleFunc("/transactions/{id}/release", handler.ReleaseTransaction).Methods(http.MethodPost)
+	r.HandleFunc("/transactions/{id}/reject", handler.RejectTransaction).Methods(http.MethodPost)
+	r.HandleFunc("/reviews", handler.ListReviews).Methods(http.MethodGet)
+	r.HandleFunc("/holds", handler.CreateHold).Methods(http.MethodPost)
+	r.HandleFunc("/holds/{id}", handler.GetHold).Methods(http.MethodGet)
+	r.HandleFunc("/holds/{id}/capture", handler.CaptureHold).Methods(http.MethodPost)
+	r.HandleFunc("/holds/{id}/void", handler.VoidHold).Methods(http.MethodPost)
+	r.HandleFunc("/schedules", handler.CreateSchedule).Methods(http.MethodPost)
+	r.HandleFunc("/schedules", handler.ListSchedules).Methods(http.MethodGet)
+	r.HandleFunc("/schedules/{id}", handler.GetSchedule).Methods(http.MethodGet)
+	r.HandleFunc("/schedules/{id}/cancel", handler.CancelSchedule).Methods(http.MethodPost)
+	r.HandleFunc("/money_requests", handler.CreateMoneyRequest).Methods(http.MethodPost)
+	r.HandleFunc("/money_requests", handler.ListMoneyRequests).Methods(http.MethodGet)
+	r.HandleFunc("/money_requests/{id}", handler.GetMoneyRequest).Methods(http.MethodGet)
+	r.HandleFunc("/money_requests/{id}/accept", handler.AcceptMoneyRequest).Methods(http.MethodPost)
+	r.HandleFunc("/money_requests/{id}/decline", handler.DeclineMoneyRequest).Methods(http.MethodPost)
+	r.HandleFunc("/money_requests/{id}/cancel", handler.CancelMoneyRequest).Methods(http.MethodPost)
+	r.HandleFunc("/batches", handler.CreateBatch).Methods(http.MethodPost)
+	r.HandleFunc("/batches/{id}", handler.GetBatch).Methods(http.MethodGet)
+	r.HandleFunc("/splits", handler.CreateSplit).Methods(http.MethodPost)
+	r.HandleFunc("/splits/{id}", handler.GetSplit).Methods(http.MethodGet)
+	r.HandleFunc("/deposits", handler.Deposit).Methods(http.MethodPost)
+	r.HandleFunc("/withdrawals", handler.Withdraw).Methods(http.MethodPost)
+	r.HandleFunc("/fundings/{id}", handler.GetFunding).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks", handler.CreateWebhook).Methods(http.MethodPost)
+	r.HandleFunc("/webhooks", handler.ListWebhooks).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks/deliveries", handler.ListWebhookDeliveries).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks/deliveries/{id}", handler.GetWebhookDelivery).Methods(http.MethodGet)
+	r.HandleFunc("/webhooks/deliveries/{id}/replay", handler.ReplayWebhookDelivery).Methods(http.MethodPost)
+	r.HandleFunc("/webhooks/{id}", handler.DeleteWebhook).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/accounts/{id}", handler.GetAccount).Methods(http.MethodGet)
+	r.HandleFunc("/admin/accounts/{id}/status", handler.SetAccountStatus).Methods(http.MethodPost)
+	r.HandleFunc("/admin/adjustments", handler.CreateAdjustment).Methods(http.MethodPost)
+	r.HandleFunc("/admin/adjustments", handler.ListAdjustments).Methods(http.MethodGet)
+	r.HandleFunc("/admin/adjustments/{id}", handler.GetAdjustment).Methods(http.MethodGet)
+	r.HandleFunc("/admin/adjustments/{id}/approve", handler.ApproveAdjustment).Methods(http.MethodPost)
+	r.HandleFunc("/admin/adjustments/{id}/reject", handler.RejectAdjustment).Methods(http.MethodPost)
+	r.HandleFunc("/admin/transactions", handler.SearchTransactions).Methods(http.MethodGet)
+	r.HandleFunc("/admin/audit", handler.ListAuditLog).Methods(http.MethodGet)
+
+	// internal routes, not published by the gateway
+	r.HandleFunc("/balances", handler.OpenBalance).Methods(http.MethodPost)
+	r.HandleFunc("/funding/events", handler.FundingEvent).Methods(http.MethodPost)
+
+	go expire("holds", sqlDB.ExpireHolds, time.Minute)
+	go expire("money requests", sqlDB.ExpireMoneyRequests, time.Minute)
+	go runSchedules(sqlDB, time.Minute)
+
+	// events go to the webhooks of their users, and to nsqd when there is one
+	publishers := domain.Publishers{sqlDB.WebhookPublisher()}
+	if config.Events.NSQD != "" {
+		publishers = append(publishers, events.NewNSQ(&http.Client{Timeout: 5 * time.Second}, config.Events.NSQD, config.Events.Topic))
+	}
+
+	go relayEvents(sqlDB, publishers, config.Events.RelayInterval)
+	go deliverWebhooks(sqlDB, domain.NewWebhookClient(10*time.Second), config.Webhooks.Interval)
+
+	if config.Reconciliation.Interval > 0 {
+		go reconcile(sqlDB, config.Reconciliation)
+	}
+
+	// monitoring is served on a separate port, /debug/vars is not exposed to the outside world
+	expvar.Publish("locks", expvar.Func(sqlDB.LockStats))
+	go func() {
+		log.Print("Serving metrics on port 8080")
+		log.Fatal(http.ListenAndServe(":8080", nil))
+	}()
 
 	log.Print("Listening on port 80")
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", 80), r))
 
 }
+
+// expire periodically updates the status of what is past its expiry
+func expire(what string, expire func() (int64, error), every time.Duration) {
+	for range time.Tick(every) {
+		n, err := expire()
+		if err != nil {
+			log.Printf("could not expire %s: %s", what, err)
+			continue
+		}
+
+		if n > 0 {
+			log.Printf("%d %s expired", n, what)
+		}
+	}
+}
+
+// runSchedules pays the scheduled payments that are due, until none is left
+func runSchedules(db *domain.SQLDatabase, every time.Duration) {
+	for range time.Tick(every) {
+		for {
+			n, err := db.RunDueSchedules()
+			if err != nil {
+				log.Printf("could not run scheduled payments: %s", err)
+			}
+
+			if err != nil || n == 0 {
+				break
+			}
+
+			log.Printf("%d scheduled payments ran", n)
+		}
+	}
+}
+
+// relayEvents publishes the events of the outbox, until none is left
+func relayEvents(db *domain.SQLDatabase, publisher domain.Publisher, every time.Duration) {
+	for range time.Tick(every) {
+		for {
+			n, err := db.RelayEvents(publisher)
+			if err != nil {
+				log.Printf("could not relay events: %s", err)
+			}
+
+			if err != nil || n == 0 {
+				break
+			}
+		}
+	}
+}
+
+// deliverWebhooks sends the webhook deliveries that are due, until none is left
+func deliverWebhooks(db *domain.SQLDatabase, client *http.Client, every time.Duration) {
+	for range time.Tick(every) {
+		for {
+			n, err := db.DeliverWebhooks(client)
+			if err != nil {
+				log.Printf("could not deliver webhooks: %s", err)
+			}
+
+			if err != nil || n == 0 {
+				break
+			}
+		}
+	}
+}
+
+// reconcile periodically compares the balances with the transactions and logs the discrepancies it finds
+func reconcile(db *domain.SQLDatabase, config domain.ReconciliationConfig) {
+	for range time.Tick(config.Interval) {
+		report, err := db.Reconcile(config.Record)
+		if err != nil {
+			log.Printf("could not reconcile balances: %s", err)
+			continue
+		}
+
+		if len(report.Discrepancies) > 0 {
+			b, _ := json.Marshal(report)
+			log.Printf("%d balances differ from their transactions: %s", len(report.Discrepancies), b)
+		}
+	}
+}
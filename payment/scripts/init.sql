@@ -1,4 +1,4 @@
-DROP TABLE IF EXISTS transactions, balance;
+DROP TABLE IF EXISTS account_locks, discrepancies, audit_log, adjustments, account_status_changes, webhook_attempts, webhook_deliveries, webhook_subscriptions, outbox, fundings, batch_items, batches, split_parts, money_requests, splits, schedule_runs, schedules, holds, transactions, balance;
 
 CREATE TABLE transactions (
   id SERIAL PRIMARY KEY,
@@ -9,17 +9,317 @@ CREATE TABLE transactions (
   message VARCHAR(128),
   amount FLOAT,
   currency VARCHAR(3),
-  createdAt timestamp NOT NULL DEFAULT NOW()
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  kind VARCHAR(16) NOT NULL DEFAULT 'payment',
+  originalTransactionId VARCHAR(36) REFERENCES transactions (transactionId),
+  status VARCHAR(16) NOT NULL DEFAULT 'completed',
+  failureReason VARCHAR(128),
+  riskReasons VARCHAR(256),
+  fee FLOAT NOT NULL DEFAULT 0,
+  -- when the money moved, NULL while it has not
+  settledAt timestamp
 );
 
+CREATE INDEX transactions_sender_idx ON transactions (senderid, createdAt);
+CREATE INDEX transactions_status_idx ON transactions (status);
+CREATE INDEX transactions_original_idx ON transactions (originalTransactionId);
+
 CREATE TABLE balance (
-  id SERIAL PRIMARY KEY,
+  -- id is also the key of the advisory lock of the account
+  id BIGSERIAL PRIMARY KEY,
   userId  VARCHAR(36) UNIQUE,
   amount FLOAT,
   lastTransactionId VARCHAR(36),
+  tier VARCHAR(16) NOT NULL DEFAULT 'standard',
+  status VARCHAR(16) NOT NULL DEFAULT 'active',
   updatedAt timestamp NOT NULL DEFAULT NOW()
 );
 
+-- a row per account locked by the for_update lock strategy, the rows are locked instead of the balances
+CREATE TABLE account_locks (
+  userId VARCHAR(36) PRIMARY KEY
+);
+
+-- balances that differ from the sum of the transactions of their user, found by the reconciliation
+CREATE TABLE discrepancies (
+  id SERIAL PRIMARY KEY,
+  userid VARCHAR(36) NOT NULL,
+  storedBalance FLOAT NOT NULL,
+  computedBalance FLOAT NOT NULL,
+  difference FLOAT NOT NULL,
+  lastTransactionId VARCHAR(36),
+  firstRunId VARCHAR(36) NOT NULL,
+  lastRunId VARCHAR(36) NOT NULL,
+  detectedAt timestamp NOT NULL DEFAULT NOW(),
+  lastSeenAt timestamp NOT NULL DEFAULT NOW(),
+  resolvedAt timestamp
+);
+
+CREATE UNIQUE INDEX discrepancies_open_idx ON discrepancies (userid) WHERE resolvedAt IS NULL;
+
+CREATE TABLE account_status_changes (
+  id SERIAL PRIMARY KEY,
+  userid VARCHAR(36) NOT NULL,
+  fromStatus VARCHAR(16) NOT NULL,
+  toStatus VARCHAR(16) NOT NULL,
+  reason VARCHAR(256) NOT NULL,
+  changedBy VARCHAR(64) NOT NULL,
+  createdAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX account_status_changes_user_idx ON account_status_changes (userid);
+
+CREATE TABLE adjustments (
+  id SERIAL PRIMARY KEY,
+  adjustmentId VARCHAR(36) UNIQUE NOT NULL,
+  requestId VARCHAR(36) UNIQUE NOT NULL,
+  userid VARCHAR(36) NOT NULL,
+  direction VARCHAR(16) NOT NULL,
+  amount FLOAT NOT NULL,
+  currency VARCHAR(3) NOT NULL,
+  reasonCode VARCHAR(32) NOT NULL,
+  ticket VARCHAR(64) NOT NULL,
+  message VARCHAR(128),
+  status VARCHAR(16) NOT NULL,
+  createdBy VARCHAR(64) NOT NULL,
+  reviewedBy VARCHAR(64),
+  rejectionReason VARCHAR(256),
+  transactionId VARCHAR(36),
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  updatedAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX adjustments_status_idx ON adjustments (status);
+
+-- the audit log is append-only, updates and deletes are refused
+CREATE TABLE audit_log (
+  id BIGSERIAL PRIMARY KEY,
+  actor VARCHAR(64) NOT NULL,
+  action VARCHAR(32) NOT NULL,
+  target VARCHAR(64),
+  details TEXT NOT NULL,
+  createdAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_log_actor_idx ON audit_log (actor);
+CREATE INDEX audit_log_target_idx ON audit_log (target);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'the audit log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+  FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();
+
+CREATE TABLE outbox (
+  id BIGSERIAL PRIMARY KEY,
+  eventId VARCHAR(36) UNIQUE NOT NULL,
+  type VARCHAR(32) NOT NULL,
+  senderid VARCHAR(36) NOT NULL,
+  receiverid VARCHAR(36) NOT NULL,
+  payload TEXT NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  lastError VARCHAR(256),
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  publishedAt timestamp
+);
+
+CREATE INDEX outbox_unpublished_idx ON outbox (id) WHERE publishedAt IS NULL;
+
+CREATE TABLE webhook_subscriptions (
+  id SERIAL PRIMARY KEY,
+  subscriptionId VARCHAR(36) UNIQUE NOT NULL,
+  userid VARCHAR(36) NOT NULL,
+  url VARCHAR(512) NOT NULL,
+  secret VARCHAR(64) NOT NULL,
+  eventTypes VARCHAR(256) NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  createdAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX webhook_subscriptions_user_idx ON webhook_subscriptions (userid);
+
+CREATE TABLE webhook_deliveries (
+  id SERIAL PRIMARY KEY,
+  deliveryId VARCHAR(36) UNIQUE NOT NULL,
+  subscriptionId VARCHAR(36) NOT NULL REFERENCES webhook_subscriptions (subscriptionId),
+  eventId VARCHAR(36) NOT NULL,
+  eventType VARCHAR(32) NOT NULL,
+  payload TEXT NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  nextAttemptAt timestamp,
+  leaseId VARCHAR(36),
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  updatedAt timestamp NOT NULL DEFAULT NOW(),
+  UNIQUE (subscriptionId, eventId)
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (nextAttemptAt) WHERE status = 'pending';
+
+CREATE TABLE webhook_attempts (
+  id SERIAL PRIMARY KEY,
+  deliveryId VARCHAR(36) NOT NULL REFERENCES webhook_deliveries (deliveryId),
+  statusCode INTEGER,
+  response VARCHAR(1024),
+  error VARCHAR(256),
+  durationMs INTEGER NOT NULL,
+  createdAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE fundings (
+  id SERIAL PRIMARY KEY,
+  fundingId VARCHAR(36) UNIQUE NOT NULL,
+  requestId VARCHAR(36) UNIQUE NOT NULL,
+  userid VARCHAR(36) NOT NULL,
+  direction VARCHAR(16) NOT NULL,
+  method VARCHAR(16) NOT NULL,
+  source VARCHAR(64),
+  amount FLOAT NOT NULL,
+  currency VARCHAR(3),
+  status VARCHAR(16) NOT NULL,
+  providerRef VARCHAR(64),
+  failureReason VARCHAR(128),
+  transactionId VARCHAR(36) REFERENCES transactions (transactionId),
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  updatedAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX fundings_user_status_idx ON fundings (userid, status);
+
+CREATE TABLE holds (
+  id SERIAL PRIMARY KEY,
+  holdId VARCHAR(36) UNIQUE NOT NULL,
+  requestId VARCHAR(36) UNIQUE NOT NULL,
+  senderid VARCHAR(36) NOT NULL,
+  receiverid VARCHAR(36) NOT NULL,
+  amount FLOAT NOT NULL,
+  capturedAmount FLOAT NOT NULL DEFAULT 0,
+  currency VARCHAR(3),
+  message VARCHAR(128),
+  status VARCHAR(16) NOT NULL,
+  transactionId VARCHAR(36) REFERENCES transactions (transactionId),
+  expiresAt timestamp NOT NULL,
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  updatedAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX holds_sender_status_idx ON holds (senderid, status);
+
+CREATE TABLE schedules (
+  id SERIAL PRIMARY KEY,
+  scheduleId VARCHAR(36) UNIQUE NOT NULL,
+  requestId VARCHAR(36) UNIQUE NOT NULL,
+  senderid VARCHAR(36) NOT NULL,
+  receiverid VARCHAR(36) NOT NULL,
+  amount FLOAT NOT NULL,
+  currency VARCHAR(3),
+  message VARCHAR(128),
+  recurrence VARCHAR(128) NOT NULL DEFAULT '',
+  startAt timestamptz NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  nextRunAt timestamptz,
+  runCount INTEGER NOT NULL DEFAULT 0,
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  updatedAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX schedules_due_idx ON schedules (status, nextRunAt);
+CREATE INDEX schedules_sender_idx ON schedules (senderid);
+
+CREATE TABLE schedule_runs (
+  id SERIAL PRIMARY KEY,
+  scheduleId VARCHAR(36) NOT NULL REFERENCES schedules (scheduleId),
+  occurrence INTEGER NOT NULL,
+  scheduledAt timestamptz NOT NULL,
+  requestId VARCHAR(36) NOT NULL,
+  transactionId VARCHAR(36) NOT NULL REFERENCES transactions (transactionId),
+  status VARCHAR(16) NOT NULL,
+  failureReason VARCHAR(128),
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  UNIQUE (scheduleId, occurrence)
+);
+
+CREATE TABLE splits (
+  id SERIAL PRIMARY KEY,
+  splitId VARCHAR(36) UNIQUE NOT NULL,
+  requestId VARCHAR(36) UNIQUE NOT NULL,
+  creatorid VARCHAR(36) NOT NULL,
+  totalAmount FLOAT NOT NULL,
+  currency VARCHAR(3),
+  message VARCHAR(128),
+  method VARCHAR(16) NOT NULL,
+  status VARCHAR(16) NOT NULL,
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  updatedAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE money_requests (
+  id SERIAL PRIMARY KEY,
+  moneyRequestId VARCHAR(36) UNIQUE NOT NULL,
+  requestId VARCHAR(36) UNIQUE NOT NULL,
+  requesterid VARCHAR(36) NOT NULL,
+  payerid VARCHAR(36) NOT NULL,
+  amount FLOAT NOT NULL,
+  currency VARCHAR(3),
+  message VARCHAR(128),
+  status VARCHAR(16) NOT NULL,
+  transactionId VARCHAR(36) REFERENCES transactions (transactionId),
+  splitId VARCHAR(36) REFERENCES splits (splitId),
+  expiresAt timestamp NOT NULL,
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  updatedAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX money_requests_payer_idx ON money_requests (payerid, status);
+CREATE INDEX money_requests_requester_idx ON money_requests (requesterid, status);
+CREATE INDEX money_requests_split_idx ON money_requests (splitId);
+
+CREATE TABLE split_parts (
+  id SERIAL PRIMARY KEY,
+  splitId VARCHAR(36) NOT NULL REFERENCES splits (splitId),
+  idx INTEGER NOT NULL,
+  userid VARCHAR(36) NOT NULL,
+  amount FLOAT NOT NULL,
+  moneyRequestId VARCHAR(36) REFERENCES money_requests (moneyRequestId),
+  UNIQUE (splitId, idx),
+  UNIQUE (splitId, userid)
+);
+
+CREATE TABLE batches (
+  id SERIAL PRIMARY KEY,
+  batchId VARCHAR(36) UNIQUE NOT NULL,
+  requestId VARCHAR(36) UNIQUE NOT NULL,
+  senderid VARCHAR(36) NOT NULL,
+  mode VARCHAR(16) NOT NULL,
+  status VARCHAR(32) NOT NULL,
+  totalAmount FLOAT NOT NULL,
+  createdAt timestamp NOT NULL DEFAULT NOW(),
+  updatedAt timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE batch_items (
+  id SERIAL PRIMARY KEY,
+  batchId VARCHAR(36) NOT NULL REFERENCES batches (batchId),
+  idx INTEGER NOT NULL,
+  requestId VARCHAR(36) UNIQUE NOT NULL,
+  recipientid VARCHAR(36) NOT NULL,
+  amount FLOAT NOT NULL,
+  currency VARCHAR(3),
+  message VARCHAR(128),
+  status VARCHAR(16) NOT NULL,
+  transactionId VARCHAR(36) REFERENCES transactions (transactionId),
+  failureReason VARCHAR(128),
+  UNIQUE (batchId, idx)
+);
+
 
-INSERT into balance (userid, amount ) VALUES ('1', '1000');
+-- the money of user 1 came in through a deposit, so that its balance matches its transactions
+INSERT into transactions (requestid, transactionid, senderid, receiverid, message, amount, currency, kind, settledat)
+VALUES ('00000000-0000-0000-0000-000000000001', '00000000-0000-0000-0000-000000000001', 'external', '1', 'opening balance', 1000, 'SGD', 'deposit', NOW());
+INSERT into balance (userid, amount, lastTransactionId) VALUES ('1', '1000', '00000000-0000-0000-0000-000000000001');
 INSERT into balance (userid, amount ) VALUES ('2', '0');
+-- the house account collects the fees
+INSERT into balance (userid, amount ) VALUES ('house', '0');